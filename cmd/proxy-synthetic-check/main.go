@@ -1,33 +1,92 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
 
 	"eugene-chernyshenko/proxy-synthetic-check/internal/config"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/history"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/kafka"
 	"eugene-chernyshenko/proxy-synthetic-check/internal/metrics"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/proxy"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/request"
 	"eugene-chernyshenko/proxy-synthetic-check/internal/runner"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/tracing"
 )
 
 func main() {
+	configFile := flag.String("config", "", "Config file path (default $"+config.ConfigEnvVar+", else "+config.DefaultConfigFile+")")
+	configDir := flag.String("config-dir", "", "Load and merge all .yaml files from this directory instead of a single config file")
+	runOnceEnv, _ := strconv.ParseBool(os.Getenv("RUN_ONCE"))
+	once := flag.Bool("once", runOnceEnv, "Check every proxy once, print the results and exit 1 if any check failed (default $RUN_ONCE)")
+	onceMetrics := flag.Bool("once-metrics", false, "With -once, also write the metrics to stdout in Prometheus text format")
+	flag.Parse()
+
+	if flag.Arg(0) == "validate-schema" {
+		os.Exit(validateSchema(flag.Args()[1:], *configFile, *configDir))
+	}
+
 	// Load YAML config
-	cfg, err := config.Load()
+	loadConfig := func() (*config.ProxyConfig, error) {
+		if *configDir != "" {
+			return config.LoadDir(*configDir)
+		}
+		return config.Load(config.ResolvePath(*configFile))
+	}
+	cfg, err := loadConfig()
 	if err != nil {
 		log.Fatalf("Error loading proxy configuration: %v", err)
 	}
 
+	if flag.Arg(0) == "schema" {
+		os.Exit(printSchema(cfg))
+	}
+
 	// Initialize metrics with collected label keys
 	buckets := cfg.GetLatencyBuckets()
-	m := metrics.New(cfg.Proxies, buckets)
+	m, err := metrics.New(cfg.Proxies, buckets, cfg.GetSizeBuckets(), cfg.LabelRename)
+	if err != nil {
+		log.Fatalf("Error initializing metrics: %v", err)
+	}
+	m.SetConfigHash(cfg.Hash)
+	m.SetMaxErrorCardinality(cfg.MaxErrorCardinality)
 	log.Printf("Using latency buckets: %v", buckets)
 
+	// Initialize tracing (no-op when otlp_endpoint is not set)
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.OTLPEndpoint)
+	if err != nil {
+		log.Fatalf("Error initializing tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	if *once {
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+		code := runOnce(ctx, cfg, m, os.Stdout, *onceMetrics)
+		stop()
+		shutdownTracing(context.Background())
+		os.Exit(code)
+	}
+
 	defaultTargetURL := cfg.DefaultTargetURL
 	requestInterval := time.Duration(cfg.RequestInterval) * time.Millisecond
-	requestTimeout := time.Duration(cfg.RequestTimeout) * time.Second
+	requestTimeout := cfg.GetRequestTimeout()
 
 	// Default metrics port to 8080 if not specified
 	metricsPort := cfg.MetricsPort
@@ -35,31 +94,351 @@ func main() {
 		metricsPort = 8080
 	}
 
-	// Start metrics server
+	// Start metrics server, along with liveness and readiness endpoints for probes
+	metricsPath := cfg.GetMetricsPath()
+	readiness := &runner.Readiness{}
+	http.Handle(metricsPath, m.Handler())
+	http.HandleFunc("/healthz", healthz)
+	http.Handle("/readyz", readyz(readiness.Ready))
+	server := &http.Server{Addr: ":" + strconv.Itoa(metricsPort)}
 	go func() {
-		http.Handle("/metrics", promhttp.Handler())
-		addr := ":" + strconv.Itoa(metricsPort)
-		log.Printf("Metrics server starting on %s/metrics", addr)
-		if err := http.ListenAndServe(addr, nil); err != nil {
+		log.Printf("Metrics server starting on %s%s (health checks at /healthz and /readyz)", server.Addr, metricsPath)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Fatalf("Error starting metrics server: %v", err)
 		}
 	}()
 
 	log.Printf("Configuration:")
-	log.Printf("  Default Target URL: %s", defaultTargetURL)
+	log.Printf("  Default Target URL: %s", config.MaskURL(defaultTargetURL))
 	log.Printf("  Request interval: %v", requestInterval)
 	log.Printf("  Request timeout: %v", requestTimeout)
+	if cfg.JitterMs > 0 {
+		log.Printf("  Jitter: ±%v", cfg.GetJitter())
+	}
 	log.Printf("  Metrics port: %d", metricsPort)
+	if cfg.OTLPEndpoint != "" {
+		log.Printf("  OTLP endpoint: %s", cfg.OTLPEndpoint)
+	}
 	log.Printf("  Number of proxies: %d", len(cfg.Proxies))
+	if len(cfg.Routes) > 0 {
+		log.Printf("  Number of routes: %d", len(cfg.Routes))
+	}
+	log.Printf("  Config hash: %s", cfg.Hash)
+	if cfg.ShutdownScrapeGraceMs > 0 {
+		log.Printf("  Shutdown scrape grace: %v", cfg.GetShutdownScrapeGrace())
+	}
+
+	// Start host connectivity sentinel, global in-flight cap and result history if configured
+	shared, err := targetShared(cfg)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	shared.Readiness = readiness
+	if cc := cfg.ConnectivityCheck; cc != nil && cc.Address != "" {
+		log.Printf("  Connectivity check: %s every %v", cc.Address, cc.GetInterval())
+		shared.Connectivity = runner.NewConnectivity(cc.Address, cc.GetInterval(), cc.GetTimeout())
+		go shared.Connectivity.Run()
+	}
+	if cfg.MaxGoroutines > 0 {
+		log.Printf("  Max in-flight checks: %d", cfg.MaxGoroutines)
+		shared.InFlight = runner.NewInFlightLimit(cfg.MaxGoroutines)
+	}
+	if shared.TargetPolicy != nil {
+		log.Printf("  Allowed targets: hosts %v, networks %v", cfg.AllowedTargetHosts, cfg.AllowedTargetCIDRs)
+	}
+	if cfg.CAFile != "" {
+		log.Printf("  Target CAs: %s", cfg.CAFile)
+	}
+	if cfg.InsecureSkipVerify {
+		log.Printf("  Warning: target certificates are not verified (insecure_skip_verify)")
+	}
+	if cfg.SQLitePath != "" {
+		store, err := history.Open(cfg.SQLitePath)
+		if err != nil {
+			log.Fatalf("Error opening history database: %v", err)
+		}
+		log.Printf("  History: %s (retention %v), query at /query", cfg.SQLitePath, cfg.GetSQLiteRetention())
+		shared.History = history.NewWriter(store, cfg.GetSQLiteRetention())
+		go shared.History.Run()
+		http.Handle("/query", store.Handler())
+	}
+	if cfg.BaselinesFile != "" {
+		shared.Baselines, err = runner.LoadBaselines(cfg.BaselinesFile, cfg.GetBaselineFactor())
+		if err != nil {
+			log.Fatalf("Error loading latency baselines: %v", err)
+		}
+		log.Printf("  Latency baselines: %d proxies from %s, factor %v", shared.Baselines.Len(), cfg.BaselinesFile, cfg.GetBaselineFactor())
+	}
+	if len(cfg.KafkaBrokers) > 0 {
+		log.Printf("  Kafka: topic %s on %v", cfg.KafkaTopic, cfg.KafkaBrokers)
+		client, err := kafka.NewClient(cfg.KafkaBrokers, cfg.KafkaTopic, cfg.KafkaTLS, cfg.KafkaSASL)
+		if err != nil {
+			log.Fatalf("Error creating Kafka producer: %v", err)
+		}
+		shared.Kafka = kafka.NewSink(client, m)
+		go shared.Kafka.Run()
+	}
+
+	// Fail the deployment if some proxy never succeeds within the deadline
+	if cfg.FirstSuccessDeadlineMs > 0 {
+		deadline := time.Duration(cfg.FirstSuccessDeadlineMs) * time.Millisecond
+		var proxyIDs []string
+		for i := range cfg.Proxies {
+			proxyIDs = append(proxyIDs, "proxy_"+strconv.Itoa(i+1))
+		}
+		shared.FirstSuccess = runner.NewFirstSuccess(proxyIDs)
+		log.Printf("  First success deadline: %v", deadline)
+		go func() {
+			if err := shared.FirstSuccess.Wait(deadline); err != nil {
+				log.Printf("First success deadline exceeded: %v", err)
+				os.Exit(1)
+			}
+			log.Printf("All proxies succeeded within the first success deadline")
+		}()
+	}
 
 	// Start each proxy in a separate goroutine with sequential ID
-	for i, proxyConfig := range cfg.Proxies {
-		proxyID := "proxy_" + strconv.Itoa(i+1)
-		targetURL := proxyConfig.GetTargetURL(defaultTargetURL)
-		log.Printf("[%s] Using target URL: %s", proxyID, targetURL)
-		go runner.Run(m, proxyID, proxyConfig, targetURL, requestInterval, requestTimeout)
+	supervisor := runner.NewSupervisor(m, shared)
+	supervisor.Apply(cfg)
+	http.Handle("/probe", probeHandler(supervisor))
+
+	// Routes are checked hop by hop, independently of the proxies
+	routesCtx, stopRoutes := context.WithCancel(context.Background())
+	for _, route := range cfg.Routes {
+		go runner.RunRoute(routesCtx, m, route.Name, cfg.RouteHops(route), route.GetTargetURL(defaultTargetURL), requestInterval, requestTimeout, shared.TargetPolicy)
+	}
+
+	// Re-read the config on SIGHUP and keep the current proxies when it doesn't load;
+	// shut down on SIGTERM or SIGINT
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM, os.Interrupt)
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			log.Printf("Received %v, shutting down", sig)
+			shutdown(server, supervisor.Current().GetShutdownScrapeGrace(), func() {
+				supervisor.Stop()
+				stopRoutes()
+				shared.Kafka.Close()
+				shared.History.Close()
+			})
+			return
+		}
+
+		// Verifying a reload takes up to reload_verify_timeout_ms; keep handling signals meanwhile
+		log.Printf("Reloading proxy configuration")
+		go func() {
+			if err := supervisor.Reload(loadConfig); err != nil {
+				log.Printf("Error reloading proxy configuration, keeping the current one: %v", err)
+				return
+			}
+			current := supervisor.Current()
+			log.Printf("Configuration reloaded: %d proxies, config hash %s", len(current.Proxies), current.Hash)
+		}()
+	}
+}
+
+// healthz answers 200 whenever the process serves HTTP
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// readyz returns a handler answering 200 once ready reports true, 503 until then
+func readyz(ready func() bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ready() {
+			http.Error(w, "no check completed yet", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+}
+
+// probeHandler serves single checks on demand, blackbox_exporter style: /probe?proxy=proxy_1
+// checks that proxy, /probe?label=region=eu (repeatable) the only proxy with all the labels.
+// target=URL checks that URL instead of the proxy's target. The response holds the metrics
+// of the check along with probe_success, probe_duration_seconds and probe_http_status_code.
+func probeHandler(supervisor *runner.Supervisor) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		target := query.Get("target")
+		if query.Has("target") {
+			if target == "" {
+				http.Error(w, "target is empty", http.StatusBadRequest)
+				return
+			}
+			if err := config.ValidateTargetURL(target); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		labels := make(map[string]string)
+		for _, label := range query["label"] {
+			key, value, ok := strings.Cut(label, "=")
+			if !ok {
+				http.Error(w, "label must be key=value, got "+label, http.StatusBadRequest)
+				return
+			}
+			labels[key] = value
+		}
+		proxyID, err := supervisor.Find(query.Get("proxy"), labels)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		probeSuccess := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_success",
+			Help: "Whether the probe check succeeded (1) or not (0)",
+		})
+		probeDuration := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_duration_seconds",
+			Help: "Duration of the probe check in seconds",
+		})
+		probeStatusCode := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_http_status_code",
+			Help: "HTTP status code of the probe check's response, 0 when none was received",
+		})
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(probeSuccess, probeDuration, probeStatusCode)
+		gatherers := prometheus.Gatherers{registry}
+
+		probeMetrics, result, err := supervisor.Probe(r.Context(), proxyID, target)
+		if err != nil {
+			log.Printf("[%s] Error probing: %v", proxyID, err)
+		} else {
+			gatherers = append(gatherers, probeMetrics.Gatherer())
+			if result.Status == "success" {
+				probeSuccess.Set(1)
+			}
+			probeDuration.Set(result.Duration.Seconds())
+			probeStatusCode.Set(float64(result.StatusCode))
+		}
+		promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+}
+
+// targetShared returns the runner state shared by all proxies that governs which targets are
+// checked and how they are verified: the target allowlist and the global ca_file and
+// insecure_skip_verify
+func targetShared(cfg *config.ProxyConfig) (runner.Shared, error) {
+	shared := runner.Shared{InsecureSkipVerify: cfg.InsecureSkipVerify}
+	var err error
+	shared.TargetPolicy, err = request.NewTargetPolicy(cfg.AllowedTargetHosts, cfg.AllowedTargetCIDRs)
+	if err != nil {
+		return shared, fmt.Errorf("target allowlist: %w", err)
+	}
+	if cfg.CAFile != "" {
+		shared.RootCAs, err = proxy.LoadCertPool(cfg.CAFile)
+		if err != nil {
+			return shared, fmt.Errorf("loading ca_file: %w", err)
+		}
+	}
+	return shared, nil
+}
+
+// runOnce checks every proxy of cfg once and writes a line per check to out, followed by the
+// metrics in Prometheus text format with printMetrics; the lines are then written as comments
+// so out stays valid text format. It returns the exit code: 0 when no
+// check failed, 1 otherwise. Checks ending in warning don't fail.
+func runOnce(ctx context.Context, cfg *config.ProxyConfig, m *metrics.Metrics, out io.Writer, printMetrics bool) int {
+	shared, err := targetShared(cfg)
+	if err != nil {
+		log.Printf("Error: %v", err)
+		return 1
+	}
+
+	code := 0
+	prefix := ""
+	if printMetrics {
+		prefix = "# "
+	}
+	for _, r := range runner.RunOnce(ctx, m, cfg, shared) {
+		name := prefix + r.ProxyID + " (" + r.ProxyConfig.Protocol + " " + proxy.MaskAuth(r.ProxyConfig.Protocol, r.ProxyConfig.Proxy) + ")"
+		switch {
+		case r.Err != nil:
+			fmt.Fprintf(out, "%s: error: %v\n", name, r.Err)
+			code = 1
+		case r.Result.Status == "error":
+			fmt.Fprintf(out, "%s: error %s after %v\n", name, r.Result.ErrorType, r.Result.Duration.Round(time.Millisecond))
+			code = 1
+		default:
+			fmt.Fprintf(out, "%s: %s in %v (HTTP %d)\n", name, r.Result.Status, r.Result.Duration.Round(time.Millisecond), r.Result.StatusCode)
+		}
+	}
+
+	if printMetrics {
+		families, err := m.Gatherer().Gather()
+		if err != nil {
+			log.Printf("Error gathering metrics: %v", err)
+			return 1
+		}
+		enc := expfmt.NewEncoder(out, expfmt.NewFormat(expfmt.TypeTextPlain))
+		for _, family := range families {
+			if err := enc.Encode(family); err != nil {
+				log.Printf("Error writing metrics: %v", err)
+				return 1
+			}
+		}
+	}
+	return code
+}
+
+// shutdown stops the checks, keeps serving metrics for grace so a final scrape captures the
+// terminal state, then stops server
+func shutdown(server *http.Server, grace time.Duration, stopChecks func()) {
+	stopChecks()
+	if grace > 0 {
+		log.Printf("Checks stopped, serving metrics for another %v", grace)
+		time.Sleep(grace)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Error stopping metrics server: %v", err)
+	}
+}
+
+// validateSchema checks config files against the embedded JSON Schema and returns the exit code.
+// Files are taken from args, else every .yaml/.yml file in configDir, else the config file.
+func validateSchema(args []string, configFile, configDir string) int {
+	files := args
+	if len(files) == 0 && configDir != "" {
+		for _, pattern := range []string{"*.yaml", "*.yml"} {
+			matches, _ := filepath.Glob(filepath.Join(configDir, pattern))
+			files = append(files, matches...)
+		}
+	}
+	if len(files) == 0 {
+		files = []string{config.ResolvePath(configFile)}
 	}
 
-	// Keep main goroutine alive
-	select {}
+	code := 0
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err == nil {
+			err = config.ValidateSchema(data)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+			code = 1
+			continue
+		}
+		fmt.Printf("%s: ok\n", file)
+	}
+	return code
+}
+
+// printSchema writes the metrics and labels cfg will expose as JSON to stdout and returns the exit code
+func printSchema(cfg *config.ProxyConfig) int {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(struct {
+		Metrics []metrics.Definition `json:"metrics"`
+	}{metrics.Definitions(cfg.Proxies, cfg.GetLatencyBuckets(), cfg.GetSizeBuckets(), cfg.LabelRename)})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing schema: %v\n", err)
+		return 1
+	}
+	return 0
 }
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"eugene-chernyshenko/proxy-synthetic-check/internal/config"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/metrics"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/runner"
+)
+
+func TestShutdown_ServesMetricsDuringGrace(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("requests_total 1\n"))
+	})}
+	go server.Serve(listener)
+	url := "http://" + listener.Addr().String() + "/metrics"
+
+	const grace = 300 * time.Millisecond
+	var stopped atomic.Bool
+	done := make(chan struct{})
+	go func() {
+		shutdown(server, grace, func() { stopped.Store(true) })
+		close(done)
+	}()
+
+	time.Sleep(grace / 3)
+	if !stopped.Load() {
+		t.Error("checks not stopped when shutdown began")
+	}
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("metrics not served during the grace period: %v", err)
+	}
+	resp.Body.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not return after the grace period")
+	}
+	if _, err := http.Get(url); err == nil {
+		t.Error("metrics still served after the grace period")
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	rec := httptest.NewRecorder()
+	healthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("/healthz status = %d, want 200", rec.Code)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	var ready atomic.Bool
+	server := httptest.NewServer(readyz(ready.Load))
+	defer server.Close()
+
+	get := func() int {
+		t.Helper()
+		resp, err := http.Get(server.URL + "/readyz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := get(); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz before any check = %d, want 503", code)
+	}
+	ready.Store(true)
+	if code := get(); code != http.StatusOK {
+		t.Errorf("/readyz after a check = %d, want 200", code)
+	}
+}
+
+func TestProbeHandler(t *testing.T) {
+	// A healthy HTTP proxy answering every request itself
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer stub.Close()
+
+	m, err := metrics.New(nil, []float64{0.1, 1}, []float64{100}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	supervisor := runner.NewSupervisor(m, runner.Shared{})
+	supervisor.Apply(&config.ProxyConfig{
+		DefaultTargetURL: "http://example.com/",
+		RequestInterval:  60000,
+		RequestTimeout:   5,
+		Proxies: []config.Proxy{
+			{Protocol: "http", Proxy: strings.TrimPrefix(stub.URL, "http://"), Labels: map[string]string{"region": "eu"}},
+		},
+	})
+	defer supervisor.Stop()
+
+	server := httptest.NewServer(probeHandler(supervisor))
+	defer server.Close()
+	get := func(query string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(server.URL + "/probe?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	for _, query := range []string{"proxy=proxy_1", "label=region=eu"} {
+		code, body := get(query)
+		if code != http.StatusOK || !strings.Contains(body, "probe_success 1") {
+			t.Errorf("/probe?%s = %d:\n%s\nwant 200 with probe_success 1", query, code, body)
+		}
+		if !strings.Contains(body, `requests_total{error="",proxy_id="proxy_1"`) {
+			t.Errorf("/probe?%s does not hold the requests_total of the check:\n%s", query, body)
+		}
+	}
+
+	// Another target through the same proxy
+	code, body := get("proxy=proxy_1&target=" + url.QueryEscape("http://other.example.com/health"))
+	if code != http.StatusOK || !strings.Contains(body, "probe_success 1") || !strings.Contains(body, "probe_http_status_code 200") {
+		t.Errorf("/probe with target = %d:\n%s\nwant 200 with probe_success 1 and probe_http_status_code 200", code, body)
+	}
+	if !strings.Contains(body, "probe_duration_seconds ") {
+		t.Errorf("/probe with target has no probe_duration_seconds:\n%s", body)
+	}
+
+	for _, query := range []string{"", "proxy=proxy_2", "label=region=us", "label=region", "proxy=proxy_1&target=", "proxy=proxy_1&target=example.com"} {
+		if code, body := get(query); code != http.StatusBadRequest {
+			t.Errorf("/probe?%s = %d (%s), want 400", query, code, body)
+		}
+	}
+}
+
+func TestProbeHandler_ProxyError(t *testing.T) {
+	// A proxy address nothing listens on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	m, err := metrics.New(nil, []float64{0.1, 1}, []float64{100}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	supervisor := runner.NewSupervisor(m, runner.Shared{})
+	supervisor.Apply(&config.ProxyConfig{
+		DefaultTargetURL: "http://example.com/",
+		RequestInterval:  60000,
+		RequestTimeout:   5,
+		Proxies:          []config.Proxy{{Protocol: "http", Proxy: addr}},
+	})
+	defer supervisor.Stop()
+
+	rec := httptest.NewRecorder()
+	probeHandler(supervisor).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/probe?proxy=proxy_1&target=http://example.com/", nil))
+	body := rec.Body.String()
+	if rec.Code != http.StatusOK || !strings.Contains(body, "probe_success 0") || !strings.Contains(body, "probe_http_status_code 0") {
+		t.Errorf("/probe through a dead proxy = %d:\n%s\nwant 200 with probe_success 0 and probe_http_status_code 0", rec.Code, body)
+	}
+	if !strings.Contains(body, `error="connection_error"`) {
+		t.Errorf("/probe through a dead proxy does not record connection_error:\n%s", body)
+	}
+}
+
+func TestRunOnce(t *testing.T) {
+	// A healthy HTTP proxy answering every request itself
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer stub.Close()
+	// A proxy address nothing listens on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := listener.Addr().String()
+	listener.Close()
+	healthy := config.Proxy{Protocol: "http", Proxy: strings.TrimPrefix(stub.URL, "http://")}
+
+	tests := []struct {
+		name    string
+		proxies []config.Proxy
+		want    int
+	}{
+		{"all succeed", []config.Proxy{healthy, healthy}, 0},
+		{"one fails", []config.Proxy{healthy, {Protocol: "http", Proxy: dead}}, 1},
+		{"compare_targets", []config.Proxy{{Protocol: "http", Proxy: healthy.Proxy, CompareTargets: []string{"http://a.example.com/", "http://b.example.com/"}}}, 0},
+		{"cannot be checked", []config.Proxy{healthy, {Protocol: "http", Proxy: healthy.Proxy, CAFile: filepath.Join(t.TempDir(), "missing.pem")}}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.ProxyConfig{DefaultTargetURL: "http://example.com/", RequestTimeout: 5, Proxies: tt.proxies}
+			m, err := metrics.New(cfg.Proxies, []float64{0.1, 1}, []float64{100}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var out strings.Builder
+			if code := runOnce(context.Background(), cfg, m, &out, true); code != tt.want {
+				t.Errorf("runOnce() = %d, want %d; output:\n%s", code, tt.want, out.String())
+			}
+			if lines := strings.Count(out.String(), "proxy_"); lines < len(tt.proxies) {
+				t.Errorf("runOnce() output has no line per proxy:\n%s", out.String())
+			}
+			if !strings.Contains(out.String(), "exporter_configured_proxies ") {
+				t.Errorf("runOnce() did not write the metrics:\n%s", out.String())
+			}
+		})
+	}
+}
+
+func TestTargetShared(t *testing.T) {
+	cfg := &config.ProxyConfig{InsecureSkipVerify: true, AllowedTargetHosts: []string{"example.com"}}
+	shared, err := targetShared(cfg)
+	if err != nil {
+		t.Fatalf("targetShared() error = %v", err)
+	}
+	if !shared.InsecureSkipVerify || shared.TargetPolicy == nil || shared.RootCAs != nil {
+		t.Errorf("targetShared() = %+v, want insecure_skip_verify and the allowlist", shared)
+	}
+
+	cfg.CAFile = filepath.Join(t.TempDir(), "missing.pem")
+	if _, err := targetShared(cfg); err == nil || !strings.Contains(err.Error(), "ca_file") {
+		t.Errorf("targetShared() error = %v, want a ca_file error", err)
+	}
+}
@@ -1,28 +1,289 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/robfig/cron/v3"
 	"gopkg.in/yaml.v3"
+
+	"eugene-chernyshenko/proxy-synthetic-check/internal/metrics/labels"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/proxy"
 )
 
-// ProxyConfig represents the YAML configuration file structure
+// ProxyConfig represents the configuration file structure (YAML or JSON)
 type ProxyConfig struct {
-	DefaultTargetURL string    `yaml:"default_target_url"`
-	RequestInterval  int       `yaml:"request_interval_ms"`
-	RequestTimeout   int       `yaml:"request_timeout"`
-	MetricsPort      int       `yaml:"metrics_port"`
-	LatencyBuckets   []float64 `yaml:"latency_buckets,omitempty"` // Optional custom buckets
-	Proxies          []Proxy   `yaml:"proxies"`
+	DefaultTargetURL string            `yaml:"default_target_url" json:"default_target_url"`
+	RequestInterval  int               `yaml:"request_interval_ms" json:"request_interval_ms"`
+	RequestTimeout   int               `yaml:"request_timeout" json:"request_timeout"`
+	RequestTimeoutMs int               `yaml:"request_timeout_ms,omitempty" json:"request_timeout_ms,omitempty"` // Overrides request_timeout (seconds) when set
+	JitterMs         int               `yaml:"jitter_ms,omitempty" json:"jitter_ms,omitempty"`                   // Randomize the first check and every interval by up to ±jitter_ms
+	MetricsPort      int               `yaml:"metrics_port" json:"metrics_port"`
+	LatencyBuckets   []float64         `yaml:"latency_buckets,omitempty" json:"latency_buckets,omitempty"` // Optional custom buckets
+	SizeBuckets      []float64         `yaml:"size_buckets,omitempty" json:"size_buckets,omitempty"`       // Optional response size buckets in bytes
+	LabelRename      map[string]string `yaml:"label_rename,omitempty" json:"label_rename,omitempty"`       // Metric label names to expose under another name, e.g. proxy_id: proxy
+	OTLPEndpoint     string            `yaml:"otlp_endpoint,omitempty" json:"otlp_endpoint,omitempty"`     // Optional OTLP/HTTP traces endpoint, tracing disabled when empty
+	Proxies          []Proxy           `yaml:"proxies" json:"proxies"`
+	Routes           []Route           `yaml:"routes,omitempty" json:"routes,omitempty"` // Multi-hop routes reported up only when every hop forwards
+
+	ConnectivityCheck *ConnectivityCheck `yaml:"connectivity_check,omitempty" json:"connectivity_check,omitempty"` // Optional host network sentinel
+	MaxGoroutines     int                `yaml:"max_goroutines,omitempty" json:"max_goroutines,omitempty"`         // Cap on checks in flight across all proxies, 0 = unlimited
+
+	MetricsPath string `yaml:"metrics_path,omitempty" json:"metrics_path,omitempty"` // Path of the metrics endpoint, default /metrics
+
+	MaxErrorCardinality int `yaml:"max_error_cardinality,omitempty" json:"max_error_cardinality,omitempty"` // Distinct error label values per proxy before new ones are recorded as other, 0 = unlimited
+
+	FirstSuccessDeadlineMs int `yaml:"first_success_deadline_ms,omitempty" json:"first_success_deadline_ms,omitempty"` // Exit non-zero unless every proxy succeeds once within this time
+
+	ShutdownScrapeGraceMs int `yaml:"shutdown_scrape_grace_ms,omitempty" json:"shutdown_scrape_grace_ms,omitempty"` // Keep serving metrics this long after checks stop on SIGTERM
+
+	ReloadVerifyTimeoutMs int `yaml:"reload_verify_timeout_ms,omitempty" json:"reload_verify_timeout_ms,omitempty"` // Roll a reload back unless every added or changed proxy succeeds once within this time
+
+	AllowedTargetHosts []string `yaml:"allowed_target_hosts,omitempty" json:"allowed_target_hosts,omitempty"` // Target hostnames (or *.domain patterns) checks may be sent to
+	AllowedTargetCIDRs []string `yaml:"allowed_target_cidrs,omitempty" json:"allowed_target_cidrs,omitempty"` // Networks all resolved target addresses must be in
+
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty" json:"insecure_skip_verify,omitempty"` // Accept any target certificate, e.g. self-signed ones
+	CAFile             string `yaml:"ca_file,omitempty" json:"ca_file,omitempty"`                           // PEM file of CAs target certificates are verified against instead of the system roots
+
+	SQLitePath           string `yaml:"sqlite_path,omitempty" json:"sqlite_path,omitempty"`                       // Optional SQLite database recording every check result
+	SQLiteRetentionHours int    `yaml:"sqlite_retention_hours,omitempty" json:"sqlite_retention_hours,omitempty"` // Age after which recorded results are pruned (default 168)
+
+	KafkaBrokers []string `yaml:"kafka_brokers,omitempty" json:"kafka_brokers,omitempty"` // Optional Kafka bootstrap brokers (host:port) every check result is published to
+	KafkaTopic   string   `yaml:"kafka_topic,omitempty" json:"kafka_topic,omitempty"`     // Topic check results are published to, required with kafka_brokers
+
+	KafkaTLS  bool       `yaml:"kafka_tls,omitempty" json:"kafka_tls,omitempty"`   // Connect to the Kafka brokers over TLS, verified against the system roots
+	KafkaSASL *KafkaSASL `yaml:"kafka_sasl,omitempty" json:"kafka_sasl,omitempty"` // Optional SASL authentication with the Kafka brokers
+
+	BaselinesFile  string  `yaml:"baselines_file,omitempty" json:"baselines_file,omitempty"`   // Optional YAML/JSON file mapping proxy IDs to baseline latencies in seconds
+	BaselineFactor float64 `yaml:"baseline_factor,omitempty" json:"baseline_factor,omitempty"` // Checks slower than baseline * factor are flagged as latency regressions (default 2)
+
+	Hash string `yaml:"-" json:"-"` // Short SHA-256 of the loaded config bytes, set by Load/LoadDir
+}
+
+// GetRequestTimeout returns the request timeout, preferring request_timeout_ms over request_timeout
+func (c *ProxyConfig) GetRequestTimeout() time.Duration {
+	if c.RequestTimeoutMs > 0 {
+		return time.Duration(c.RequestTimeoutMs) * time.Millisecond
+	}
+	return time.Duration(c.RequestTimeout) * time.Second
+}
+
+// GetShutdownScrapeGrace returns how long metrics are still served after checks stop on shutdown
+func (c *ProxyConfig) GetShutdownScrapeGrace() time.Duration {
+	return time.Duration(c.ShutdownScrapeGraceMs) * time.Millisecond
+}
+
+// GetReloadVerifyTimeout returns how long reloaded proxies have to succeed before the reload
+// is rolled back, zero when reloads are not verified
+func (c *ProxyConfig) GetReloadVerifyTimeout() time.Duration {
+	return time.Duration(c.ReloadVerifyTimeoutMs) * time.Millisecond
+}
+
+// GetMetricsPath returns the path metrics are served at, /metrics unless configured
+func (c *ProxyConfig) GetMetricsPath() string {
+	if c.MetricsPath == "" {
+		return "/metrics"
+	}
+	return c.MetricsPath
+}
+
+// GetJitter returns the maximum random offset applied to check times, zero when disabled
+func (c *ProxyConfig) GetJitter() time.Duration {
+	return time.Duration(c.JitterMs) * time.Millisecond
+}
+
+// defaultBaselineFactor is how much slower than its baseline a check may be before it is flagged
+const defaultBaselineFactor = 2
+
+// GetBaselineFactor returns the factor over the baseline latency flagged as a regression
+func (c *ProxyConfig) GetBaselineFactor() float64 {
+	if c.BaselineFactor > 0 {
+		return c.BaselineFactor
+	}
+	return defaultBaselineFactor
+}
+
+// GetSQLiteRetention returns how long recorded results are kept, defaulting to 7 days
+func (c *ProxyConfig) GetSQLiteRetention() time.Duration {
+	if c.SQLiteRetentionHours > 0 {
+		return time.Duration(c.SQLiteRetentionHours) * time.Hour
+	}
+	return 7 * 24 * time.Hour
+}
+
+// ConnectivityCheck configures a direct dial used to detect that the host itself is offline
+type ConnectivityCheck struct {
+	Address    string `yaml:"address" json:"address"`                             // host:port dialed directly, e.g. 1.1.1.1:443
+	IntervalMs int    `yaml:"interval_ms,omitempty" json:"interval_ms,omitempty"` // Probe interval (default 5000)
+	TimeoutMs  int    `yaml:"timeout_ms,omitempty" json:"timeout_ms,omitempty"`   // Dial timeout (default 2000)
+}
+
+// GetInterval returns the probe interval, defaulting to 5s
+func (c *ConnectivityCheck) GetInterval() time.Duration {
+	if c.IntervalMs > 0 {
+		return time.Duration(c.IntervalMs) * time.Millisecond
+	}
+	return 5 * time.Second
+}
+
+// GetTimeout returns the dial timeout, defaulting to 2s
+func (c *ConnectivityCheck) GetTimeout() time.Duration {
+	if c.TimeoutMs > 0 {
+		return time.Duration(c.TimeoutMs) * time.Millisecond
+	}
+	return 2 * time.Second
 }
 
 // Proxy represents a single proxy configuration
 type Proxy struct {
-	Protocol  string            `yaml:"protocol"`             // socks5, http
-	Proxy     string            `yaml:"proxy"`                // username:password@host:port or host:port (no scheme)
-	TargetURL string            `yaml:"target_url,omitempty"` // Optional target URL (overrides default)
-	Labels    map[string]string `yaml:"labels"`               // Custom labels for metrics
+	Protocol          string            `yaml:"protocol" json:"protocol"`                                           // socks5, socks5h, socks4, socks4a, http
+	Proxy             string            `yaml:"proxy" json:"proxy"`                                                 // username:password@host:port or host:port (no scheme)
+	TargetURL         string            `yaml:"target_url,omitempty" json:"target_url,omitempty"`                   // Optional target URL (overrides default)
+	RequestIntervalMs int               `yaml:"request_interval_ms,omitempty" json:"request_interval_ms,omitempty"` // Optional check interval (overrides the global request_interval_ms)
+	RequestTimeout    int               `yaml:"request_timeout,omitempty" json:"request_timeout,omitempty"`         // Optional timeout in seconds (overrides the global timeout)
+	RequestTimeoutMs  int               `yaml:"request_timeout_ms,omitempty" json:"request_timeout_ms,omitempty"`   // Optional timeout in milliseconds, preferred over request_timeout
+	Labels            map[string]string `yaml:"labels" json:"labels"`                                               // Custom labels for metrics
+	Method            string            `yaml:"method,omitempty" json:"method,omitempty"`                           // HTTP method of checks (default GET)
+	Headers           map[string]string `yaml:"headers,omitempty" json:"headers,omitempty"`                         // Extra request headers; a Host entry overrides the Host header
+	Body              string            `yaml:"body,omitempty" json:"body,omitempty"`                               // Request body, e.g. for POST checks
+	BodyFile          string            `yaml:"body_file,omitempty" json:"body_file,omitempty"`                     // File read once at load time into Body, taking precedence over body
+
+	Description string `yaml:"description,omitempty" json:"description,omitempty"` // Free-text operator context, logged but never a metric label
+	Owner       string `yaml:"owner,omitempty" json:"owner,omitempty"`             // Who to contact about this proxy, logged but never a metric label
+
+	Ref string `yaml:"ref,omitempty" json:"ref,omitempty"` // Unique name routes use to refer to this proxy
+
+	DegradedLatencyMs int  `yaml:"degraded_latency_ms,omitempty" json:"degraded_latency_ms,omitempty"` // Successful checks slower than this report as degraded
+	StrictSOCKS5Auth  bool `yaml:"strict_socks5_auth,omitempty" json:"strict_socks5_auth,omitempty"`   // Fail if the SOCKS5 server negotiates a different auth method than configured
+
+	ConnectIP string `yaml:"connect_ip,omitempty" json:"connect_ip,omitempty"` // Connect to the target at this IP, keeping the URL hostname for SNI and Host
+
+	HMACSigning *HMACSigning `yaml:"hmac_signing,omitempty" json:"hmac_signing,omitempty"` // Optional request signing for authenticated targets
+
+	WarnStatusCodes []int `yaml:"warn_status_codes,omitempty" json:"warn_status_codes,omitempty"` // Status codes recorded as "warning" instead of success/error
+	ExpectedStatus  []int `yaml:"expected_status,omitempty" json:"expected_status,omitempty"`     // Status codes counted as success; any other is an unexpected_status error. Default: below 400
+
+	CoarseStatusErrors bool `yaml:"coarse_status_errors,omitempty" json:"coarse_status_errors,omitempty"` // Record HTTP status errors as http_error instead of http_<code>; status_class keeps the class
+
+	CompareTargets []string `yaml:"compare_targets,omitempty" json:"compare_targets,omitempty"` // Two URLs probed back to back each tick instead of the target URL
+
+	InitialSpreadMs int `yaml:"initial_spread_ms,omitempty" json:"initial_spread_ms,omitempty"` // First check is delayed by a random amount in [0, initial_spread_ms]
+
+	Cron string `yaml:"cron,omitempty" json:"cron,omitempty"` // Standard 5-field cron spec checks run on instead of every request_interval_ms
+
+	Canary bool `yaml:"canary,omitempty" json:"canary,omitempty"` // Tracked under canary="true" so it can be excluded from aggregates and alerts
+
+	TLSALPN []string `yaml:"tls_alpn,omitempty" json:"tls_alpn,omitempty"` // ALPN protocols offered to the target; negotiating none of them is an alpn_mismatch
+
+	RequireOCSPStapling bool `yaml:"require_ocsp_stapling,omitempty" json:"require_ocsp_stapling,omitempty"` // Fail HTTPS responses whose handshake carried no valid stapled OCSP response as ocsp_missing
+
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty" json:"insecure_skip_verify,omitempty"` // Accept any target certificate (also set for all proxies by the global setting)
+	CAFile             string `yaml:"ca_file,omitempty" json:"ca_file,omitempty"`                           // PEM file of CAs target certificates are verified against, overriding the global ca_file
+
+	UserAgent         string   `yaml:"user_agent,omitempty" json:"user_agent,omitempty"`                   // User-Agent header sent with checks (Go default when empty)
+	UserAgentRotation []string `yaml:"user_agent_rotation,omitempty" json:"user_agent_rotation,omitempty"` // User-Agents used round-robin, one per check, overriding user_agent
+
+	RequireCompression bool `yaml:"require_compression,omitempty" json:"require_compression,omitempty"` // Send Accept-Encoding: br, gzip and fail uncompressed responses
+
+	EmptyBodyIsFailure bool `yaml:"empty_body_is_failure,omitempty" json:"empty_body_is_failure,omitempty"` // Fail successful responses without a body as empty_response
+	EmptyBodyRetries   int  `yaml:"empty_body_retries,omitempty" json:"empty_body_retries,omitempty"`       // Repeat a check failing with empty_response up to this many times before reporting it
+
+	BodyContains string `yaml:"body_contains,omitempty" json:"body_contains,omitempty"` // Fail successful responses whose body lacks this substring as body_mismatch
+	BodyRegex    string `yaml:"body_regex,omitempty" json:"body_regex,omitempty"`       // Fail successful responses whose body doesn't match this regular expression as body_regex_mismatch
+	bodyRegexp   *regexp.Regexp
+
+	ExpectedSHA256 string `yaml:"expected_sha256,omitempty" json:"expected_sha256,omitempty"` // Hex SHA-256 the full response body must have, checksum_mismatch otherwise
+
+	Chain []Hop `yaml:"chain,omitempty" json:"chain,omitempty"` // Further proxies traversed after this one, in order; the last one connects to the target
+
+	FollowRedirects *bool `yaml:"follow_redirects,omitempty" json:"follow_redirects,omitempty"` // Follow redirects (default true); when false the 3xx response itself is checked
+	MaxRedirects    int   `yaml:"max_redirects,omitempty" json:"max_redirects,omitempty"`       // Redirects followed before failing with too_many_redirects (default 10, as net/http)
+
+	ConnectOnly bool `yaml:"connect_only,omitempty" json:"connect_only,omitempty"` // Only open a TCP connection to the target host:port through the proxy, no HTTP
+
+	WebSocket bool `yaml:"websocket,omitempty" json:"websocket,omitempty"` // Perform a WebSocket opening handshake with the target instead of an HTTP request
+
+	TLSOnly bool `yaml:"tls_only,omitempty" json:"tls_only,omitempty"` // Only perform a TLS handshake with the target through the proxy, no HTTP
+
+	MonotonicField string `yaml:"monotonic_field,omitempty" json:"monotonic_field,omitempty"` // JSON path of a counter that must grow between two samples taken per check
+
+	MaxInFlight int `yaml:"max_in_flight,omitempty" json:"max_in_flight,omitempty"` // Checks of this proxy allowed to run concurrently before ticks are skipped (default 4)
+
+	MaxConnsPerProxy int `yaml:"max_conns_per_proxy,omitempty" json:"max_conns_per_proxy,omitempty"` // Connections opened to the target through this proxy at once; further requests wait for one (0 = unlimited)
+
+	MaxIdleConns        int  `yaml:"max_idle_conns,omitempty" json:"max_idle_conns,omitempty"`                   // Idle keep-alive connections kept open (0 = net/http default of 100)
+	MaxIdleConnsPerHost int  `yaml:"max_idle_conns_per_host,omitempty" json:"max_idle_conns_per_host,omitempty"` // Idle keep-alive connections kept open per target host (0 = net/http default of 2)
+	IdleConnTimeoutMs   int  `yaml:"idle_conn_timeout_ms,omitempty" json:"idle_conn_timeout_ms,omitempty"`       // Idle connections are closed after this long (0 = never)
+	DisableKeepAlives   bool `yaml:"disable_keep_alives,omitempty" json:"disable_keep_alives,omitempty"`         // Open a new connection through the proxy for every request
+
+	DialTimeoutMs int `yaml:"dial_timeout_ms,omitempty" json:"dial_timeout_ms,omitempty"` // Time allowed to connect to the proxy, failing unreachable proxies early (0 = bounded by the request timeout only)
+}
+
+// Hop is one further proxy of a chain
+type Hop struct {
+	Protocol string `yaml:"protocol" json:"protocol"` // socks5, socks5h, socks4, socks4a, http
+	Proxy    string `yaml:"proxy" json:"proxy"`       // username:password@host:port or host:port (no scheme)
+}
+
+// KafkaSASL authenticates with the Kafka brokers
+type KafkaSASL struct {
+	Mechanism string `yaml:"mechanism" json:"mechanism"` // plain, scram-sha-256 or scram-sha-512
+	Username  string `yaml:"username" json:"username"`
+	Password  string `yaml:"password" json:"password"`
+}
+
+// Route is a path through several configured proxies, checked hop by hop: each hop has to
+// connect to the next one through all hops before it, and the last one to the target
+type Route struct {
+	Name      string   `yaml:"name" json:"name"`                                 // Value of the route label
+	Proxies   []string `yaml:"proxies" json:"proxies"`                           // Refs of the proxies in traversal order, at least two
+	TargetURL string   `yaml:"target_url,omitempty" json:"target_url,omitempty"` // Host and port the last hop connects to (default default_target_url)
+}
+
+// RouteHops returns the proxies route refers to as hops, in traversal order. Refs without a
+// proxy (rejected by Validate) are left out.
+func (c *ProxyConfig) RouteHops(route Route) []Hop {
+	var hops []Hop
+	for _, ref := range route.Proxies {
+		for _, p := range c.Proxies {
+			if p.Ref == ref {
+				hops = append(hops, Hop{Protocol: p.Protocol, Proxy: p.Proxy})
+				break
+			}
+		}
+	}
+	return hops
+}
+
+// GetTargetURL returns the route target URL, or defaultURL when not set
+func (r *Route) GetTargetURL(defaultURL string) string {
+	if r.TargetURL != "" {
+		return r.TargetURL
+	}
+	return defaultURL
+}
+
+// HMACSigning configures an HMAC signature over the request path and a unix timestamp
+type HMACSigning struct {
+	Secret          string `yaml:"secret" json:"secret"`
+	Header          string `yaml:"header,omitempty" json:"header,omitempty"`                     // Header carrying the hex signature (default X-Signature)
+	TimestampHeader string `yaml:"timestamp_header,omitempty" json:"timestamp_header,omitempty"` // Header carrying the signed timestamp (default X-Timestamp)
+	Algorithm       string `yaml:"algorithm,omitempty" json:"algorithm,omitempty"`               // sha256 (default), sha512 or sha1
 }
 
 // GetTargetURL returns the target URL for this proxy, using proxy-specific URL if set,
@@ -34,25 +295,632 @@ func (p *Proxy) GetTargetURL(defaultURL string) string {
 	return defaultURL
 }
 
-// Load reads and parses the configuration from proxies.yaml file
-func Load() (*ProxyConfig, error) {
-	data, err := os.ReadFile("proxies.yaml")
+// GetRequestInterval returns the interval between checks of this proxy, using the proxy-specific
+// interval if set, otherwise the global request_interval_ms
+func (p *Proxy) GetRequestInterval(defaultMs int) time.Duration {
+	if p.RequestIntervalMs > 0 {
+		return time.Duration(p.RequestIntervalMs) * time.Millisecond
+	}
+	return time.Duration(defaultMs) * time.Millisecond
+}
+
+// GetRequestTimeout returns the request timeout of this proxy, using request_timeout_ms or
+// request_timeout if set (in that order), otherwise the global timeout
+func (p *Proxy) GetRequestTimeout(defaultTimeout time.Duration) time.Duration {
+	if p.RequestTimeoutMs > 0 {
+		return time.Duration(p.RequestTimeoutMs) * time.Millisecond
+	}
+	if p.RequestTimeout > 0 {
+		return time.Duration(p.RequestTimeout) * time.Second
+	}
+	return defaultTimeout
+}
+
+// GetFollowRedirects reports whether HTTP checks follow redirects, defaulting to true
+func (p *Proxy) GetFollowRedirects() bool {
+	return p.FollowRedirects == nil || *p.FollowRedirects
+}
+
+// Methods lists the HTTP methods checks may use
+var Methods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+
+// GetMethod returns the HTTP method of checks, defaulting to GET
+func (p *Proxy) GetMethod() string {
+	if p.Method != "" {
+		return strings.ToUpper(p.Method)
+	}
+	return "GET"
+}
+
+// DefaultMaxInFlight is the default number of concurrent checks per proxy
+const DefaultMaxInFlight = 4
+
+// GetMaxInFlight returns how many checks of this proxy may run concurrently
+func (p *Proxy) GetMaxInFlight() int {
+	if p.MaxInFlight > 0 {
+		return p.MaxInFlight
+	}
+	return DefaultMaxInFlight
+}
+
+// GetIdleConnTimeout returns how long idle connections to the target are kept open,
+// or zero to keep them indefinitely
+func (p *Proxy) GetIdleConnTimeout() time.Duration {
+	return time.Duration(p.IdleConnTimeoutMs) * time.Millisecond
+}
+
+// GetDialTimeout returns the time allowed to connect to the proxy, or zero when only the
+// request timeout applies
+func (p *Proxy) GetDialTimeout() time.Duration {
+	return time.Duration(p.DialTimeoutMs) * time.Millisecond
+}
+
+// GetDegradedThreshold returns the latency above which a successful check is degraded,
+// or zero when the degraded state is disabled
+func (p *Proxy) GetDegradedThreshold() time.Duration {
+	return time.Duration(p.DegradedLatencyMs) * time.Millisecond
+}
+
+// MetricLabels returns the custom metric labels, plus canary="true" for canary proxies
+func (p *Proxy) MetricLabels() map[string]string {
+	if !p.Canary {
+		return p.Labels
+	}
+	labels := make(map[string]string, len(p.Labels)+1)
+	maps.Copy(labels, p.Labels)
+	labels["canary"] = "true"
+	return labels
+}
+
+// GetInitialSpread returns the upper bound of the random delay before the first check
+func (p *Proxy) GetInitialSpread() time.Duration {
+	return time.Duration(p.InitialSpreadMs) * time.Millisecond
+}
+
+// IsWarnStatus reports whether code is listed in warn_status_codes
+func (p *Proxy) IsWarnStatus(code int) bool {
+	return slices.Contains(p.WarnStatusCodes, code)
+}
+
+// IsExpectedStatus reports whether code counts as success: listed in expected_status, or below
+// 400 when the list is empty
+func (p *Proxy) IsExpectedStatus(code int) bool {
+	if len(p.ExpectedStatus) == 0 {
+		return code < 400
+	}
+	return slices.Contains(p.ExpectedStatus, code)
+}
+
+// CronSchedule returns the parsed cron spec (minute, hour, day of month, month, day of week,
+// in local time), nil when checks run every interval
+func (p *Proxy) CronSchedule() (cron.Schedule, error) {
+	if p.Cron == "" {
+		return nil, nil
+	}
+	return cron.ParseStandard(p.Cron)
+}
+
+// BodyRegexp returns the compiled body_regex, nil when unset. Proxies from Load have it compiled
+// already; for others it is compiled on each call.
+func (p *Proxy) BodyRegexp() (*regexp.Regexp, error) {
+	if p.bodyRegexp != nil || p.BodyRegex == "" {
+		return p.bodyRegexp, nil
+	}
+	return regexp.Compile(p.BodyRegex)
+}
+
+// Key identifies a proxy entry by protocol, address, chain and target URL
+func (p *Proxy) Key() string {
+	key := p.Protocol + "://" + p.Proxy
+	for _, hop := range p.Chain {
+		key += " -> " + hop.Protocol + "://" + hop.Proxy
+	}
+	return key + " " + p.TargetURL
+}
+
+// BaseConfigFile is the file in a config directory that supplies global settings
+const BaseConfigFile = "base.yaml"
+
+// DefaultConfigFile is the config file used when neither the -config flag nor ConfigEnvVar is set
+const DefaultConfigFile = "proxies.yaml"
+
+// ConfigEnvVar names the environment variable holding the config file path
+const ConfigEnvVar = "PROXY_CHECK_CONFIG"
+
+// ResolvePath returns the config file path: flagValue if set, else ConfigEnvVar, else DefaultConfigFile
+func ResolvePath(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	if path := os.Getenv(ConfigEnvVar); path != "" {
+		return path
+	}
+	return DefaultConfigFile
+}
+
+// Load reads and parses the configuration from the file at path. Files ending in .json are
+// parsed as JSON, everything else as YAML.
+func Load(path string) (*ProxyConfig, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 
 	var cfg ProxyConfig
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
+	if err := unmarshal(path, ExpandEnv(data), &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if len(cfg.Proxies) == 0 {
+		return nil, fmt.Errorf("no proxies configured in config file %s", path)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s:\n%w", path, err)
+	}
+
+	if err := cfg.prepareProxies(); err != nil {
+		return nil, err
+	}
+
+	cfg.Hash = Hash(data)
+
+	return &cfg, nil
+}
+
+// unmarshal decodes data into cfg as JSON or YAML depending on the extension of path
+func unmarshal(path string, data []byte, cfg *ProxyConfig) error {
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		return json.Unmarshal(data, cfg)
+	}
+	return yaml.Unmarshal(data, cfg)
+}
+
+// ExpandEnv replaces ${VAR} and $VAR in config bytes with environment variable values,
+// so secrets don't have to be committed. Unset variables expand to "" with a warning;
+// $$ produces a literal $.
+func ExpandEnv(data []byte) []byte {
+	return []byte(os.Expand(string(data), func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			log.Printf("Warning: config references unset environment variable %s, using empty value", name)
+		}
+		return value
+	}))
+}
+
+// Hash returns the first 12 hex characters of the SHA-256 of config bytes (before environment expansion)
+func Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// LoadDir reads all .yaml/.yml files in dir in name order and merges them into one config.
+// Global settings are taken from BaseConfigFile only; proxies from every file are concatenated.
+// The same proxy (see Proxy.Key) defined twice is rejected.
+func LoadDir(dir string) (*ProxyConfig, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
 		return nil, err
 	}
 
+	var names []string
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if entry.IsDir() || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+
+	var cfg ProxyConfig
+	var all []byte // names and contents of all merged files, for the config hash
+	hasBase := false
+	seen := make(map[string]string) // proxy key -> file that defined it
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		all = append(all, name...)
+		all = append(all, 0)
+		all = append(all, data...)
+
+		var fileCfg ProxyConfig
+		if err := yaml.Unmarshal(ExpandEnv(data), &fileCfg); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+
+		if name == BaseConfigFile {
+			proxies := cfg.Proxies
+			cfg = fileCfg
+			cfg.Proxies = proxies
+			hasBase = true
+		}
+
+		for i, p := range fileCfg.Proxies {
+			if prev, ok := seen[p.Key()]; ok {
+				return nil, fmt.Errorf("%s: proxy #%d is already defined in %s", name, i+1, prev)
+			}
+			seen[p.Key()] = name
+			cfg.Proxies = append(cfg.Proxies, p)
+		}
+	}
+
+	if !hasBase {
+		return nil, fmt.Errorf("%s not found in config directory %s", BaseConfigFile, dir)
+	}
+
 	if len(cfg.Proxies) == 0 {
-		return nil, errors.New("no proxies configured in config file")
+		return nil, errors.New("no proxies configured in config directory")
 	}
 
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config directory %s:\n%w", dir, err)
+	}
+
+	if err := cfg.prepareProxies(); err != nil {
+		return nil, err
+	}
+
+	cfg.Hash = Hash(all)
+
 	return &cfg, nil
 }
 
+// prepareProxies replaces the body of every proxy with a body_file by the file contents and
+// compiles body_regex patterns, so neither happens per check
+func (c *ProxyConfig) prepareProxies() error {
+	var errs []error
+	for i := range c.Proxies {
+		p := &c.Proxies[i]
+		if p.BodyRegex != "" {
+			// Validate has already rejected invalid patterns
+			p.bodyRegexp = regexp.MustCompile(p.BodyRegex)
+		}
+		if p.BodyFile == "" {
+			continue
+		}
+		data, err := os.ReadFile(p.BodyFile)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("proxy #%d: body_file: %w", i+1, err))
+			continue
+		}
+		p.Body = string(data)
+	}
+	return errors.Join(errs...)
+}
+
+// Protocols lists the supported proxy protocols
+var Protocols = []string{"socks5", "socks5h", "socks4", "socks4a", "http"}
+
+// Validate checks the config for problems that would otherwise only surface at runtime.
+// All problems are returned joined, one per line; proxies are referred to by position
+// so credentials never appear in the error.
+func (c *ProxyConfig) Validate() error {
+	var errs []error
+	add := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	// Only routes and proxies without an interval or cron schedule of their own use the global one
+	usesInterval := len(c.Routes) > 0
+	for _, p := range c.Proxies {
+		usesInterval = usesInterval || p.RequestIntervalMs == 0 && p.Cron == ""
+	}
+	if c.RequestInterval < 0 || c.RequestInterval == 0 && usesInterval {
+		add("request_interval_ms must be positive, got %d", c.RequestInterval)
+	}
+	switch {
+	case c.RequestTimeoutMs < 0:
+		add("request_timeout_ms must be positive, got %d", c.RequestTimeoutMs)
+	case c.RequestTimeoutMs == 0 && c.RequestTimeout <= 0:
+		add("request_timeout must be positive, got %d", c.RequestTimeout)
+	}
+	if c.JitterMs < 0 {
+		add("jitter_ms must be positive, got %d", c.JitterMs)
+	}
+	if c.ShutdownScrapeGraceMs < 0 {
+		add("shutdown_scrape_grace_ms must be positive, got %d", c.ShutdownScrapeGraceMs)
+	}
+	if c.ReloadVerifyTimeoutMs < 0 {
+		add("reload_verify_timeout_ms must be positive, got %d", c.ReloadVerifyTimeoutMs)
+	}
+	if c.BaselineFactor < 0 || (c.BaselineFactor > 0 && c.BaselineFactor < 1) {
+		add("baseline_factor must be at least 1, got %v", c.BaselineFactor)
+	}
+	if len(c.KafkaBrokers) > 0 && c.KafkaTopic == "" {
+		add("kafka_topic is required with kafka_brokers")
+	}
+	if c.KafkaTopic != "" && len(c.KafkaBrokers) == 0 {
+		add("kafka_brokers is required with kafka_topic")
+	}
+	for _, broker := range c.KafkaBrokers {
+		if _, port, err := net.SplitHostPort(broker); err != nil || port == "" {
+			add("kafka_brokers: %q must be host:port", broker)
+		}
+	}
+	if (c.KafkaTLS || c.KafkaSASL != nil) && len(c.KafkaBrokers) == 0 {
+		add("kafka_brokers is required with kafka_tls and kafka_sasl")
+	}
+	if s := c.KafkaSASL; s != nil {
+		switch s.Mechanism {
+		case "plain", "scram-sha-256", "scram-sha-512":
+		default:
+			add("kafka_sasl: mechanism must be plain, scram-sha-256 or scram-sha-512, got %q", s.Mechanism)
+		}
+		if s.Username == "" {
+			add("kafka_sasl: username is required")
+		}
+	}
+	renamedTo := make(map[string]string)
+	for _, from := range slices.Sorted(maps.Keys(c.LabelRename)) {
+		to := c.LabelRename[from]
+		if !isValidLabelName(from) || !isValidLabelName(to) {
+			add("label_rename: %q to %q: label names must match [a-zA-Z_][a-zA-Z0-9_]* and not start with __", from, to)
+		}
+		if prev, ok := renamedTo[to]; ok {
+			add("label_rename: %q and %q are both renamed to %q", prev, from, to)
+		}
+		renamedTo[to] = from
+	}
+	// A rename must not clash with a label that keeps its name, e.g. proxy_id to a custom label key
+	metricLabels := slices.Clone(labels.All)
+	for _, p := range c.Proxies {
+		metricLabels = slices.AppendSeq(metricLabels, maps.Keys(p.MetricLabels()))
+	}
+	for _, from := range slices.Sorted(maps.Keys(c.LabelRename)) {
+		to := c.LabelRename[from]
+		if _, renamed := c.LabelRename[to]; to != from && !renamed && slices.Contains(metricLabels, to) {
+			add("label_rename: %q is renamed to %q, which is already a metric label", from, to)
+		}
+	}
+	// 0 selects the default port
+	if c.MetricsPort < 0 || c.MetricsPort > 65535 {
+		add("metrics_port must be in 1-65535, got %d", c.MetricsPort)
+	}
+	if c.MetricsPath != "" && (!strings.HasPrefix(c.MetricsPath, "/") || slices.Contains([]string{"/healthz", "/readyz", "/probe", "/query"}, c.MetricsPath)) {
+		add("metrics_path must start with / and not be /healthz, /readyz, /probe or /query, got %q", c.MetricsPath)
+	}
+	for i, bucket := range c.LatencyBuckets {
+		if bucket <= 0 {
+			add("latency_buckets must be positive, got %v", bucket)
+		}
+		if i > 0 && bucket <= c.LatencyBuckets[i-1] {
+			add("latency_buckets must be sorted ascending, got %v after %v", bucket, c.LatencyBuckets[i-1])
+		}
+	}
+	for i, bucket := range c.SizeBuckets {
+		if bucket <= 0 {
+			add("size_buckets must be positive, got %v", bucket)
+		}
+		if i > 0 && bucket <= c.SizeBuckets[i-1] {
+			add("size_buckets must be sorted ascending, got %v after %v", bucket, c.SizeBuckets[i-1])
+		}
+	}
+
+	refs := make(map[string]Proxy) // by ref, for routes
+	for i, p := range c.Proxies {
+		name := "proxy #" + strconv.Itoa(i+1)
+		if p.Ref != "" {
+			if _, ok := refs[p.Ref]; ok {
+				add("%s: ref %q is already used", name, p.Ref)
+			}
+			refs[p.Ref] = p
+		}
+		if !isKnownProtocol(p.Protocol) {
+			add("%s: protocol must be one of %s, got %q", name, strings.Join(Protocols, ", "), p.Protocol)
+		}
+		if p.Proxy == "" {
+			add("%s: proxy address is not set", name)
+		} else if _, err := proxy.ParseURL(p.Protocol, p.Proxy); err != nil {
+			add("%s: %w", name, err)
+		}
+		if p.RequestIntervalMs < 0 {
+			add("%s: request_interval_ms must be positive, got %d", name, p.RequestIntervalMs)
+		}
+		if _, err := p.CronSchedule(); err != nil {
+			add("%s: invalid cron: %v", name, err)
+		}
+		if !isValidMethod(p.Method) {
+			add("%s: method must be one of %s in upper or lower case, got %q", name, strings.Join(Methods, ", "), p.Method)
+		}
+		// Options inspecting the response body need one
+		for _, option := range []struct {
+			name string
+			set  bool
+		}{
+			{"body_contains", p.BodyContains != ""},
+			{"body_regex", p.BodyRegex != ""},
+			{"expected_sha256", p.ExpectedSHA256 != ""},
+			{"monotonic_field", p.MonotonicField != ""},
+		} {
+			if !option.set {
+				continue
+			}
+			if p.GetMethod() == "HEAD" {
+				add("%s: %s needs a response body and can't be used with method HEAD", name, option.name)
+			}
+			if p.ConnectOnly || p.WebSocket || p.TLSOnly {
+				add("%s: %s needs an HTTP check and can't be combined with connect_only, websocket or tls_only", name, option.name)
+			}
+		}
+		if p.ExpectedSHA256 != "" {
+			if digest, err := hex.DecodeString(p.ExpectedSHA256); err != nil || len(digest) != sha256.Size {
+				add("%s: expected_sha256 must be 64 hex digits", name)
+			}
+		}
+		if p.BodyRegex != "" {
+			if _, err := regexp.Compile(p.BodyRegex); err != nil {
+				add("%s: invalid body_regex: %v", name, err)
+			}
+		}
+		// The allowlist would look up the target locally, the lookup remote DNS exists to avoid
+		if len(c.AllowedTargetCIDRs) > 0 && p.ConnectIP == "" {
+			protocols := []string{p.Protocol}
+			for _, hop := range p.Chain {
+				protocols = append(protocols, hop.Protocol)
+			}
+			for _, protocol := range protocols {
+				if isRemoteDNS(protocol) {
+					add("%s: allowed_target_cidrs resolves targets locally and can't be used with remote DNS protocol %s without connect_ip", name, protocol)
+					break
+				}
+			}
+		}
+		if p.EmptyBodyRetries < 0 {
+			add("%s: empty_body_retries must be positive, got %d", name, p.EmptyBodyRetries)
+		}
+		if p.EmptyBodyRetries > 0 && !p.EmptyBodyIsFailure {
+			add("%s: empty_body_retries requires empty_body_is_failure", name)
+		}
+		if p.MaxInFlight < 0 {
+			add("%s: max_in_flight must be positive, got %d", name, p.MaxInFlight)
+		}
+		if p.MaxConnsPerProxy < 0 {
+			add("%s: max_conns_per_proxy must be positive, got %d", name, p.MaxConnsPerProxy)
+		}
+		if p.MaxIdleConns < 0 {
+			add("%s: max_idle_conns must be positive, got %d", name, p.MaxIdleConns)
+		}
+		if p.MaxIdleConnsPerHost < 0 {
+			add("%s: max_idle_conns_per_host must be positive, got %d", name, p.MaxIdleConnsPerHost)
+		}
+		if p.IdleConnTimeoutMs < 0 {
+			add("%s: idle_conn_timeout_ms must be positive, got %d", name, p.IdleConnTimeoutMs)
+		}
+		if p.DialTimeoutMs < 0 {
+			add("%s: dial_timeout_ms must be positive, got %d", name, p.DialTimeoutMs)
+		}
+		if p.RequestTimeout < 0 {
+			add("%s: request_timeout must be positive, got %d", name, p.RequestTimeout)
+		}
+		if p.RequestTimeoutMs < 0 {
+			add("%s: request_timeout_ms must be positive, got %d", name, p.RequestTimeoutMs)
+		}
+		for j, hop := range p.Chain {
+			if !isKnownProtocol(hop.Protocol) {
+				add("%s: chain hop %d: protocol must be one of %s, got %q", name, j+2, strings.Join(Protocols, ", "), hop.Protocol)
+			}
+			if _, err := proxy.ParseURL(hop.Protocol, hop.Proxy); err != nil {
+				add("%s: chain hop %d: %w", name, j+2, err)
+			}
+		}
+
+		if p.ConnectOnly && len(p.CompareTargets) > 0 {
+			add("%s: connect_only can't be combined with compare_targets", name)
+		}
+
+		if p.WebSocket && (p.ConnectOnly || len(p.CompareTargets) > 0) {
+			add("%s: websocket can't be combined with connect_only or compare_targets", name)
+		}
+
+		if p.TLSOnly && (p.ConnectOnly || p.WebSocket || len(p.CompareTargets) > 0) {
+			add("%s: tls_only can't be combined with connect_only, websocket or compare_targets", name)
+		}
+
+		if p.RequireOCSPStapling && (p.ConnectOnly || p.WebSocket) {
+			add("%s: require_ocsp_stapling needs an HTTP check and can't be combined with connect_only or websocket", name)
+		}
+
+		targets := p.CompareTargets
+		if len(targets) == 0 {
+			targets = []string{p.GetTargetURL(c.DefaultTargetURL)}
+		} else if len(targets) != 2 {
+			add("%s: compare_targets must contain exactly two URLs, got %d", name, len(targets))
+		}
+		for _, target := range targets {
+			if err := ValidateTargetURL(target); err != nil {
+				add("%s: %w", name, err)
+			}
+		}
+	}
+
+	routeNames := make(map[string]bool)
+	for i, r := range c.Routes {
+		name := "route #" + strconv.Itoa(i+1)
+		switch {
+		case r.Name == "":
+			add("%s: name is not set", name)
+		case routeNames[r.Name]:
+			add("%s: name %q is already used", name, r.Name)
+		}
+		routeNames[r.Name] = true
+		if len(r.Proxies) < 2 {
+			add("%s: proxies must contain at least two proxies, got %d", name, len(r.Proxies))
+		}
+		for _, ref := range r.Proxies {
+			p, ok := refs[ref]
+			switch {
+			case !ok:
+				add("%s: no proxy has ref %q", name, ref)
+			case len(p.Chain) > 0:
+				add("%s: proxy %q has a chain; route hops must be single proxies", name, ref)
+			}
+		}
+		if err := ValidateTargetURL(r.GetTargetURL(c.DefaultTargetURL)); err != nil {
+			add("%s: %w", name, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// labelNamePattern matches valid Prometheus label names
+var labelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// isValidLabelName reports whether name is a valid label name that is not reserved (__ prefix)
+func isValidLabelName(name string) bool {
+	return labelNamePattern.MatchString(name) && !strings.HasPrefix(name, "__")
+}
+
+// isRemoteDNS reports whether protocol has the proxy resolve target hostnames, ignoring case
+func isRemoteDNS(protocol string) bool {
+	return strings.EqualFold(protocol, "socks5h") || strings.EqualFold(protocol, "socks4a")
+}
+
+// isValidMethod reports whether method is empty or one of Methods in upper or lower case,
+// as the schema allows
+func isValidMethod(method string) bool {
+	return method == "" || slices.Contains(Methods, method) ||
+		method == strings.ToLower(method) && slices.Contains(Methods, strings.ToUpper(method))
+}
+
+// isKnownProtocol reports whether protocol is one of Protocols, ignoring case
+func isKnownProtocol(protocol string) bool {
+	return slices.Contains(Protocols, strings.ToLower(protocol))
+}
+
+// ValidateTargetURL checks that target is an absolute URL with a scheme and host
+func ValidateTargetURL(target string) error {
+	if target == "" {
+		return errors.New("target_url is not set and there is no default_target_url")
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return fmt.Errorf("invalid target URL %q: %w", target, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("target URL %q must include a scheme and host", u.Redacted())
+	}
+	return nil
+}
+
+// MaskURL returns rawURL with the password of its userinfo, if any, replaced by xxxxx,
+// for logs and error messages
+func MaskURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	return u.Redacted()
+}
+
 // GetLatencyBuckets returns latency buckets, using config if provided, otherwise defaults
 func (c *ProxyConfig) GetLatencyBuckets() []float64 {
 	if len(c.LatencyBuckets) > 0 {
@@ -74,3 +942,12 @@ func (c *ProxyConfig) GetLatencyBuckets() []float64 {
 		10.0, // 10s - timeout
 	}
 }
+
+// GetSizeBuckets returns response size buckets in bytes, using config if provided, otherwise defaults
+func (c *ProxyConfig) GetSizeBuckets() []float64 {
+	if len(c.SizeBuckets) > 0 {
+		return c.SizeBuckets
+	}
+	// Powers of 4 from 256B to 4MiB
+	return []float64{256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304}
+}
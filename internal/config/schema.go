@@ -0,0 +1,76 @@
+package config
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"gopkg.in/yaml.v3"
+)
+
+// Schema is the JSON Schema describing the configuration file
+//
+//go:embed schema.json
+var Schema []byte
+
+// schemaURL is the location the embedded schema is registered under
+const schemaURL = "proxies.schema.json"
+
+// ValidateSchema validates a YAML config document against Schema after environment expansion.
+// All violations are reported, one per line, prefixed with the path of the offending field.
+func ValidateSchema(data []byte) error {
+	var doc any
+	if err := yaml.Unmarshal(ExpandEnv(data), &doc); err != nil {
+		return err
+	}
+
+	// Round-trip through JSON so the validator sees JSON types (e.g. numbers, string map keys)
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	instance, err := jsonschema.UnmarshalJSON(bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+
+	schemaDoc, err := jsonschema.UnmarshalJSON(bytes.NewReader(Schema))
+	if err != nil {
+		return fmt.Errorf("invalid embedded schema: %w", err)
+	}
+	c := jsonschema.NewCompiler()
+	c.AssertFormat()
+	if err := c.AddResource(schemaURL, schemaDoc); err != nil {
+		return fmt.Errorf("invalid embedded schema: %w", err)
+	}
+	sch, err := c.Compile(schemaURL)
+	if err != nil {
+		return fmt.Errorf("invalid embedded schema: %w", err)
+	}
+
+	err = sch.Validate(instance)
+	verr, ok := err.(*jsonschema.ValidationError)
+	if !ok {
+		return err
+	}
+
+	printer := message.NewPrinter(language.English)
+	var lines []string
+	var collect func(e *jsonschema.ValidationError)
+	collect = func(e *jsonschema.ValidationError) {
+		if len(e.Causes) == 0 {
+			lines = append(lines, "/"+strings.Join(e.InstanceLocation, "/")+": "+e.ErrorKind.LocalizedString(printer))
+			return
+		}
+		for _, cause := range e.Causes {
+			collect(cause)
+		}
+	}
+	collect(verr)
+	return fmt.Errorf("config does not match schema:\n  %s", strings.Join(lines, "\n  "))
+}
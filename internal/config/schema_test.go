@@ -0,0 +1,73 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestValidateSchema_Example(t *testing.T) {
+	data, err := os.ReadFile("../../proxies.yaml.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateSchema(data); err != nil {
+		t.Errorf("example config does not validate: %v", err)
+	}
+}
+
+func TestValidateSchema_Violations(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want string
+	}{
+		{
+			name: "unknown protocol",
+			yaml: "proxies:\n  - protocol: ftp\n    proxy: host:1080\n",
+			want: "/proxies/0/protocol:",
+		},
+		{
+			name: "missing proxy address",
+			yaml: "proxies:\n  - protocol: http\n  - protocol: socks5\n",
+			want: "/proxies/1: missing property 'proxy'",
+		},
+		{
+			name: "typo in field name",
+			yaml: "request_interval: 1000\nproxies:\n  - protocol: http\n    proxy: host:8080\n",
+			want: "/: additional properties 'request_interval' not allowed",
+		},
+		{
+			name: "port out of range",
+			yaml: "metrics_port: 70000\nproxies: []\n",
+			want: "/metrics_port:",
+		},
+		{
+			name: "wrong type",
+			yaml: "proxies:\n  - protocol: http\n    proxy: host:8080\n    warn_status_codes: [\"429\"]\n",
+			want: "/proxies/0/warn_status_codes/0:",
+		},
+		{
+			name: "mixed case method",
+			yaml: "proxies:\n  - protocol: http\n    proxy: host:8080\n    method: Post\n",
+			want: "/proxies/0/method:",
+		},
+		{
+			name: "invalid connect_ip",
+			yaml: "proxies:\n  - protocol: http\n    proxy: host:8080\n    connect_ip: not-an-ip\n",
+			want: "/proxies/0/connect_ip:",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateSchema([]byte(tt.yaml))
+			if err == nil {
+				t.Fatal("expected schema violation, got nil")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %q does not contain %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,267 @@
+package history
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	_ "modernc.org/sqlite" // registers the "sqlite" database/sql driver
+
+	"eugene-chernyshenko/proxy-synthetic-check/internal/request"
+)
+
+// Row is one recorded check outcome
+type Row struct {
+	ProxyID string        `json:"proxy_id"`
+	Time    time.Time     `json:"ts"`
+	Status  string        `json:"status"`
+	Latency time.Duration `json:"-"`
+	Error   string        `json:"error"`
+	Code    int           `json:"code"` // HTTP status code, 0 when no response was received
+}
+
+// MarshalJSON encodes the latency in seconds, like the metrics
+func (r Row) MarshalJSON() ([]byte, error) {
+	type row Row
+	return json.Marshal(struct {
+		row
+		LatencySeconds float64 `json:"latency_seconds"`
+	}{row(r), r.Latency.Seconds()})
+}
+
+const schema = `CREATE TABLE IF NOT EXISTS results (
+	proxy_id TEXT NOT NULL,
+	ts INTEGER NOT NULL,
+	status TEXT NOT NULL,
+	latency_seconds REAL NOT NULL,
+	error TEXT NOT NULL,
+	code INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS results_proxy_ts ON results (proxy_id, ts);
+CREATE INDEX IF NOT EXISTS results_ts ON results (ts);`
+
+// Store persists check outcomes in a SQLite database
+type Store struct {
+	db *sql.DB
+}
+
+// Open opens (creating if needed) the SQLite database at path
+func Open(path string) (*Store, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer; serialize access instead of failing with SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+// Close closes the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Insert writes rows in a single transaction
+func (s *Store) Insert(rows ...Row) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT INTO results (proxy_id, ts, status, latency_seconds, error, code) VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, r := range rows {
+		if _, err := stmt.Exec(r.ProxyID, r.Time.UnixMilli(), r.Status, r.Latency.Seconds(), r.Error, r.Code); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Recent returns up to limit most recent rows, newest first. An empty proxyID matches all proxies.
+func (s *Store) Recent(proxyID string, limit int) ([]Row, error) {
+	rows, err := s.db.Query(`SELECT proxy_id, ts, status, latency_seconds, error, code FROM results
+		WHERE ? = '' OR proxy_id = ? ORDER BY ts DESC LIMIT ?`, proxyID, proxyID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []Row
+	for rows.Next() {
+		var r Row
+		var ts int64
+		var latency float64
+		if err := rows.Scan(&r.ProxyID, &ts, &r.Status, &latency, &r.Error, &r.Code); err != nil {
+			return nil, err
+		}
+		r.Time = time.UnixMilli(ts)
+		r.Latency = time.Duration(latency * float64(time.Second))
+		result = append(result, r)
+	}
+	return result, rows.Err()
+}
+
+// Prune deletes rows older than before and returns how many were deleted
+func (s *Store) Prune(before time.Time) (int64, error) {
+	res, err := s.db.Exec(`DELETE FROM results WHERE ts < ?`, before.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// defaultQueryLimit and maxQueryLimit bound the rows returned by the query endpoint
+const (
+	defaultQueryLimit = 100
+	maxQueryLimit     = 10000
+)
+
+// Handler serves recent rows as JSON, filtered by the optional proxy_id and limit query parameters
+func (s *Store) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := defaultQueryLimit
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+			limit = min(n, maxQueryLimit)
+		}
+
+		rows, err := s.Recent(r.URL.Query().Get("proxy_id"), limit)
+		if err != nil {
+			log.Printf("Error querying history: %v", err)
+			http.Error(w, "query failed", http.StatusInternalServerError)
+			return
+		}
+		if rows == nil {
+			rows = []Row{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rows)
+	})
+}
+
+// Writer records check results into a Store asynchronously so checks never wait on disk.
+// A nil *Writer discards results.
+type Writer struct {
+	store     *Store
+	retention time.Duration
+	rows      chan Row
+	stop      chan struct{} // Closed by Close
+	done      chan struct{} // Closed when Run returns
+}
+
+// writerQueueSize bounds results buffered for writing; further results are dropped
+const writerQueueSize = 1024
+
+// NewWriter creates a writer for store that prunes rows older than retention
+func NewWriter(store *Store, retention time.Duration) *Writer {
+	return &Writer{
+		store:     store,
+		retention: retention,
+		rows:      make(chan Row, writerQueueSize),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// Add queues a check result for writing, dropping it if the queue is full
+func (w *Writer) Add(proxyID string, result request.CheckResult) {
+	if w == nil {
+		return
+	}
+	row := Row{
+		ProxyID: proxyID,
+		Time:    time.Now(),
+		Status:  result.Status,
+		Latency: result.Duration,
+		Error:   result.ErrorType,
+		Code:    result.StatusCode,
+	}
+	select {
+	case w.rows <- row:
+	default:
+		log.Printf("[%s] Warning: history queue full, result dropped", proxyID)
+	}
+}
+
+// pruneInterval is how often rows older than the retention are deleted
+const pruneInterval = time.Minute
+
+// Run writes queued results in batches and prunes old rows until Close is called
+func (w *Writer) Run() {
+	defer close(w.done)
+	prune := time.NewTicker(pruneInterval)
+	defer prune.Stop()
+
+	for {
+		select {
+		case row := <-w.rows:
+			w.write(row)
+		case <-prune.C:
+			if _, err := w.store.Prune(time.Now().Add(-w.retention)); err != nil {
+				log.Printf("Error pruning history: %v", err)
+			}
+		case <-w.stop:
+			w.flush()
+			if err := w.store.Close(); err != nil {
+				log.Printf("Error closing history database: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// flush writes the results still queued
+func (w *Writer) flush() {
+	for {
+		select {
+		case row := <-w.rows:
+			w.write(row)
+		default:
+			return
+		}
+	}
+}
+
+// write inserts row together with the rows queued behind it, up to a queue's worth
+func (w *Writer) write(row Row) {
+	batch := []Row{row}
+drain:
+	for len(batch) < writerQueueSize {
+		select {
+		case row := <-w.rows:
+			batch = append(batch, row)
+		default:
+			break drain
+		}
+	}
+	if err := w.store.Insert(batch...); err != nil {
+		log.Printf("Error writing %d history rows: %v", len(batch), err)
+	}
+}
+
+// Close stops Run once the queued results are written, then closes the store.
+// Results added afterwards are discarded.
+func (w *Writer) Close() {
+	if w == nil {
+		return
+	}
+	close(w.stop)
+	<-w.done
+}
@@ -0,0 +1,140 @@
+package history
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"eugene-chernyshenko/proxy-synthetic-check/internal/request"
+)
+
+func openTestStore(t *testing.T) *Store {
+	t.Helper()
+	store, err := Open(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestStore_InsertRecentPrune(t *testing.T) {
+	store := openTestStore(t)
+	now := time.Now().Truncate(time.Millisecond)
+
+	err := store.Insert(
+		Row{ProxyID: "proxy_1", Time: now.Add(-2 * time.Hour), Status: "success", Latency: 100 * time.Millisecond, Code: 200},
+		Row{ProxyID: "proxy_1", Time: now, Status: "error", Latency: 2 * time.Second, Error: "timeout"},
+		Row{ProxyID: "proxy_2", Time: now.Add(-time.Minute), Status: "error", Latency: 50 * time.Millisecond, Error: "http_503", Code: 503},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := store.Recent("proxy_1", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("Recent(proxy_1) returned %d rows, want 2", len(rows))
+	}
+	want := Row{ProxyID: "proxy_1", Time: now, Status: "error", Latency: 2 * time.Second, Error: "timeout"}
+	if rows[0] != want {
+		t.Errorf("newest row = %+v, want %+v", rows[0], want)
+	}
+
+	all, err := store.Recent("", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all[1].ProxyID != "proxy_2" {
+		t.Errorf("Recent(all, 2) = %+v, want proxy_1 then proxy_2", all)
+	}
+
+	deleted, err := store.Prune(now.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 1 {
+		t.Errorf("Prune deleted %d rows, want 1", deleted)
+	}
+}
+
+func TestWriter_Add(t *testing.T) {
+	store := openTestStore(t)
+	w := NewWriter(store, time.Hour)
+	go w.Run()
+
+	w.Add("proxy_1", request.CheckResult{Status: "success", Duration: 300 * time.Millisecond, StatusCode: 204})
+
+	var rows []Row
+	deadline := time.Now().Add(2 * time.Second)
+	for len(rows) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		var err error
+		if rows, err = store.Recent("proxy_1", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(rows) != 1 || rows[0].Code != 204 || rows[0].Latency != 300*time.Millisecond {
+		t.Errorf("rows = %+v, want one success with code 204", rows)
+	}
+
+	// A nil writer discards results
+	var nilWriter *Writer
+	nilWriter.Add("proxy_1", request.CheckResult{})
+}
+
+func TestWriter_CloseWritesQueue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(store, time.Hour)
+	for range 3 {
+		w.Add("proxy_1", request.CheckResult{Status: "success"})
+	}
+	go w.Run()
+
+	w.Close()
+	if err := store.db.Ping(); err == nil {
+		t.Error("store still open after Close")
+	}
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if rows, err := reopened.Recent("proxy_1", 10); err != nil || len(rows) != 3 {
+		t.Errorf("Recent() = %d rows, %v after Close, want the 3 queued ones", len(rows), err)
+	}
+
+	var nilWriter *Writer
+	nilWriter.Close()
+}
+
+func TestStore_Handler(t *testing.T) {
+	store := openTestStore(t)
+	if err := store.Insert(Row{ProxyID: "proxy_1", Time: time.Now(), Status: "success", Latency: time.Second, Code: 200}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	store.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/query?proxy_id=proxy_1", nil))
+	var got []map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON %q: %v", rec.Body.String(), err)
+	}
+	if len(got) != 1 || got[0]["latency_seconds"] != 1.0 || got[0]["code"] != 200.0 {
+		t.Errorf("response = %v, want one row with latency_seconds 1 and code 200", got)
+	}
+
+	rec = httptest.NewRecorder()
+	store.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/query?limit=x", nil))
+	if rec.Code != 400 {
+		t.Errorf("invalid limit: status %d, want 400", rec.Code)
+	}
+}
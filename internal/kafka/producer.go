@@ -0,0 +1,85 @@
+package kafka
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+
+	"eugene-chernyshenko/proxy-synthetic-check/internal/config"
+)
+
+// Producer publishes keyed messages to a Kafka topic
+type Producer interface {
+	Produce(ctx context.Context, key, value []byte) error
+	Close() error
+}
+
+// produceTimeout bounds publishing one message, including the client's retries
+const produceTimeout = 10 * time.Second
+
+// Client is a Producer backed by a franz-go client. Messages are acknowledged by the partition
+// leader, and messages with the same key go to the same partition.
+type Client struct {
+	client *kgo.Client
+}
+
+// NewClient creates a producer for topic, bootstrapping from brokers (host:port), over TLS
+// with useTLS and authenticated with saslConfig when set. Nothing is dialed until the first
+// message.
+func NewClient(brokers []string, topic string, useTLS bool, saslConfig *config.KafkaSASL) (*Client, error) {
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(brokers...),
+		kgo.DefaultProduceTopic(topic),
+		// Check results are telemetry: the leader's acknowledgement is enough, and
+		// idempotent writes would require acknowledgement by all in-sync replicas
+		kgo.RequiredAcks(kgo.LeaderAck()),
+		kgo.DisableIdempotentWrite(),
+	}
+	if useTLS {
+		opts = append(opts, kgo.DialTLSConfig(&tls.Config{}))
+	}
+	if saslConfig != nil {
+		mechanism, err := saslMechanism(saslConfig)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, kgo.SASL(mechanism))
+	}
+
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("kafka: %w", err)
+	}
+	return &Client{client: client}, nil
+}
+
+// saslMechanism returns the SASL mechanism configured by c
+func saslMechanism(c *config.KafkaSASL) (sasl.Mechanism, error) {
+	switch c.Mechanism {
+	case "plain":
+		return plain.Auth{User: c.Username, Pass: c.Password}.AsMechanism(), nil
+	case "scram-sha-256":
+		return scram.Auth{User: c.Username, Pass: c.Password}.AsSha256Mechanism(), nil
+	case "scram-sha-512":
+		return scram.Auth{User: c.Username, Pass: c.Password}.AsSha512Mechanism(), nil
+	default:
+		return nil, fmt.Errorf("kafka: unsupported SASL mechanism %q", c.Mechanism)
+	}
+}
+
+// Produce writes one message to the partition of key and waits for the leader's acknowledgement
+func (c *Client) Produce(ctx context.Context, key, value []byte) error {
+	return c.client.ProduceSync(ctx, &kgo.Record{Key: key, Value: value}).FirstErr()
+}
+
+// Close closes the connections to the brokers
+func (c *Client) Close() error {
+	c.client.Close()
+	return nil
+}
@@ -0,0 +1,22 @@
+package kafka
+
+import (
+	"testing"
+
+	"eugene-chernyshenko/proxy-synthetic-check/internal/config"
+)
+
+func TestNewClient_SASL(t *testing.T) {
+	for _, mechanism := range []string{"plain", "scram-sha-256", "scram-sha-512"} {
+		client, err := NewClient([]string{"127.0.0.1:9092"}, "checks", true, &config.KafkaSASL{Mechanism: mechanism, Username: "checker", Password: "secret"})
+		if err != nil {
+			t.Errorf("NewClient() with %s error = %v", mechanism, err)
+			continue
+		}
+		client.Close()
+	}
+
+	if _, err := NewClient([]string{"127.0.0.1:9092"}, "checks", false, &config.KafkaSASL{Mechanism: "gssapi", Username: "checker"}); err == nil {
+		t.Error("NewClient() error = nil for an unsupported SASL mechanism")
+	}
+}
@@ -0,0 +1,140 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"eugene-chernyshenko/proxy-synthetic-check/internal/metrics"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/request"
+)
+
+// Message is the JSON payload published for one check result
+type Message struct {
+	ProxyID        string    `json:"proxy_id"`
+	Time           time.Time `json:"ts"`
+	Status         string    `json:"status"`
+	LatencySeconds float64   `json:"latency_seconds"`
+	Error          string    `json:"error"`
+	Code           int       `json:"code"` // HTTP status code, 0 when no response was received
+}
+
+// Sink publishes check results to Kafka asynchronously so checks never wait on the brokers.
+// A nil *Sink discards results.
+type Sink struct {
+	producer Producer
+	m        *metrics.Metrics
+	messages chan Message
+	stop     chan struct{} // Closed by Close
+	done     chan struct{} // Closed when Run returns
+	failing  bool          // Whether the last publish failed
+}
+
+// sinkQueueSize bounds results buffered for publishing; further results are dropped
+const sinkQueueSize = 1024
+
+// sinkFlushTimeout bounds publishing the results still queued on Close
+const sinkFlushTimeout = 5 * time.Second
+
+// NewSink creates a sink publishing through producer
+func NewSink(producer Producer, m *metrics.Metrics) *Sink {
+	return &Sink{
+		producer: producer,
+		m:        m,
+		messages: make(chan Message, sinkQueueSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Add queues a check result for publishing, dropping it if the queue is full
+func (s *Sink) Add(proxyID string, result request.CheckResult) {
+	if s == nil {
+		return
+	}
+	msg := Message{
+		ProxyID:        proxyID,
+		Time:           time.Now(),
+		Status:         result.Status,
+		LatencySeconds: result.Duration.Seconds(),
+		Error:          result.ErrorType,
+		Code:           result.StatusCode,
+	}
+	select {
+	case s.messages <- msg:
+	default:
+		s.m.KafkaDropped.Inc()
+	}
+}
+
+// Run publishes queued results one by one, keyed by proxy ID, until Close is called.
+// Failures are counted, and logged only when publishing starts and stops failing.
+func (s *Sink) Run() {
+	defer close(s.done)
+	for {
+		select {
+		case msg := <-s.messages:
+			s.publish(context.Background(), msg)
+		case <-s.stop:
+			s.flush()
+			if err := s.producer.Close(); err != nil {
+				log.Printf("Error closing Kafka producer: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// flush publishes the results still queued within sinkFlushTimeout and counts the rest as dropped
+func (s *Sink) flush() {
+	ctx, cancel := context.WithTimeout(context.Background(), sinkFlushTimeout)
+	defer cancel()
+	for {
+		select {
+		case msg := <-s.messages:
+			if ctx.Err() != nil {
+				s.m.KafkaDropped.Inc()
+				continue
+			}
+			s.publish(ctx, msg)
+		default:
+			return
+		}
+	}
+}
+
+// Close stops Run once the queued results are published, then closes the producer.
+// Results added afterwards are discarded.
+func (s *Sink) Close() {
+	if s == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+}
+
+func (s *Sink) publish(ctx context.Context, msg Message) {
+	err := s.produce(ctx, msg)
+	switch {
+	case err != nil:
+		s.m.KafkaDeliveryErrors.Inc()
+		if !s.failing {
+			log.Printf("Error publishing check results to Kafka: %v", err)
+		}
+		s.failing = true
+	case s.failing:
+		log.Printf("Publishing check results to Kafka recovered")
+		s.failing = false
+	}
+}
+
+func (s *Sink) produce(ctx context.Context, msg Message) error {
+	value, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, produceTimeout)
+	defer cancel()
+	return s.producer.Produce(ctx, []byte(msg.ProxyID), value)
+}
@@ -0,0 +1,114 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"eugene-chernyshenko/proxy-synthetic-check/internal/metrics/metricstest"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/request"
+)
+
+type produced struct {
+	key, value []byte
+}
+
+// mockProducer records messages, failing with err when set
+type mockProducer struct {
+	err      error
+	messages chan produced
+	closed   bool
+}
+
+func (p *mockProducer) Produce(ctx context.Context, key, value []byte) error {
+	p.messages <- produced{key, value}
+	return p.err
+}
+
+func (p *mockProducer) Close() error {
+	p.closed = true
+	return nil
+}
+
+func TestSink_PublishesResultsByProxyID(t *testing.T) {
+	producer := &mockProducer{messages: make(chan produced, 1)}
+	sink := NewSink(producer, metricstest.New(t))
+	go sink.Run()
+
+	sink.Add("proxy_1", request.CheckResult{Status: "error", ErrorType: "http_503", Duration: 250 * time.Millisecond, StatusCode: 503})
+
+	var msg produced
+	select {
+	case msg = <-producer.messages:
+	case <-time.After(time.Second):
+		t.Fatal("no message produced")
+	}
+	if string(msg.key) != "proxy_1" {
+		t.Errorf("key = %q, want proxy_1", msg.key)
+	}
+	var got Message
+	if err := json.Unmarshal(msg.value, &got); err != nil {
+		t.Fatalf("payload %s: %v", msg.value, err)
+	}
+	if got.ProxyID != "proxy_1" || got.Status != "error" || got.Error != "http_503" || got.Code != 503 || got.LatencySeconds != 0.25 || got.Time.IsZero() {
+		t.Errorf("payload = %+v, want the check result of proxy_1", got)
+	}
+}
+
+func TestSink_CountsDeliveryErrors(t *testing.T) {
+	m := metricstest.New(t)
+	producer := &mockProducer{err: errors.New("broker down"), messages: make(chan produced, 1)}
+	sink := NewSink(producer, m)
+	go sink.Run()
+
+	before := testutil.ToFloat64(m.KafkaDeliveryErrors)
+	sink.Add("proxy_1", request.CheckResult{Status: "success"})
+	<-producer.messages
+	deadline := time.Now().Add(time.Second)
+	for testutil.ToFloat64(m.KafkaDeliveryErrors) != before+1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("kafka_delivery_errors_total = %v, want %v", testutil.ToFloat64(m.KafkaDeliveryErrors), before+1)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSink_DropsWhenQueueFull(t *testing.T) {
+	m := metricstest.New(t)
+	// Not running: nothing drains the queue
+	sink := NewSink(&mockProducer{}, m)
+	before := testutil.ToFloat64(m.KafkaDropped)
+	for range sinkQueueSize + 3 {
+		sink.Add("proxy_1", request.CheckResult{Status: "success"})
+	}
+	if got := testutil.ToFloat64(m.KafkaDropped); got != before+3 {
+		t.Errorf("kafka_messages_dropped_total = %v, want %v", got, before+3)
+	}
+
+	var nilSink *Sink
+	nilSink.Add("proxy_1", request.CheckResult{Status: "success"})
+}
+
+func TestSink_CloseFlushesQueue(t *testing.T) {
+	producer := &mockProducer{messages: make(chan produced, 3)}
+	sink := NewSink(producer, metricstest.New(t))
+	for range 3 {
+		sink.Add("proxy_1", request.CheckResult{Status: "success"})
+	}
+	go sink.Run()
+
+	sink.Close()
+	if got := len(producer.messages); got != 3 {
+		t.Errorf("published %d messages before Close returned, want 3", got)
+	}
+	if !producer.closed {
+		t.Error("producer not closed")
+	}
+
+	var nilSink *Sink
+	nilSink.Close()
+}
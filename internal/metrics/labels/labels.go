@@ -0,0 +1,36 @@
+// Package labels names the labels of the exported metrics besides the custom label keys.
+// It imports nothing, so config can check label_rename against them without importing metrics.
+package labels
+
+// Per-proxy labels, followed on every per-proxy metric by the custom label keys
+const (
+	ProxyID       = "proxy_id"
+	ProxyProtocol = "proxy_protocol"
+)
+
+// Labels further splitting some per-proxy metrics
+const (
+	Status      = "status"
+	Error       = "error"
+	StatusClass = "status_class"
+	Reason      = "reason"
+	ConnReused  = "conn_reused"
+	Target      = "target"
+	UserAgent   = "user_agent"
+)
+
+// Labels of the metrics that aren't per proxy
+const (
+	Hash      = "hash"
+	Version   = "version"
+	GoVersion = "go_version"
+	Route     = "route"
+	Hop       = "hop"
+)
+
+// All lists every label above
+var All = []string{
+	ProxyID, ProxyProtocol,
+	Status, Error, StatusClass, Reason, ConnReused, Target, UserAgent,
+	Hash, Version, GoVersion, Route, Hop,
+}
@@ -1,65 +1,613 @@
 package metrics
 
 import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
 	"sort"
+	"sync"
 
-	"github.com/prometheus/client_golang/prometheus"
 	"eugene-chernyshenko/proxy-synthetic-check/internal/config"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/metrics/labels"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-// Metrics holds all Prometheus metrics
+// Metrics holds all Prometheus metrics, registered in a registry of their own
 type Metrics struct {
-	RequestsTotal   *prometheus.CounterVec
-	RequestDuration *prometheus.HistogramVec
-	LabelKeys       []string
+	RequestsTotal    *prometheus.CounterVec
+	RequestDuration  *prometheus.HistogramVec
+	ResponseSize     *prometheus.HistogramVec
+	ProxyState       *prometheus.GaugeVec
+	LastSuccess      *prometheus.GaugeVec
+	InFlight         *prometheus.GaugeVec
+	LatencyAnomalies *prometheus.CounterVec
+	ConfigHashInfo   *prometheus.GaugeVec
+	RequestsSkipped  *prometheus.CounterVec
+	CheckPanics      *prometheus.CounterVec
+	ProxyInitErrors  *prometheus.CounterVec
+	ConnWait         *prometheus.HistogramVec
+	Redirects        *prometheus.CounterVec
+	ConnectionReuse  *prometheus.CounterVec
+
+	// Request phases from httptrace
+	DNSDuration          *prometheus.HistogramVec
+	ConnectDuration      *prometheus.HistogramVec
+	TLSHandshakeDuration *prometheus.HistogramVec
+	TimeToFirstByte      *prometheus.HistogramVec
+
+	// Leaf certificate of HTTPS targets
+	CertExpiry *prometheus.GaugeVec
+
+	ConfigReloadErrors prometheus.Counter
+
+	// Scale of the exporter itself
+	ConfiguredProxies prometheus.Gauge
+	LabelKeyCount     prometheus.Gauge
+	StartTime         prometheus.Gauge
+	BuildInfo         *prometheus.GaugeVec
+
+	// user_agent_rotation
+	RequestsByUserAgent *prometheus.CounterVec
+
+	// compare_targets mode
+	TargetLatency      *prometheus.GaugeVec
+	TargetLatencyDelta *prometheus.GaugeVec
+
+	// routes
+	RouteUp    *prometheus.GaugeVec
+	RouteHopUp *prometheus.GaugeVec
+
+	// baselines_file
+	LatencyRegression *prometheus.GaugeVec
+
+	// kafka_brokers
+	KafkaDeliveryErrors prometheus.Counter
+	KafkaDropped        prometheus.Counter
+
+	LabelKeys []string
+
+	proxyIDLabel string // name of the proxy_id label after label_rename
+
+	registry *prometheus.Registry
+
+	// max_error_cardinality
+	errorValuesMu  sync.Mutex
+	maxErrorValues int                        // 0 = unlimited
+	errorValues    map[string]map[string]bool // error label values recorded per proxy ID
+}
+
+// Definition describes one exposed metric: its name, type, help text, label keys in order
+// and, for histograms, the bucket upper bounds
+type Definition struct {
+	Name    string    `json:"name"`
+	Type    string    `json:"type"` // counter, gauge or histogram
+	Help    string    `json:"help"`
+	Labels  []string  `json:"labels"`
+	Buckets []float64 `json:"buckets,omitempty"`
 }
 
-// New creates and initializes Prometheus metrics with collected label keys
-func New(proxies []config.Proxy, buckets []float64) *Metrics {
+// Definitions returns the metrics New creates for proxies, latency buckets and response size
+// buckets with label names renamed by labelRename (may be nil), without registering anything
+func Definitions(proxies []config.Proxy, buckets, sizeBuckets []float64, labelRename map[string]string) []Definition {
+	defs := definitions(proxies, buckets, sizeBuckets)
+	for i := range defs {
+		for j, label := range defs[i].Labels {
+			if renamed, ok := labelRename[label]; ok {
+				defs[i].Labels[j] = renamed
+			}
+		}
+	}
+	return defs
+}
+
+// definitions returns the metric definitions with the original label names
+func definitions(proxies []config.Proxy, buckets, sizeBuckets []float64) []Definition {
 	// Collect all unique label keys from all proxies
 	labelKeys := collectLabelKeys(proxies)
 
-	// Build label list: proxy_id, proxy_protocol, ...labelKeys..., status, error
-	requestsLabels := []string{"proxy_id", "proxy_protocol"}
-	requestsLabels = append(requestsLabels, labelKeys...)
-	requestsLabels = append(requestsLabels, "status", "error")
+	// Build per-proxy label list: proxy_id, proxy_protocol, ...labelKeys...
+	proxyLabels := []string{labels.ProxyID, labels.ProxyProtocol}
+	proxyLabels = append(proxyLabels, labelKeys...)
 
-	requestsTotal := prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "requests_total",
-			Help: "Total number of requests",
-		},
-		requestsLabels,
-	)
-
-	// Build label list for histogram: proxy_id, proxy_protocol, ...labelKeys...
-	durationLabels := []string{"proxy_id", "proxy_protocol"}
-	durationLabels = append(durationLabels, labelKeys...)
+	// withLabels returns the per-proxy labels followed by extra
+	withLabels := func(extra ...string) []string {
+		return append(append([]string{}, proxyLabels...), extra...)
+	}
 
-	requestDuration := prometheus.NewHistogramVec(
-		prometheus.HistogramOpts{
+	return []Definition{
+		{
+			Name:   "requests_total",
+			Type:   "counter",
+			Help:   "Total number of requests",
+			Labels: withLabels(labels.Status, labels.Error, labels.StatusClass),
+		},
+		{
+			// Histogram additionally splits by status_class so fast failures don't skew success latency
 			Name:    "request_duration_seconds",
+			Type:    "histogram",
 			Help:    "Request latency distribution",
+			Labels:  withLabels(labels.StatusClass),
+			Buckets: buckets,
+		},
+		{
+			Name:    "response_size_bytes",
+			Type:    "histogram",
+			Help:    "Size of received response bodies",
+			Labels:  withLabels(),
+			Buckets: sizeBuckets,
+		},
+		{
+			Name:   "proxy_state",
+			Type:   "gauge",
+			Help:   "Proxy state from the last check: 2 = up, 1 = degraded, 0 = down",
+			Labels: withLabels(),
+		},
+		{
+			Name:   "last_success_timestamp_seconds",
+			Type:   "gauge",
+			Help:   "Unix time of the last successful check",
+			Labels: withLabels(),
+		},
+		{
+			Name:   "in_flight_requests",
+			Type:   "gauge",
+			Help:   "Number of HTTP checks currently outstanding",
+			Labels: withLabels(),
+		},
+		{
+			Name:   "proxy_latency_regression",
+			Type:   "gauge",
+			Help:   "Whether the last successful check was slower than the proxy's baseline latency times baseline_factor",
+			Labels: withLabels(),
+		},
+		{
+			Name:   "latency_anomaly_total",
+			Type:   "counter",
+			Help:   "Number of non-positive or implausibly large latency measurements that were clamped",
+			Labels: withLabels(),
+		},
+		{
+			Name:   "config_hash_info",
+			Type:   "gauge",
+			Help:   "Short SHA-256 of the loaded configuration, always 1",
+			Labels: []string{labels.Hash},
+		},
+		{
+			Name:   "requests_skipped_total",
+			Type:   "counter",
+			Help:   "Number of checks that were not performed, by reason",
+			Labels: withLabels(labels.Reason),
+		},
+		{
+			Name:   "check_panics_total",
+			Type:   "counter",
+			Help:   "Number of checks that panicked and were recovered",
+			Labels: withLabels(),
+		},
+		{
+			Name:   "proxy_init_errors_total",
+			Type:   "counter",
+			Help:   "Number of times a proxy's runner could not be set up, e.g. because of an invalid proxy address",
+			Labels: withLabels(),
+		},
+		{
+			// Grows when requests queue for one of max_conns_per_proxy connections
+			Name:    "conn_wait_seconds",
+			Type:    "histogram",
+			Help:    "Time from requesting a connection to the target until getting one, including dialing",
+			Labels:  withLabels(),
 			Buckets: buckets,
 		},
-		durationLabels,
-	)
+		{
+			Name:   "connection_reuse_total",
+			Type:   "counter",
+			Help:   "Connections to the target obtained by HTTP checks, by whether an idle one was reused",
+			Labels: withLabels(labels.ConnReused),
+		},
+		{
+			Name:   "redirects_total",
+			Type:   "counter",
+			Help:   "Total number of redirects followed by HTTP checks",
+			Labels: withLabels(),
+		},
+		{
+			Name:    "dns_duration_seconds",
+			Type:    "histogram",
+			Help:    "Time to resolve a hostname locally when dialing a new connection (the proxy, or the target without a SOCKS proxy)",
+			Labels:  withLabels(),
+			Buckets: buckets,
+		},
+		{
+			Name:    "connect_duration_seconds",
+			Type:    "histogram",
+			Help:    "Time to establish a TCP connection when dialing a new connection",
+			Labels:  withLabels(),
+			Buckets: buckets,
+		},
+		{
+			Name:    "tls_handshake_duration_seconds",
+			Type:    "histogram",
+			Help:    "Time of the TLS handshake with the target on new connections",
+			Labels:  withLabels(),
+			Buckets: buckets,
+		},
+		{
+			Name:    "time_to_first_byte_seconds",
+			Type:    "histogram",
+			Help:    "Time from the request being written until the first byte of the response",
+			Labels:  withLabels(),
+			Buckets: buckets,
+		},
+		{
+			Name:   "tls_cert_expiry_timestamp_seconds",
+			Type:   "gauge",
+			Help:   "Unix time the leaf certificate presented by the target expires",
+			Labels: withLabels(labels.Target),
+		},
+		{
+			Name:   "config_reload_errors_total",
+			Type:   "counter",
+			Help:   "Number of configuration reloads that failed and kept the previous configuration",
+			Labels: []string{},
+		},
+		{
+			Name:   "exporter_configured_proxies",
+			Type:   "gauge",
+			Help:   "Number of proxies in the loaded configuration",
+			Labels: []string{},
+		},
+		{
+			Name:   "exporter_label_keys",
+			Type:   "gauge",
+			Help:   "Number of custom label keys exported on the per-proxy metrics, fixed at startup",
+			Labels: []string{},
+		},
+		{
+			Name:   "exporter_start_time_seconds",
+			Type:   "gauge",
+			Help:   "Start time of the exporter process since unix epoch in seconds",
+			Labels: []string{},
+		},
+		{
+			Name:   "exporter_build_info",
+			Type:   "gauge",
+			Help:   "Version of the exporter and the Go toolchain it was built with, always 1",
+			Labels: []string{labels.Version, labels.GoVersion},
+		},
+		{
+			Name:   "requests_by_user_agent_total",
+			Type:   "counter",
+			Help:   "Number of checks by the User-Agent chosen from user_agent_rotation",
+			Labels: withLabels(labels.UserAgent, labels.Status),
+		},
+		{
+			Name:   "target_latency_seconds",
+			Type:   "gauge",
+			Help:   "Latency of the last paired probe per target in compare_targets mode",
+			Labels: withLabels(labels.Target),
+		},
+		{
+			Name:   "target_latency_delta_seconds",
+			Type:   "gauge",
+			Help:   "Latency of the second compare_targets URL minus the first, from the last paired probe",
+			Labels: withLabels(),
+		},
+		{
+			Name:   "route_up",
+			Type:   "gauge",
+			Help:   "Whether every hop of the route forwarded in the last check: 1 = up, 0 = down",
+			Labels: []string{labels.Route},
+		},
+		{
+			Name:   "route_hop_up",
+			Type:   "gauge",
+			Help:   "Whether the hop connected to the next hop (or the target) through the hops before it in the last check",
+			Labels: []string{labels.Route, labels.Hop},
+		},
+		{
+			Name:   "kafka_delivery_errors_total",
+			Type:   "counter",
+			Help:   "Number of check results that could not be published to Kafka",
+			Labels: []string{},
+		},
+		{
+			Name:   "kafka_messages_dropped_total",
+			Type:   "counter",
+			Help:   "Number of check results dropped because the Kafka publishing queue was full",
+			Labels: []string{},
+		},
+	}
+}
+
+// New creates and initializes Prometheus metrics with collected label keys. Label names are
+// renamed by labelRename (may be nil), which must have passed config validation. It fails when
+// a metric can't be registered, e.g. because of a clash with an already registered one.
+func New(proxies []config.Proxy, buckets, sizeBuckets []float64, labelRename map[string]string) (*Metrics, error) {
+	m := newMetrics(proxies, buckets, sizeBuckets, labelRename)
+	if err := m.register(); err != nil {
+		return nil, err
+	}
+
+	m.SetConfigured(proxies)
+	m.StartTime.SetToCurrentTime()
+	version, goVersion := buildVersion()
+	m.BuildInfo.WithLabelValues(version, goVersion).Set(1)
+
+	return m, nil
+}
+
+// NewProbe creates metrics for a single on-demand check of proxies, as New does, but registers
+// only the metrics recorded by checks, leaving out those of the exporter and the Go runtime
+func NewProbe(proxies []config.Proxy, buckets, sizeBuckets []float64, labelRename map[string]string) (*Metrics, error) {
+	m := newMetrics(proxies, buckets, sizeBuckets, labelRename)
+	if err := m.registerAll(m.checkCollectors()); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// newMetrics creates the metrics of New without registering them
+func newMetrics(proxies []config.Proxy, buckets, sizeBuckets []float64, labelRename map[string]string) *Metrics {
+	defs := make(map[string]Definition)
+	for _, def := range Definitions(proxies, buckets, sizeBuckets, labelRename) {
+		defs[def.Name] = def
+	}
+
+	m := &Metrics{
+		RequestsTotal:    newCounterVec(defs["requests_total"]),
+		RequestDuration:  newHistogramVec(defs["request_duration_seconds"]),
+		ResponseSize:     newHistogramVec(defs["response_size_bytes"]),
+		ProxyState:       newGaugeVec(defs["proxy_state"]),
+		LastSuccess:      newGaugeVec(defs["last_success_timestamp_seconds"]),
+		InFlight:         newGaugeVec(defs["in_flight_requests"]),
+		LatencyAnomalies: newCounterVec(defs["latency_anomaly_total"]),
+		ConfigHashInfo:   newGaugeVec(defs["config_hash_info"]),
+		RequestsSkipped:  newCounterVec(defs["requests_skipped_total"]),
+		CheckPanics:      newCounterVec(defs["check_panics_total"]),
+		ProxyInitErrors:  newCounterVec(defs["proxy_init_errors_total"]),
+		ConnWait:         newHistogramVec(defs["conn_wait_seconds"]),
+		Redirects:        newCounterVec(defs["redirects_total"]),
+		ConnectionReuse:  newCounterVec(defs["connection_reuse_total"]),
+
+		DNSDuration:          newHistogramVec(defs["dns_duration_seconds"]),
+		ConnectDuration:      newHistogramVec(defs["connect_duration_seconds"]),
+		TLSHandshakeDuration: newHistogramVec(defs["tls_handshake_duration_seconds"]),
+		TimeToFirstByte:      newHistogramVec(defs["time_to_first_byte_seconds"]),
+
+		CertExpiry: newGaugeVec(defs["tls_cert_expiry_timestamp_seconds"]),
+
+		ConfigReloadErrors: newCounter(defs["config_reload_errors_total"]),
+
+		ConfiguredProxies: newGauge(defs["exporter_configured_proxies"]),
+		LabelKeyCount:     newGauge(defs["exporter_label_keys"]),
+		StartTime:         newGauge(defs["exporter_start_time_seconds"]),
+		BuildInfo:         newGaugeVec(defs["exporter_build_info"]),
+
+		RequestsByUserAgent: newCounterVec(defs["requests_by_user_agent_total"]),
+
+		TargetLatency:      newGaugeVec(defs["target_latency_seconds"]),
+		TargetLatencyDelta: newGaugeVec(defs["target_latency_delta_seconds"]),
+
+		RouteUp:    newGaugeVec(defs["route_up"]),
+		RouteHopUp: newGaugeVec(defs["route_hop_up"]),
+
+		LatencyRegression: newGaugeVec(defs["proxy_latency_regression"]),
+
+		KafkaDeliveryErrors: newCounter(defs["kafka_delivery_errors_total"]),
+		KafkaDropped:        newCounter(defs["kafka_messages_dropped_total"]),
+
+		LabelKeys: collectLabelKeys(proxies),
+
+		proxyIDLabel: labels.ProxyID,
+
+		registry: prometheus.NewRegistry(),
+
+		errorValues: make(map[string]map[string]bool),
+	}
+	if renamed, ok := labelRename[labels.ProxyID]; ok {
+		m.proxyIDLabel = renamed
+	}
+	return m
+}
+
+// register registers all metrics in m.registry, along with the Go runtime and process
+// metrics served from the default registry. Errors such as prometheus.AlreadyRegisteredError
+// are returned wrapped.
+func (m *Metrics) register() error {
+	return m.registerAll(append([]prometheus.Collector{
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.LatencyRegression,
+		m.ConfigHashInfo,
+		m.RequestsSkipped,
+		m.CheckPanics,
+		m.ProxyInitErrors,
+		m.ConfigReloadErrors,
+		m.ConfiguredProxies,
+		m.LabelKeyCount,
+		m.StartTime,
+		m.BuildInfo,
+		m.TargetLatency,
+		m.TargetLatencyDelta,
+		m.RouteUp,
+		m.RouteHopUp,
+		m.KafkaDeliveryErrors,
+		m.KafkaDropped,
+	}, m.checkCollectors()...))
+}
+
+// checkCollectors returns the metrics recorded by a single check of a proxy
+func (m *Metrics) checkCollectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.RequestsTotal,
+		m.RequestDuration,
+		m.ResponseSize,
+		m.ProxyState,
+		m.LastSuccess,
+		m.InFlight,
+		m.LatencyAnomalies,
+		m.ConnWait,
+		m.Redirects,
+		m.ConnectionReuse,
+		m.DNSDuration,
+		m.ConnectDuration,
+		m.TLSHandshakeDuration,
+		m.TimeToFirstByte,
+		m.CertExpiry,
+		m.RequestsByUserAgent,
+	}
+}
+
+// registerAll registers cs in m.registry, failing on the first that can't be registered
+func (m *Metrics) registerAll(cs []prometheus.Collector) error {
+	for _, c := range cs {
+		if err := m.registry.Register(c); err != nil {
+			return fmt.Errorf("registering metrics: %w", err)
+		}
+	}
+	return nil
+}
+
+// Handler returns an HTTP handler serving the metrics in the Prometheus exposition format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
 
-	prometheus.MustRegister(requestsTotal)
-	prometheus.MustRegister(requestDuration)
+// Gatherer returns the registry of the metrics, e.g. to serve them along with others
+func (m *Metrics) Gatherer() prometheus.Gatherer {
+	return m.registry
+}
 
-	return &Metrics{
-		RequestsTotal:   requestsTotal,
-		RequestDuration: requestDuration,
-		LabelKeys:       labelKeys,
+func newCounterVec(def Definition) *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{Name: def.Name, Help: def.Help}, def.Labels)
+}
+
+func newCounter(def Definition) prometheus.Counter {
+	return prometheus.NewCounter(prometheus.CounterOpts{Name: def.Name, Help: def.Help})
+}
+
+func newGaugeVec(def Definition) *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: def.Name, Help: def.Help}, def.Labels)
+}
+
+func newGauge(def Definition) prometheus.Gauge {
+	return prometheus.NewGauge(prometheus.GaugeOpts{Name: def.Name, Help: def.Help})
+}
+
+func newHistogramVec(def Definition) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: def.Name, Help: def.Help, Buckets: def.Buckets}, def.Labels)
+}
+
+// ProxyLabelValues returns the per-proxy label values: proxy_id, proxy_protocol, ...LabelKeys...
+// Label keys the proxy doesn't define get an empty value.
+func (m *Metrics) ProxyLabelValues(proxyID, protocol string, labels map[string]string) []string {
+	values := []string{proxyID, protocol}
+	for _, key := range m.LabelKeys {
+		values = append(values, labels[key])
 	}
+	return values
+}
+
+// DeleteProxy removes all series of proxyID, e.g. after it was removed from the config
+func (m *Metrics) DeleteProxy(proxyID string) {
+	match := prometheus.Labels{m.proxyIDLabel: proxyID}
+	m.RequestsTotal.DeletePartialMatch(match)
+	m.RequestDuration.DeletePartialMatch(match)
+	m.ResponseSize.DeletePartialMatch(match)
+	m.ProxyState.DeletePartialMatch(match)
+	m.LastSuccess.DeletePartialMatch(match)
+	m.InFlight.DeletePartialMatch(match)
+	m.LatencyRegression.DeletePartialMatch(match)
+	m.LatencyAnomalies.DeletePartialMatch(match)
+	m.RequestsSkipped.DeletePartialMatch(match)
+	m.CheckPanics.DeletePartialMatch(match)
+	m.ProxyInitErrors.DeletePartialMatch(match)
+	m.ConnWait.DeletePartialMatch(match)
+	m.Redirects.DeletePartialMatch(match)
+	m.ConnectionReuse.DeletePartialMatch(match)
+	m.DNSDuration.DeletePartialMatch(match)
+	m.ConnectDuration.DeletePartialMatch(match)
+	m.TLSHandshakeDuration.DeletePartialMatch(match)
+	m.TimeToFirstByte.DeletePartialMatch(match)
+	m.CertExpiry.DeletePartialMatch(match)
+	m.RequestsByUserAgent.DeletePartialMatch(match)
+	m.TargetLatency.DeletePartialMatch(match)
+	m.TargetLatencyDelta.DeletePartialMatch(match)
+
+	m.errorValuesMu.Lock()
+	delete(m.errorValues, proxyID)
+	m.errorValuesMu.Unlock()
+}
+
+// OtherError is the error label value recorded instead of new error values of a proxy
+// that already has max_error_cardinality distinct ones
+const OtherError = "other"
+
+// SetMaxErrorCardinality limits the distinct error label values recorded per proxy to n,
+// 0 for unlimited
+func (m *Metrics) SetMaxErrorCardinality(n int) {
+	m.errorValuesMu.Lock()
+	defer m.errorValuesMu.Unlock()
+	m.maxErrorValues = n
+}
+
+// ErrorLabel returns the error label value to record for errorType of proxyID: errorType
+// itself if it was recorded before or the proxy has fewer than max_error_cardinality distinct
+// values, OtherError otherwise. An empty errorType (success) is not counted.
+func (m *Metrics) ErrorLabel(proxyID, errorType string) string {
+	if errorType == "" {
+		return ""
+	}
+	m.errorValuesMu.Lock()
+	defer m.errorValuesMu.Unlock()
+	if m.maxErrorValues <= 0 {
+		return errorType
+	}
+	seen := m.errorValues[proxyID]
+	if seen[errorType] {
+		return errorType
+	}
+	if len(seen) >= m.maxErrorValues {
+		return OtherError
+	}
+	if seen == nil {
+		seen = make(map[string]bool)
+		m.errorValues[proxyID] = seen
+	}
+	seen[errorType] = true
+	return errorType
+}
+
+// SetConfigHash exposes hash as the only config_hash_info series, replacing any previous one
+func (m *Metrics) SetConfigHash(hash string) {
+	m.ConfigHashInfo.Reset()
+	m.ConfigHashInfo.WithLabelValues(hash).Set(1)
+}
+
+// buildVersion returns the module version and Go version of the running binary
+func buildVersion() (version, goVersion string) {
+	version = "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		version = info.Main.Version
+	}
+	return version, runtime.Version()
+}
+
+// SetConfigured updates the exporter scale gauges from the configured proxies. The label key
+// count is that of LabelKeys, which a reload doesn't change.
+func (m *Metrics) SetConfigured(proxies []config.Proxy) {
+	m.ConfiguredProxies.Set(float64(len(proxies)))
+	m.LabelKeyCount.Set(float64(len(m.LabelKeys)))
 }
 
 // collectLabelKeys collects all unique label keys from all proxies
 func collectLabelKeys(proxies []config.Proxy) []string {
 	keySet := make(map[string]bool)
 	for _, p := range proxies {
-		for key := range p.Labels {
+		for key := range p.MetricLabels() {
 			keySet[key] = true
 		}
 	}
@@ -74,4 +622,3 @@ func collectLabelKeys(proxies []config.Proxy) []string {
 
 	return keys
 }
-
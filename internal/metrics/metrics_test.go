@@ -1,17 +1,21 @@
 package metrics
 
 import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 
 	"eugene-chernyshenko/proxy-synthetic-check/internal/config"
 )
 
 func TestCollectLabelKeys_Logic(t *testing.T) {
-	// Test the label collection logic by creating a single metrics instance
-	// Note: We can't test New() multiple times due to Prometheus global registry,
-	// so we test the label collection through one comprehensive test
-
 	proxies := []config.Proxy{
 		{
 			Protocol: "socks5",
@@ -50,7 +54,10 @@ func TestCollectLabelKeys_Logic(t *testing.T) {
 	}
 
 	buckets := []float64{0.1, 0.5, 1.0}
-	m := New(proxies, buckets)
+	m, err := New(proxies, buckets, nil, nil)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
 
 	// Check that label keys are collected, deduplicated, and sorted alphabetically
 	// Empty/nil labels should not affect the result
@@ -68,6 +75,217 @@ func TestCollectLabelKeys_Logic(t *testing.T) {
 	}
 }
 
-// Note: We can't test New() multiple times in the same test run due to Prometheus
-// global registry. The empty labels case is tested indirectly in TestCollectLabelKeys_Logic
-// by ensuring that nil/empty labels don't cause issues when mixed with non-empty labels.
+// newTestMetrics returns metrics for no configured proxies with small buckets
+func newTestMetrics(t *testing.T) *Metrics {
+	t.Helper()
+	m, err := New(nil, []float64{0.1, 0.5, 1.0}, []float64{10, 100, 1000}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestNew_StartTimeAndBuildInfo(t *testing.T) {
+	before := time.Now()
+	m := newTestMetrics(t)
+	after := time.Now()
+
+	// Start time is the boot timestamp in (fractional) unix seconds
+	if got := testutil.ToFloat64(m.StartTime); got < float64(before.Unix()) || got > float64(after.Unix()+1) {
+		t.Errorf("exporter_start_time_seconds = %v, want between %d and %d", got, before.Unix(), after.Unix()+1)
+	}
+	if n := testutil.CollectAndCount(m.BuildInfo); n != 1 {
+		t.Errorf("exporter_build_info series = %d, want 1", n)
+	}
+}
+
+func TestSetConfigured(t *testing.T) {
+	proxies := []config.Proxy{
+		{Protocol: "socks5", Proxy: "proxy1.example.com:1080", Labels: map[string]string{"name": "wifi", "region": "us"}},
+		{Protocol: "http", Proxy: "proxy2.example.com:8080", Labels: map[string]string{"provider": "provider-a"}},
+		{Protocol: "socks5", Proxy: "proxy3.example.com:1080", Labels: map[string]string{"name": "another"}},
+	}
+	m, err := New(proxies, []float64{0.1, 1}, nil, nil)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	// Exporter scale gauges reflect the config, and are updated on reload
+	if got := testutil.ToFloat64(m.ConfiguredProxies); got != 3 {
+		t.Errorf("exporter_configured_proxies = %v, want 3", got)
+	}
+	if got := testutil.ToFloat64(m.LabelKeyCount); got != 3 {
+		t.Errorf("exporter_label_keys = %v, want 3", got)
+	}
+	m.SetConfigured(proxies[2:])
+	if got := testutil.ToFloat64(m.ConfiguredProxies); got != 1 {
+		t.Errorf("exporter_configured_proxies after reload = %v, want 1", got)
+	}
+	// Label keys are fixed at startup
+	if got := testutil.ToFloat64(m.LabelKeyCount); got != 3 {
+		t.Errorf("exporter_label_keys after reload = %v, want the 3 exported ones", got)
+	}
+}
+
+func TestSetConfigHash(t *testing.T) {
+	m := newTestMetrics(t)
+
+	// config_hash_info keeps a single series across updates
+	m.SetConfigHash("aaaaaaaaaaaa")
+	m.SetConfigHash("bbbbbbbbbbbb")
+	if n := testutil.CollectAndCount(m.ConfigHashInfo); n != 1 {
+		t.Errorf("config_hash_info series = %d, want 1", n)
+	}
+	if v := testutil.ToFloat64(m.ConfigHashInfo.WithLabelValues("bbbbbbbbbbbb")); v != 1 {
+		t.Errorf("config_hash_info{hash=\"bbbbbbbbbbbb\"} = %v, want 1", v)
+	}
+}
+
+func TestNew_LabelRename(t *testing.T) {
+	proxies := []config.Proxy{{Protocol: "socks5", Proxy: "proxy1.example.com:1080", Labels: map[string]string{"name": "wifi"}}}
+	m, err := New(proxies, []float64{0.1, 1}, nil, map[string]string{"proxy_id": "proxy", "proxy_protocol": "protocol"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	// label_rename applies to the exposed label names; label values stay positional
+	m.RequestsTotal.WithLabelValues(append(m.ProxyLabelValues("proxy_1", "socks5", proxies[0].Labels), "success", "", "2xx")...).Inc()
+	families, err := m.registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather() error = %v", err)
+	}
+	var labels []string
+	for _, family := range families {
+		if family.GetName() == "requests_total" {
+			for _, pair := range family.GetMetric()[0].GetLabel() {
+				labels = append(labels, pair.GetName())
+			}
+		}
+	}
+	if want := []string{"error", "name", "protocol", "proxy", "status", "status_class"}; !reflect.DeepEqual(labels, want) {
+		t.Errorf("requests_total labels = %v, want %v", labels, want)
+	}
+}
+
+func TestDeleteProxy(t *testing.T) {
+	m := newTestMetrics(t)
+	m.RequestsTotal.WithLabelValues(append(m.ProxyLabelValues("proxy_1", "socks5", nil), "success", "", "2xx")...).Inc()
+	m.RequestsTotal.WithLabelValues(append(m.ProxyLabelValues("proxy_2", "socks5", nil), "success", "", "2xx")...).Inc()
+
+	m.DeleteProxy("proxy_1")
+	if n := testutil.CollectAndCount(m.RequestsTotal); n != 1 {
+		t.Errorf("requests_total series after DeleteProxy = %d, want only those of proxy_2", n)
+	}
+}
+
+func TestNew_IndependentRegistries(t *testing.T) {
+	a, err := New(nil, []float64{0.1, 1}, []float64{100}, nil)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	b, err := New([]config.Proxy{{Protocol: "http", Labels: map[string]string{"region": "eu"}}}, []float64{0.1, 1}, []float64{100}, nil)
+	if err != nil {
+		t.Fatalf("second New() error = %v", err)
+	}
+
+	a.RequestsTotal.WithLabelValues("proxy_1", "http", "success", "", "2xx").Inc()
+	if n := testutil.CollectAndCount(b.RequestsTotal); n != 0 {
+		t.Errorf("requests_total series of the second Metrics = %d, want 0", n)
+	}
+
+	rec := httptest.NewRecorder()
+	b.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	if !strings.Contains(body, `exporter_label_keys 1`) || !strings.Contains(body, "go_goroutines") {
+		t.Errorf("Handler() of the second Metrics served:\n%s\nwant its own exporter_label_keys and Go runtime metrics", body)
+	}
+	if strings.Contains(body, `requests_total{`) {
+		t.Error("Handler() of the second Metrics served requests_total of the first")
+	}
+}
+
+func TestRegister_AlreadyRegistered(t *testing.T) {
+	m, err := New(nil, []float64{0.1, 1}, []float64{100}, nil)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	err = m.register()
+	var already prometheus.AlreadyRegisteredError
+	if !errors.As(err, &already) {
+		t.Errorf("second register() error = %v, want prometheus.AlreadyRegisteredError", err)
+	}
+}
+
+func TestCollectLabelKeys_Canary(t *testing.T) {
+	proxies := []config.Proxy{
+		{Protocol: "socks5", Labels: map[string]string{"name": "wifi"}},
+		{Protocol: "socks5", Labels: map[string]string{"name": "new"}, Canary: true},
+	}
+
+	expectedKeys := []string{"canary", "name"}
+	if got := collectLabelKeys(proxies); !reflect.DeepEqual(got, expectedKeys) {
+		t.Errorf("collectLabelKeys() = %v, want %v", got, expectedKeys)
+	}
+}
+
+func TestDefinitions(t *testing.T) {
+	proxies := []config.Proxy{
+		{Protocol: "socks5", Labels: map[string]string{"region": "us", "name": "wifi"}},
+		{Protocol: "http", Canary: true},
+	}
+	buckets := []float64{0.2, 1.0}
+	sizeBuckets := []float64{512, 4096}
+
+	defs := make(map[string]Definition)
+	for _, def := range Definitions(proxies, buckets, sizeBuckets, nil) {
+		defs[def.Name] = def
+	}
+
+	proxyLabels := []string{"proxy_id", "proxy_protocol", "canary", "name", "region"}
+	if got := defs["requests_total"].Labels; !reflect.DeepEqual(got, append(proxyLabels, "status", "error", "status_class")) {
+		t.Errorf("requests_total labels = %v", got)
+	}
+	if got := defs["proxy_state"].Labels; !reflect.DeepEqual(got, proxyLabels) {
+		t.Errorf("proxy_state labels = %v, want %v", got, proxyLabels)
+	}
+
+	duration := defs["request_duration_seconds"]
+	if duration.Type != "histogram" || !reflect.DeepEqual(duration.Buckets, buckets) {
+		t.Errorf("request_duration_seconds = %+v, want histogram with buckets %v", duration, buckets)
+	}
+	if got := duration.Labels; !reflect.DeepEqual(got, append(proxyLabels, "status_class")) {
+		t.Errorf("request_duration_seconds labels = %v", got)
+	}
+	if size := defs["response_size_bytes"]; !reflect.DeepEqual(size.Buckets, sizeBuckets) || !reflect.DeepEqual(size.Labels, proxyLabels) {
+		t.Errorf("response_size_bytes = %+v, want buckets %v and labels %v", size, sizeBuckets, proxyLabels)
+	}
+	if got := defs["tls_cert_expiry_timestamp_seconds"].Labels; !reflect.DeepEqual(got, append(proxyLabels, "target")) {
+		t.Errorf("tls_cert_expiry_timestamp_seconds labels = %v", got)
+	}
+	if got := defs["connection_reuse_total"].Labels; !reflect.DeepEqual(got, append(proxyLabels, "conn_reused")) {
+		t.Errorf("connection_reuse_total labels = %v", got)
+	}
+	if got := defs["config_hash_info"].Labels; !reflect.DeepEqual(got, []string{"hash"}) {
+		t.Errorf("config_hash_info labels = %v, want [hash]", got)
+	}
+}
+
+// TestDefinitions_LabelRenameClash checks that labels.All, which config validation checks
+// label_rename against, has every metric label, so a rename to any of them is rejected before New registers a metric with a label twice
+func TestDefinitions_LabelRenameClash(t *testing.T) {
+	proxies := []config.Proxy{{Protocol: "socks5", Labels: map[string]string{"region": "us"}}}
+
+	for _, def := range Definitions(proxies, nil, nil, nil) {
+		for _, label := range def.Labels {
+			if label == "proxy_id" {
+				continue
+			}
+			cfg := config.ProxyConfig{Proxies: proxies, LabelRename: map[string]string{"proxy_id": label}}
+			err := cfg.Validate()
+			if err == nil || !strings.Contains(err.Error(), "which is already a metric label") {
+				t.Errorf("renaming proxy_id to %s (metric %s): Validate() error = %v, want a clash", label, def.Name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,20 @@
+// Package metricstest provides metrics for tests of the packages recording checks. It is
+// imported by tests only, so the testing package stays out of the binary.
+package metricstest
+
+import (
+	"testing"
+
+	"eugene-chernyshenko/proxy-synthetic-check/internal/metrics"
+)
+
+// New returns metrics for no configured proxies with a registry of their own and small
+// buckets. It fails tb when they can't be created.
+func New(tb testing.TB) *metrics.Metrics {
+	tb.Helper()
+	m, err := metrics.New(nil, []float64{0.1, 0.5, 1.0}, []float64{10, 100, 1000}, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return m
+}
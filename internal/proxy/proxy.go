@@ -2,29 +2,173 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"regexp"
+	"slices"
 	"strings"
+	"time"
 
 	"golang.org/x/net/proxy"
 )
 
-// CreateTransport creates HTTP transport based on proxy protocol
-func CreateTransport(protocol, proxyString string) (*http.Transport, error) {
-	// Construct full URL from protocol + proxyString (proxyString contains username:password@host:port or host:port)
-	proxyURL := protocol + "://" + proxyString
-	proxyURI, err := url.Parse(proxyURL)
+// Options holds optional transport settings
+type Options struct {
+	// StrictSOCKS5Auth fails SOCKS5 connections when the server negotiates a different
+	// authentication method than configured (e.g. "no auth" although credentials were given)
+	StrictSOCKS5Auth bool
+
+	// ConnectIP pins the target to this IP while TLS SNI and the Host header keep the
+	// target URL hostname. SOCKS proxies dial it through the proxy; for HTTP proxies the request
+	// URL is rewritten by the caller (see request.Make) and TLSServerName must be set.
+	ConnectIP string
+
+	// TLSServerName overrides the TLS server name (used with ConnectIP for HTTP proxies)
+	TLSServerName string
+
+	// TLSALPN sets the ALPN protocols offered to the target (e.g. h2, http/1.1).
+	// Offering h2 enables HTTP/2 on the transport, which also offers http/1.1.
+	TLSALPN []string
+
+	// RootCAs verifies the target's certificate against this pool instead of the system roots
+	// (see LoadCertPool)
+	RootCAs *x509.CertPool
+
+	// InsecureSkipVerify accepts any certificate from the target, e.g. a self-signed one
+	InsecureSkipVerify bool
+
+	// Chain lists further proxies the connection is routed through after the first one,
+	// in order; the last hop connects to the target
+	Chain []Hop
+
+	// MaxConns limits the connections open to the target at once; further requests wait
+	// for a connection to become available. Zero is unlimited.
+	MaxConns int
+
+	// MaxIdleConns and MaxIdleConnsPerHost limit the idle keep-alive connections kept open;
+	// zero leaves the net/http defaults (100 in total, 2 per host)
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+
+	// IdleConnTimeout closes idle connections after this long. Zero keeps them open
+	// indefinitely, as net/http does.
+	IdleConnTimeout time.Duration
+
+	// DisableKeepAlives opens a new connection through the proxy for every request
+	DisableKeepAlives bool
+
+	// DialTimeout bounds connecting to the (first) proxy, so an unreachable proxy fails
+	// before the request timeout. Zero leaves it to the request timeout.
+	DialTimeout time.Duration
+}
+
+// Hop is one proxy of a chain
+type Hop struct {
+	Protocol string // socks5, socks5h, socks4, socks4a or http
+	Proxy    string // username:password@host:port or host:port (no scheme)
+}
+
+// ErrInvalid is matched by errors.Is for CreateTransport and CreateDialer errors caused by
+// the proxy configuration itself (an unparsable address, an unsupported protocol, ...), which
+// retrying can't fix
+var ErrInvalid = errors.New("invalid proxy configuration")
+
+// invalidError is an error of the proxy configuration, matching ErrInvalid
+type invalidError struct {
+	err error
+}
+
+func (e invalidError) Error() string   { return e.err.Error() }
+func (e invalidError) Unwrap() []error { return []error{e.err, ErrInvalid} }
+
+// CreateTransport creates HTTP transport based on proxy protocol (socks5, socks5h, socks4, socks4a or http)
+func CreateTransport(protocol, proxyString string, opts Options) (*http.Transport, error) {
+	proxyURI, err := ParseURL(protocol, proxyString)
+	if err != nil {
+		return nil, invalidError{err}
+	}
+
+	if strings.ToLower(protocol) == "http" && len(opts.Chain) == 0 {
+		// HTTP proxy using http.ProxyURL
+		transport := &http.Transport{
+			Proxy: http.ProxyURL(proxyURI),
+		}
+		if opts.DialTimeout > 0 {
+			transport.DialContext = (&net.Dialer{Timeout: opts.DialTimeout}).DialContext
+		}
+		applyPoolOptions(transport, opts)
+		applyTLSOptions(transport, opts)
+		return transport, nil
+	}
+
+	dialer, err := CreateDialer(protocol, proxyString, opts)
+	if err != nil {
+		return nil, err
+	}
+	return dialerTransport(dialer, opts), nil
+}
+
+// CreateDialer creates a dialer opening TCP connections to targets through the proxy and its
+// chain. HTTP proxies are tunneled with CONNECT. With opts.ConnectIP every connection goes to
+// that IP at the requested port.
+func CreateDialer(protocol, proxyString string, opts Options) (proxy.ContextDialer, error) {
+	// Every hop dials the next one through the previous hop; the last hop dials the target
+	var dialer proxy.ContextDialer = proxy.Direct
+	if opts.DialTimeout > 0 {
+		dialer = &net.Dialer{Timeout: opts.DialTimeout}
+	}
+	hops := append([]Hop{{Protocol: protocol, Proxy: proxyString}}, opts.Chain...)
+	for i, hop := range hops {
+		var err error
+		dialer, err = hopDialer(hop.Protocol, hop.Proxy, dialer, opts)
+		if err != nil {
+			if len(opts.Chain) > 0 {
+				return nil, fmt.Errorf("proxy chain hop %d: %w", i+1, err)
+			}
+			return nil, err
+		}
+	}
+
+	if opts.ConnectIP != "" {
+		dialer = connectIPDialer{dialer: dialer, ip: opts.ConnectIP}
+	}
+	return dialer, nil
+}
+
+// connectIPDialer dials ip instead of the requested host, keeping the port
+type connectIPDialer struct {
+	dialer proxy.ContextDialer
+	ip     string
+}
+
+func (d connectIPDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	_, port, err := net.SplitHostPort(addr)
 	if err != nil {
 		return nil, err
 	}
+	return d.dialer.DialContext(ctx, network, net.JoinHostPort(d.ip, port))
+}
+
+// hopDialer creates a dialer connecting through one proxy, reaching the proxy itself via forward
+func hopDialer(protocol, proxyString string, forward proxy.ContextDialer, opts Options) (proxy.ContextDialer, error) {
+	proxyURI, err := ParseURL(protocol, proxyString)
+	if err != nil {
+		return nil, invalidError{err}
+	}
+	proxyAddr := proxyURI.Host
 
 	switch strings.ToLower(protocol) {
-	case "socks5":
-		proxyAddr := proxyURI.Host
+	case "socks5", "socks5h":
+		// x/net's SOCKS5 dialer never resolves the target locally; hostnames are always
+		// sent to the proxy, so socks5h (remote DNS) needs no special handling
 		if proxyAddr == "" {
-			return nil, errors.New("proxy address (host:port) is not specified")
+			return nil, invalidError{errors.New("proxy address (host:port) is not specified")}
 		}
 
 		var auth *proxy.Auth
@@ -36,39 +180,156 @@ func CreateTransport(protocol, proxyString string) (*http.Transport, error) {
 			}
 		}
 
-		dialer, err := proxy.SOCKS5("tcp", proxyAddr, auth, proxy.Direct)
+		socksDialer, err := proxy.SOCKS5("tcp", proxyAddr, auth, authMethodDialer{forward: forward})
 		if err != nil {
 			return nil, err
 		}
 
-		return &http.Transport{
-			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-				return dialer.Dial(network, addr)
-			},
+		dialer := socksDialer.(proxy.ContextDialer)
+		if opts.StrictSOCKS5Auth {
+			dialer = strictAuthDialer{socks: dialer, hasAuth: auth != nil}
+		}
+		return dialer, nil
+
+	case "socks4", "socks4a":
+		if proxyAddr == "" {
+			return nil, invalidError{errors.New("proxy address (host:port) is not specified")}
+		}
+
+		// SOCKS4 has no password; the username is sent as the user ID
+		return socks4Dialer{
+			proxyAddr: proxyAddr,
+			userID:    proxyURI.User.Username(),
+			remoteDNS: strings.ToLower(protocol) == "socks4a",
+			forward:   forward,
 		}, nil
 
 	case "http":
-		// HTTP proxy using http.ProxyURL
-		return &http.Transport{
-			Proxy: http.ProxyURL(proxyURI),
-		}, nil
+		// Tunnel with CONNECT; http.ProxyURL can't be layered on another dialer
+		if proxyAddr == "" {
+			return nil, invalidError{errors.New("proxy address (host:port) is not specified")}
+		}
+		return httpConnectDialer{proxyAddr: proxyAddr, user: proxyURI.User, forward: forward}, nil
 
 	default:
-		return nil, errors.New("unsupported proxy protocol: " + protocol)
+		return nil, invalidError{errors.New("unsupported proxy protocol: " + protocol)}
+	}
+}
+
+// dialerTransport creates a transport connecting to targets through dialer
+func dialerTransport(dialer proxy.ContextDialer, opts Options) *http.Transport {
+	transport := &http.Transport{
+		DialContext: dialer.DialContext,
+	}
+	applyPoolOptions(transport, opts)
+	applyTLSOptions(transport, opts)
+	return transport
+}
+
+// applyPoolOptions configures the connection pool of transport from opts
+func applyPoolOptions(transport *http.Transport, opts Options) {
+	transport.MaxConnsPerHost = opts.MaxConns
+	transport.MaxIdleConns = opts.MaxIdleConns
+	transport.MaxIdleConnsPerHost = opts.MaxIdleConnsPerHost
+	transport.IdleConnTimeout = opts.IdleConnTimeout
+	transport.DisableKeepAlives = opts.DisableKeepAlives
+}
+
+// applyTLSOptions configures the TLS client settings from opts, leaving the defaults when none are set
+func applyTLSOptions(transport *http.Transport, opts Options) {
+	if opts.TLSServerName == "" && len(opts.TLSALPN) == 0 && opts.RootCAs == nil && !opts.InsecureSkipVerify {
+		return
+	}
+	transport.TLSClientConfig = &tls.Config{
+		ServerName:         opts.TLSServerName,
+		NextProtos:         opts.TLSALPN,
+		RootCAs:            opts.RootCAs,
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+	}
+	// A custom TLS config or dialer disables HTTP/2 unless it is forced
+	transport.ForceAttemptHTTP2 = slices.Contains(opts.TLSALPN, "h2")
+}
+
+// LoadCertPool reads a PEM file of CA certificates into a pool for Options.RootCAs
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no PEM certificates found", path)
+	}
+	return pool, nil
+}
+
+// ParseURL returns the URL of a proxy from its protocol and address (username:password@host:port
+// or host:port). A scheme in proxyString is accepted when it matches protocol and an error otherwise,
+// instead of producing e.g. socks5://http://host:1080. Errors never contain the credentials.
+func ParseURL(protocol, proxyString string) (*url.URL, error) {
+	if scheme, rest, ok := cutScheme(proxyString); ok {
+		if !strings.EqualFold(scheme, protocol) {
+			return nil, fmt.Errorf("proxy address has scheme %s, but protocol is %s; omit the scheme", scheme, protocol)
+		}
+		proxyString = rest
+	}
+
+	// url.Parse would end the credentials at a "/" in the password, so they are split off at
+	// the last "@" and only the host is parsed
+	host, userinfo, hasUserinfo := proxyString, "", false
+	if i := strings.LastIndex(proxyString, "@"); i >= 0 {
+		host, userinfo, hasUserinfo = proxyString[i+1:], proxyString[:i], true
+	}
+	u, err := url.Parse(protocol + "://" + host)
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		// url.Error quotes the whole URL
+		return nil, fmt.Errorf("invalid proxy address: %w", urlErr.Err)
+	}
+	if err != nil {
+		return nil, err
 	}
+	if hasUserinfo {
+		username, password, hasPassword := strings.Cut(userinfo, ":")
+		if hasPassword {
+			u.User = url.UserPassword(unescapeUserinfo(username), unescapeUserinfo(password))
+		} else {
+			u.User = url.User(unescapeUserinfo(username))
+		}
+	}
+	return u, nil
+}
+
+// unescapeUserinfo decodes a percent-encoded username or password, returning any other as is
+func unescapeUserinfo(s string) string {
+	if unescaped, err := url.PathUnescape(s); err == nil {
+		return unescaped
+	}
+	return s
+}
+
+// cutScheme splits a proxy address at "://" when it starts with a URL scheme, unlike e.g.
+// user:pa://ss@host:1080, whose password merely contains "://"
+func cutScheme(proxyString string) (scheme, rest string, ok bool) {
+	scheme, rest, ok = strings.Cut(proxyString, "://")
+	if !ok || !schemePattern.MatchString(scheme) {
+		return "", proxyString, false
+	}
+	return scheme, rest, true
 }
 
+// schemePattern matches URL schemes (RFC 3986)
+var schemePattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*$`)
+
 // MaskAuth hides password in URL for safe output
 func MaskAuth(protocol, proxyString string) string {
-	// Construct full URL for parsing
-	fullURL := protocol + "://" + proxyString
-	u, err := url.Parse(fullURL)
+	// Any scheme is dropped for display, even one conflicting with protocol
+	if _, rest, ok := cutScheme(proxyString); ok {
+		proxyString = rest
+	}
+	u, err := ParseURL(protocol, proxyString)
 	if err != nil {
 		return proxyString
 	}
-	if u.User != nil {
-		u.User = url.User(u.User.Username())
-	}
 	return u.Host // Return just host:port without scheme for display
 }
-
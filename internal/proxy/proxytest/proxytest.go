@@ -0,0 +1,41 @@
+// Package proxytest provides stub proxies for tests checking through a proxy. It is imported
+// by tests only, so the testing package stays out of the binary.
+package proxytest
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// NewConnectProxy starts an HTTP proxy tunneling CONNECT requests to their destination,
+// closed when tb's test ends
+func NewConnectProxy(tb testing.TB) *httptest.Server {
+	tb.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer upstream.Close()
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+			return
+		}
+		go io.Copy(upstream, conn)
+		io.Copy(conn, upstream)
+	}))
+	tb.Cleanup(server.Close)
+	return server
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// socks4Dialer connects through a SOCKS4 proxy. With remoteDNS (SOCKS4a) the target
+// hostname is sent to the proxy for resolution; otherwise it is resolved locally,
+// since plain SOCKS4 only carries IPv4 addresses.
+type socks4Dialer struct {
+	proxyAddr string
+	userID    string
+	remoteDNS bool
+	forward   proxy.ContextDialer
+}
+
+// socks4 request and reply codes
+const (
+	socks4Version   = 0x04
+	socks4Connect   = 0x01
+	socks4Granted   = 0x5a
+	socks4ReplySize = 8
+)
+
+// Dial implements proxy.Dialer
+func (d socks4Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext implements proxy.ContextDialer
+func (d socks4Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" {
+		return nil, errors.New("socks4: unsupported network " + network)
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("socks4: invalid port %q", portStr)
+	}
+
+	// Request: version, command, port, IPv4 address, user ID, NUL [, hostname, NUL]
+	req := []byte{socks4Version, socks4Connect}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	ip := net.ParseIP(host).To4()
+	switch {
+	case ip != nil:
+		req = append(req, ip...)
+		req = append(req, d.userID...)
+		req = append(req, 0)
+	case d.remoteDNS:
+		// SOCKS4a: the invalid address 0.0.0.x tells the proxy a hostname follows
+		req = append(req, 0, 0, 0, 1)
+		req = append(req, d.userID...)
+		req = append(req, 0)
+		req = append(req, host...)
+		req = append(req, 0)
+	default:
+		ip, err = d.lookupIPv4(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		req = append(req, ip...)
+		req = append(req, d.userID...)
+		req = append(req, 0)
+	}
+
+	conn, err := d.forward.DialContext(ctx, "tcp", d.proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	if _, err := conn.Write(req); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("socks4: writing request: %w", err)
+	}
+	reply := make([]byte, socks4ReplySize)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("socks4: reading reply: %w", err)
+	}
+	if reply[1] != socks4Granted {
+		conn.Close()
+		return nil, fmt.Errorf("socks4: request rejected by proxy (code 0x%02x)", reply[1])
+	}
+	return conn, nil
+}
+
+// lookupIPv4 resolves host to its first IPv4 address
+func (d socks4Dialer) lookupIPv4(ctx context.Context, host string) (net.IP, error) {
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("socks4: no IPv4 address for " + host)
+	}
+	return ips[0].To4(), nil
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// socks4Request is a CONNECT request received by socks4Stub
+type socks4Request struct {
+	userID   string
+	hostname string // SOCKS4a hostname, empty for plain SOCKS4
+	addr     string // host:port the stub connected to
+}
+
+// socks4Stub is a minimal SOCKS4/SOCKS4a server for tests. It grants every CONNECT
+// request and forwards it to its destination.
+type socks4Stub struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	requests []socks4Request
+}
+
+func newSOCKS4Stub(t *testing.T) *socks4Stub {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	s := &socks4Stub{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+	go s.serve()
+	return s
+}
+
+// Addr returns host:port of the stub
+func (s *socks4Stub) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Requests returns the CONNECT requests received so far
+func (s *socks4Stub) Requests() []socks4Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]socks4Request(nil), s.requests...)
+}
+
+func (s *socks4Stub) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *socks4Stub) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// Request: version, command, port, IPv4 address, user ID, NUL [, hostname, NUL]
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return
+	}
+	userID, err := reader.ReadString(0)
+	if err != nil {
+		return
+	}
+	request := socks4Request{userID: userID[:len(userID)-1]}
+
+	host := net.IP(header[4:8]).String()
+	if header[4] == 0 && header[5] == 0 && header[6] == 0 && header[7] != 0 {
+		hostname, err := reader.ReadString(0)
+		if err != nil {
+			return
+		}
+		request.hostname = hostname[:len(hostname)-1]
+		host = request.hostname
+	}
+	request.addr = net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(header[2:4]))))
+
+	s.mu.Lock()
+	s.requests = append(s.requests, request)
+	s.mu.Unlock()
+
+	target, err := net.Dial("tcp", request.addr)
+	if err != nil {
+		conn.Write([]byte{0x00, 0x5b, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+	if _, err := conn.Write([]byte{0x00, 0x5a, 0, 0, 0, 0, 0, 0}); err != nil {
+		return
+	}
+
+	go io.Copy(target, reader)
+	io.Copy(conn, target)
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"golang.org/x/net/proxy"
+)
+
+// SOCKS5 authentication method codes (RFC 1928)
+const (
+	socks5AuthNone             byte = 0x00
+	socks5AuthUsernamePassword byte = 0x02
+)
+
+// authMethodKey carries a *authMethod through the dial context
+type authMethodKey struct{}
+
+// authMethod records the method byte chosen by the SOCKS5 server during one dial
+type authMethod struct {
+	header []byte // first two bytes of the server greeting reply: version, method
+}
+
+// selected returns the negotiated method and whether the server reply was seen
+func (a *authMethod) selected() (byte, bool) {
+	if len(a.header) < 2 {
+		return 0, false
+	}
+	return a.header[1], true
+}
+
+// authMethodConn copies the first bytes read from the proxy into the dial's authMethod
+type authMethodConn struct {
+	net.Conn
+	method *authMethod
+}
+
+func (c *authMethodConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if need := 2 - len(c.method.header); need > 0 && n > 0 {
+		c.method.header = append(c.method.header, b[:min(n, need)]...)
+	}
+	return n, err
+}
+
+// authMethodDialer is used as the forward dialer of the SOCKS5 client so the
+// server's method selection can be inspected after the handshake
+type authMethodDialer struct {
+	forward proxy.ContextDialer
+}
+
+func (d authMethodDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d authMethodDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	method, _ := ctx.Value(authMethodKey{}).(*authMethod)
+
+	// The forward dialer may be an earlier SOCKS5 hop of a chain, which must not
+	// record its own handshake into this hop's method
+	conn, err := d.forward.DialContext(context.WithValue(ctx, authMethodKey{}, (*authMethod)(nil)), network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if method != nil {
+		return &authMethodConn{Conn: conn, method: method}, nil
+	}
+	return conn, nil
+}
+
+// strictAuthDialer fails SOCKS5 connections whose negotiated authentication method
+// doesn't match the configured one. golang.org/x/net/proxy offers both "no auth" and
+// username/password when credentials are set and silently accepts either.
+type strictAuthDialer struct {
+	socks   proxy.ContextDialer
+	hasAuth bool
+}
+
+func (d strictAuthDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	method := &authMethod{}
+	conn, err := d.socks.DialContext(context.WithValue(ctx, authMethodKey{}, method), network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	want := socks5AuthNone
+	if d.hasAuth {
+		want = socks5AuthUsernamePassword
+	}
+	if got, ok := method.selected(); !ok || got != want {
+		conn.Close()
+		return nil, fmt.Errorf("socks5 strict auth: server selected authentication method 0x%02x, expected 0x%02x", got, want)
+	}
+	return conn, nil
+}
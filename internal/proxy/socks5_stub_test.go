@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// socks5Request is a CONNECT request received by socks5Stub
+type socks5Request struct {
+	addrType byte   // 0x01 IPv4, 0x03 domain name, 0x04 IPv6
+	addr     string // host:port as sent by the client
+}
+
+// socks5Stub is a minimal SOCKS5 server for tests. It answers every greeting with
+// method, accepts any credentials and forwards CONNECT requests to their destination.
+type socks5Stub struct {
+	listener net.Listener
+	method   byte
+
+	mu       sync.Mutex
+	requests []socks5Request
+}
+
+func newSOCKS5Stub(t *testing.T, method byte) *socks5Stub {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	s := &socks5Stub{listener: listener, method: method}
+	t.Cleanup(func() { listener.Close() })
+	go s.serve()
+	return s
+}
+
+// Addr returns host:port of the stub
+func (s *socks5Stub) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Requests returns the CONNECT requests received so far
+func (s *socks5Stub) Requests() []socks5Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]socks5Request(nil), s.requests...)
+}
+
+func (s *socks5Stub) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *socks5Stub) handle(conn net.Conn) {
+	defer conn.Close()
+
+	// Greeting: version, number of methods, methods
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, make([]byte, header[1])); err != nil {
+		return
+	}
+	if _, err := conn.Write([]byte{0x05, s.method}); err != nil {
+		return
+	}
+
+	// Username/password subnegotiation (RFC 1929)
+	if s.method == 0x02 {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, make([]byte, header[1])); err != nil {
+			return
+		}
+		passLen := make([]byte, 1)
+		if _, err := io.ReadFull(conn, passLen); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, make([]byte, passLen[0])); err != nil {
+			return
+		}
+		if _, err := conn.Write([]byte{0x01, 0x00}); err != nil {
+			return
+		}
+	}
+
+	// Request: version, command, reserved, address type, address, port
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return
+	}
+	var host string
+	switch request[3] {
+	case 0x01, 0x04:
+		size := net.IPv4len
+		if request[3] == 0x04 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return
+		}
+		host = net.IP(ip).String()
+	case 0x03:
+		nameLen := make([]byte, 1)
+		if _, err := io.ReadFull(conn, nameLen); err != nil {
+			return
+		}
+		name := make([]byte, nameLen[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return
+		}
+		host = string(name)
+	default:
+		return
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+
+	s.mu.Lock()
+	s.requests = append(s.requests, socks5Request{addrType: request[3], addr: addr})
+	s.mu.Unlock()
+
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+	if _, err := conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0}); err != nil {
+		return
+	}
+
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
@@ -0,0 +1,102 @@
+package request
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/url"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/proxy"
+
+	"eugene-chernyshenko/proxy-synthetic-check/internal/config"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/metrics"
+)
+
+// Connect opens a TCP connection to the target host and port through dialer and closes it
+// right away, recording the connect latency like Make records a request. No HTTP is sent,
+// so the target may be any TCP service. Targets refused by policy (may be nil) are recorded
+// as target_not_allowed without dialing.
+func Connect(m *metrics.Metrics, dialer proxy.ContextDialer, targetURL, proxyID string, proxyConfig config.Proxy, policy *TargetPolicy, timeout time.Duration) (result CheckResult) {
+	// Only HTTP checks send target credentials; keep them out of logs and spans
+	targetURL = config.MaskURL(targetURL)
+
+	ctx, span := otel.Tracer(tracerName).Start(context.Background(), "connect",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("proxy_id", proxyID),
+			attribute.String("proxy_protocol", proxyConfig.Protocol),
+			attribute.String("target", targetURL),
+		),
+	)
+	defer span.End()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+
+	var policyErr error
+	host, port, err := TargetAddr(targetURL)
+	if err == nil {
+		policyErr = policy.Check(ctx, host, proxyConfig.ConnectIP)
+		err = policyErr
+	}
+	if err == nil {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+		if err == nil {
+			conn.Close()
+		}
+	}
+	elapsed := time.Since(start)
+
+	labelValues := m.ProxyLabelValues(proxyID, proxyConfig.Protocol, proxyConfig.MetricLabels())
+	limit := defaultMaxPlausibleLatency
+	if timeout > 0 {
+		limit = 2 * timeout
+	}
+	elapsed = sanitizeDuration(m, elapsed, limit, proxyID, labelValues)
+
+	record := func(status, errorType string, err error) {
+		result = CheckResult{Status: status, ErrorType: errorType, Duration: elapsed}
+		recordResult(m, span, proxyID, proxyConfig, result, err)
+	}
+
+	if policyErr != nil {
+		record("error", "target_not_allowed", policyErr)
+		log.Printf("[%s] Refusing connect to %s: %v", proxyID, targetURL, policyErr)
+		return
+	}
+	if err != nil {
+		errorType, _ := CategorizeError(err)
+		record("error", errorType, err)
+		log.Printf("[%s] Error connecting to %s: %v", proxyID, targetURL, err)
+		return
+	}
+
+	record("success", "", nil)
+	return
+}
+
+// TargetAddr returns the host and port of targetURL, defaulting the port by scheme (443 for
+// https and wss, else 80)
+func TargetAddr(targetURL string) (host, port string, err error) {
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return "", "", err
+	}
+	port = u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" || u.Scheme == "wss" {
+			port = "443"
+		}
+	}
+	return u.Hostname(), port, nil
+}
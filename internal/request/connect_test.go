@@ -0,0 +1,89 @@
+package request
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/net/proxy"
+
+	"eugene-chernyshenko/proxy-synthetic-check/internal/config"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/metrics/metricstest"
+)
+
+func TestConnect_RecordsSuccessWithoutRequest(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		received <- data
+	}()
+
+	m := metricstest.New(t)
+	result := Connect(m, proxy.Direct, "http://"+ln.Addr().String()+"/health", "proxy_connect", config.Proxy{Protocol: "socks5"}, nil, time.Second)
+
+	if result.Status != "success" || result.StatusCode != 0 {
+		t.Errorf("result = %+v, want success without status code", result)
+	}
+	if got := testutil.ToFloat64(m.RequestsTotal.WithLabelValues("proxy_connect", "socks5", "success", "", "")); got != 1 {
+		t.Errorf("requests_total{status=success} = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(m.ProxyState.WithLabelValues("proxy_connect", "socks5")); got != StateUp {
+		t.Errorf("proxy_state = %v, want %v", got, StateUp)
+	}
+
+	select {
+	case data := <-received:
+		if len(data) != 0 {
+			t.Errorf("expected no bytes sent to the target, got %q", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("target never saw a connection")
+	}
+}
+
+func TestConnect_ConnectionRefused(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	m := metricstest.New(t)
+	result := Connect(m, proxy.Direct, "http://"+addr, "proxy_connect_refused", config.Proxy{Protocol: "socks5"}, nil, time.Second)
+
+	if result.Status != "error" || result.ErrorType != "connection_error" {
+		t.Errorf("result = %+v, want connection_error", result)
+	}
+}
+
+func TestTargetAddr(t *testing.T) {
+	tests := []struct {
+		url, host, port string
+	}{
+		{"http://example.com/path", "example.com", "80"},
+		{"https://example.com", "example.com", "443"},
+		{"https://example.com:8443", "example.com", "8443"},
+		{"wss://example.com/ws", "example.com", "443"},
+		{"http://[::1]:9000", "::1", "9000"},
+	}
+	for _, tt := range tests {
+		host, port, err := TargetAddr(tt.url)
+		if err != nil || host != tt.host || port != tt.port {
+			t.Errorf("TargetAddr(%q) = %q, %q, %v, want %q, %q", tt.url, host, port, err, tt.host, tt.port)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package request
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// setHeaders sets the configured headers on req; a Host entry sets req.Host, as net/http
+// ignores the Host header field
+func setHeaders(req *http.Request, headers map[string]string) {
+	for name, value := range headers {
+		if strings.EqualFold(name, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+}
+
+// defaultContentType returns the Content-Type sent with a configured body: JSON when it parses
+// as JSON, otherwise what net/http sniffs from the content
+func defaultContentType(body string) string {
+	if json.Valid([]byte(body)) {
+		return "application/json"
+	}
+	return http.DetectContentType([]byte(body))
+}
+
+// sensitiveHeaderParts mark header names whose values must not be logged
+var sensitiveHeaderParts = []string{"auth", "cookie", "key", "token", "secret", "password", "signature"}
+
+// MaskHeaders formats headers for logging in name order, hiding the values of credential-like headers
+func MaskHeaders(headers map[string]string) string {
+	parts := make([]string, 0, len(headers))
+	for _, name := range slices.Sorted(maps.Keys(headers)) {
+		value := headers[name]
+		lower := strings.ToLower(name)
+		for _, part := range sensitiveHeaderParts {
+			if strings.Contains(lower, part) {
+				value = "***"
+				break
+			}
+		}
+		parts = append(parts, name+": "+value)
+	}
+	return strings.Join(parts, ", ")
+}
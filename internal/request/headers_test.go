@@ -0,0 +1,55 @@
+package request
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"eugene-chernyshenko/proxy-synthetic-check/internal/config"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/metrics/metricstest"
+)
+
+func TestMake_Headers(t *testing.T) {
+	var got *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+	}))
+	defer server.Close()
+
+	m := metricstest.New(t)
+	proxyConfig := config.Proxy{
+		Protocol: "http",
+		Headers: map[string]string{
+			"X-Api-Key": "k3y",
+			"Accept":    "application/json",
+			"host":      "api.example.com",
+		},
+	}
+	if result := Make(context.Background(), m, server.Client(), server.URL, "proxy_headers", proxyConfig, nil); result.Status != "success" {
+		t.Fatalf("result = %+v, want success", result)
+	}
+
+	if v := got.Header.Get("X-Api-Key"); v != "k3y" {
+		t.Errorf("X-Api-Key = %q, want k3y", v)
+	}
+	if v := got.Header.Get("Accept"); v != "application/json" {
+		t.Errorf("Accept = %q, want application/json", v)
+	}
+	if got.Host != "api.example.com" {
+		t.Errorf("Host = %q, want api.example.com", got.Host)
+	}
+}
+
+func TestMaskHeaders(t *testing.T) {
+	headers := map[string]string{
+		"Authorization": "Bearer abc",
+		"X-Api-Key":     "k3y",
+		"Cookie":        "session=1",
+		"Accept":        "application/json",
+	}
+	want := "Accept: application/json, Authorization: ***, Cookie: ***, X-Api-Key: ***"
+	if got := MaskHeaders(headers); got != want {
+		t.Errorf("MaskHeaders() = %q, want %q", got, want)
+	}
+}
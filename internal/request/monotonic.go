@@ -0,0 +1,111 @@
+package request
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"eugene-chernyshenko/proxy-synthetic-check/internal/config"
+)
+
+// maxInspectedBody bounds how much of a response body is kept for inspection
+const maxInspectedBody = 1 << 20
+
+// checkMonotonic samples monotonic_field a second time with a copy of req and fails unless the
+// value grew since first, the body of the first response. On failure the status (error, or warning
+// for a warn_status_codes response) and error type are returned with the error.
+func checkMonotonic(ctx context.Context, client *http.Client, req *http.Request, proxyConfig config.Proxy, first []byte) (status, errorType string, err error) {
+	before, err := counterValue(first, proxyConfig.MonotonicField)
+	if err != nil {
+		return "error", "counter_parse_error", err
+	}
+
+	again := req.Clone(ctx)
+	if req.GetBody != nil {
+		// The body of the first request has been consumed
+		body, err := req.GetBody()
+		if err != nil {
+			return "error", "unknown_error", err
+		}
+		again.Body = body
+	}
+	if proxyConfig.HMACSigning != nil {
+		if err := signRequest(again, proxyConfig.HMACSigning, time.Now()); err != nil {
+			return "error", "unknown_error", err
+		}
+	}
+	resp, err := client.Do(again)
+	if err != nil {
+		errorType, _ = CategorizeError(err)
+		return "error", errorType, fmt.Errorf("second sample: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var body io.Reader = resp.Body
+	if proxyConfig.RequireCompression {
+		body, err = decodeBody(resp.Body, resp.Header.Get("Content-Encoding"))
+		if err != nil {
+			return "error", "read_error", fmt.Errorf("second sample: %w", err)
+		}
+	}
+	second, err := io.ReadAll(io.LimitReader(body, maxInspectedBody))
+	if err != nil {
+		return "error", "read_error", fmt.Errorf("second sample: %w", err)
+	}
+	if status, errorType := statusResult(proxyConfig, resp.StatusCode); status != "" {
+		return status, errorType, fmt.Errorf("second sample: HTTP %d", resp.StatusCode)
+	}
+	after, err := counterValue(second, proxyConfig.MonotonicField)
+	if err != nil {
+		return "error", "counter_parse_error", fmt.Errorf("second sample: %w", err)
+	}
+
+	if after <= before {
+		return "error", "counter_not_increasing", fmt.Errorf("value went from %v to %v", before, after)
+	}
+	return "", "", nil
+}
+
+// counterValue extracts the number at path from a JSON body. The path is a dot-separated list of
+// object keys and array indexes, e.g. "stats.requests" or "workers.0.served". Numbers encoded as
+// strings are accepted.
+func counterValue(body []byte, path string) (float64, error) {
+	var value any
+	if err := json.Unmarshal(body, &value); err != nil {
+		return 0, fmt.Errorf("response is not JSON: %w", err)
+	}
+
+	for _, key := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]any:
+			next, ok := v[key]
+			if !ok {
+				return 0, fmt.Errorf("field %q not found", path)
+			}
+			value = next
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return 0, fmt.Errorf("field %q not found", path)
+			}
+			value = v[i]
+		default:
+			return 0, fmt.Errorf("field %q not found", path)
+		}
+	}
+
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case string:
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("field %q is not a number", path)
+}
@@ -0,0 +1,105 @@
+package request
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"eugene-chernyshenko/proxy-synthetic-check/internal/config"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/metrics/metricstest"
+)
+
+func TestMake_MonotonicField(t *testing.T) {
+	var served atomic.Int64
+	increasing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"stats": {"requests": %d}}`, served.Add(1))
+	}))
+	defer increasing.Close()
+	static := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"stats": {"requests": 42}}`)
+	}))
+	defer static.Close()
+
+	m := metricstest.New(t)
+	proxyConfig := config.Proxy{Protocol: "http", MonotonicField: "stats.requests"}
+
+	result := Make(context.Background(), m, increasing.Client(), increasing.URL, "proxy_counter_up", proxyConfig, nil)
+	if result.Status != "success" {
+		t.Errorf("increasing counter: result = %+v, want success", result)
+	}
+	if got := served.Load(); got != 2 {
+		t.Errorf("increasing counter: target sampled %d times, want 2", got)
+	}
+
+	result = Make(context.Background(), m, static.Client(), static.URL, "proxy_counter_static", proxyConfig, nil)
+	if result.Status != "error" || result.ErrorType != "counter_not_increasing" {
+		t.Errorf("static counter: result = %+v, want counter_not_increasing", result)
+	}
+	if got := testutil.ToFloat64(m.RequestsTotal.WithLabelValues("proxy_counter_static", "http", "error", "counter_not_increasing", "2xx")); got != 1 {
+		t.Errorf("requests_total{error=counter_not_increasing} = %v, want 1", got)
+	}
+}
+
+func TestMake_MonotonicFieldSecondSampleStatus(t *testing.T) {
+	tests := []struct {
+		name          string
+		secondStatus  int
+		proxyConfig   config.Proxy
+		wantStatus    string
+		wantErrorType string
+	}{
+		{"expected_status", http.StatusNotFound, config.Proxy{ExpectedStatus: []int{200, 404}}, "success", ""},
+		{"warn_status_codes", http.StatusTooManyRequests, config.Proxy{WarnStatusCodes: []int{429}}, "warning", "http_429"},
+		{"unexpected status", http.StatusServiceUnavailable, config.Proxy{ExpectedStatus: []int{200}}, "error", "unexpected_status"},
+		{"error status", http.StatusServiceUnavailable, config.Proxy{}, "error", "http_503"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The second sample answers with secondStatus, and a grown counter
+			var served atomic.Int64
+			target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := served.Add(1)
+				if n > 1 {
+					w.WriteHeader(tt.secondStatus)
+				}
+				fmt.Fprintf(w, `{"requests": %d}`, n)
+			}))
+			defer target.Close()
+
+			proxyConfig := tt.proxyConfig
+			proxyConfig.Protocol = "http"
+			proxyConfig.MonotonicField = "requests"
+			result := Make(context.Background(), metricstest.New(t), target.Client(), target.URL, "proxy_counter_status", proxyConfig, nil)
+			if result.Status != tt.wantStatus || result.ErrorType != tt.wantErrorType {
+				t.Errorf("result = %+v, want %s %q", result, tt.wantStatus, tt.wantErrorType)
+			}
+		})
+	}
+}
+
+func TestCounterValue(t *testing.T) {
+	tests := []struct {
+		body    string
+		path    string
+		want    float64
+		wantErr bool
+	}{
+		{`{"requests": 10}`, "requests", 10, false},
+		{`{"stats": {"requests": "12"}}`, "stats.requests", 12, false},
+		{`{"workers": [{"served": 3}, {"served": 7}]}`, "workers.1.served", 7, false},
+		{`{"stats": {}}`, "stats.requests", 0, true},
+		{`{"requests": "many"}`, "requests", 0, true},
+		{`not json`, "requests", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := counterValue([]byte(tt.body), tt.path)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("counterValue(%s, %q) = %v, %v, want %v (error %v)", tt.body, tt.path, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package request
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// checkOCSPStaple returns an error unless the TLS connection state carries a stapled OCSP
+// response for the target's certificate, signed by its issuer, that reports the certificate as
+// good and is current. The staple proves the target (and not the proxy) answered, and that the
+// certificate hasn't been revoked.
+func checkOCSPStaple(state *tls.ConnectionState) error {
+	if state == nil {
+		return errors.New("not a TLS connection")
+	}
+	if len(state.OCSPResponse) == 0 {
+		return errors.New("no OCSP response stapled")
+	}
+	leaf, issuer, err := ocspCertificates(state)
+	if err != nil {
+		return err
+	}
+	resp, err := ocsp.ParseResponseForCert(state.OCSPResponse, leaf, issuer)
+	if err != nil {
+		return fmt.Errorf("invalid OCSP response: %w", err)
+	}
+	switch resp.Status {
+	case ocsp.Good:
+	case ocsp.Revoked:
+		return fmt.Errorf("certificate revoked at %s", resp.RevokedAt.UTC().Format(time.RFC3339))
+	default:
+		return errors.New("OCSP response reports the certificate status as unknown")
+	}
+	now := time.Now()
+	if resp.ThisUpdate.After(now) {
+		return fmt.Errorf("OCSP response not valid before %s", resp.ThisUpdate.UTC().Format(time.RFC3339))
+	}
+	if !resp.NextUpdate.IsZero() && resp.NextUpdate.Before(now) {
+		return fmt.Errorf("OCSP response expired at %s", resp.NextUpdate.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// ocspCertificates returns the target's certificate and its issuer, preferring the verified
+// chain; without verification (insecure_skip_verify) the chain the target sent is used
+func ocspCertificates(state *tls.ConnectionState) (leaf, issuer *x509.Certificate, err error) {
+	chain := state.PeerCertificates
+	if len(state.VerifiedChains) > 0 {
+		chain = state.VerifiedChains[0]
+	}
+	switch {
+	case len(chain) == 0:
+		return nil, nil, errors.New("no peer certificate")
+	case len(chain) > 1:
+		return chain[0], chain[1], nil
+	case chain[0].CheckSignatureFrom(chain[0]) == nil:
+		// A self-signed certificate is its own issuer
+		return chain[0], chain[0], nil
+	default:
+		return nil, nil, errors.New("issuer certificate not available to verify the OCSP response")
+	}
+}
@@ -0,0 +1,85 @@
+package request
+
+import (
+	"context"
+	"crypto"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+
+	"eugene-chernyshenko/proxy-synthetic-check/internal/config"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/metrics/metricstest"
+)
+
+// ocspStaple returns a DER OCSP response signed with the (self-signed) key of server, for its
+// certificate unless template has a serial number
+func ocspStaple(t *testing.T, server *httptest.Server, template ocsp.Response) []byte {
+	t.Helper()
+	cert := server.Certificate()
+	if template.SerialNumber == nil {
+		template.SerialNumber = cert.SerialNumber
+	}
+	der, err := ocsp.CreateResponse(cert, cert, template, server.TLS.Certificates[0].PrivateKey.(crypto.Signer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestMake_RequireOCSPStapling(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		staple    func(t *testing.T, server *httptest.Server) []byte
+		wantError string
+	}{
+		{"good", func(t *testing.T, server *httptest.Server) []byte {
+			return ocspStaple(t, server, ocsp.Response{Status: ocsp.Good, ThisUpdate: now.Add(-time.Hour), NextUpdate: now.Add(time.Hour)})
+		}, ""},
+		{"revoked", func(t *testing.T, server *httptest.Server) []byte {
+			return ocspStaple(t, server, ocsp.Response{Status: ocsp.Revoked, RevokedAt: now.Add(-time.Hour), ThisUpdate: now.Add(-time.Hour), NextUpdate: now.Add(time.Hour)})
+		}, "ocsp_missing"},
+		{"unknown", func(t *testing.T, server *httptest.Server) []byte {
+			return ocspStaple(t, server, ocsp.Response{Status: ocsp.Unknown, ThisUpdate: now.Add(-time.Hour), NextUpdate: now.Add(time.Hour)})
+		}, "ocsp_missing"},
+		{"stale", func(t *testing.T, server *httptest.Server) []byte {
+			return ocspStaple(t, server, ocsp.Response{Status: ocsp.Good, ThisUpdate: now.Add(-48 * time.Hour), NextUpdate: now.Add(-24 * time.Hour)})
+		}, "ocsp_missing"},
+		{"not yet valid", func(t *testing.T, server *httptest.Server) []byte {
+			return ocspStaple(t, server, ocsp.Response{Status: ocsp.Good, ThisUpdate: now.Add(time.Hour), NextUpdate: now.Add(2 * time.Hour)})
+		}, "ocsp_missing"},
+		{"other certificate", func(t *testing.T, server *httptest.Server) []byte {
+			return ocspStaple(t, server, ocsp.Response{Status: ocsp.Good, SerialNumber: big.NewInt(1), ThisUpdate: now.Add(-time.Hour), NextUpdate: now.Add(time.Hour)})
+		}, "ocsp_missing"},
+		{"not stapled", func(t *testing.T, server *httptest.Server) []byte { return nil }, "ocsp_missing"},
+		{"unsuccessful", func(t *testing.T, server *httptest.Server) []byte { return []byte{0x30, 0x03, 0x0a, 0x01, 0x03} }, "ocsp_missing"},
+		{"malformed", func(t *testing.T, server *httptest.Server) []byte { return []byte("not ocsp") }, "ocsp_missing"},
+	}
+
+	m := metricstest.New(t)
+	proxyConfig := config.Proxy{Protocol: "http", RequireOCSPStapling: true}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			server.StartTLS()
+			defer server.Close()
+			// The listener serves the certificates of server.TLS, set up by StartTLS
+			server.TLS.Certificates[0].OCSPStaple = tt.staple(t, server)
+
+			result := Make(context.Background(), m, server.Client(), server.URL, "proxy_ocsp", proxyConfig, nil)
+			if result.ErrorType != tt.wantError {
+				t.Errorf("result = %+v, want error type %q", result, tt.wantError)
+			}
+		})
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	if result := Make(context.Background(), m, server.Client(), server.URL, "proxy_ocsp", proxyConfig, nil); result.ErrorType != "ocsp_missing" {
+		t.Errorf("plain HTTP: result = %+v, want ocsp_missing", result)
+	}
+}
@@ -0,0 +1,99 @@
+package request
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// ErrTargetNotAllowed is wrapped by all TargetPolicy.Check errors
+var ErrTargetNotAllowed = errors.New("target not allowed")
+
+// TargetPolicy restricts which hosts checks may be sent to, guarding against the checker
+// being pointed at internal services. A nil *TargetPolicy allows every target.
+type TargetPolicy struct {
+	hosts []string       // exact hostnames or "*.example.com" suffix patterns
+	cidrs []netip.Prefix // networks every target address must be in
+}
+
+// NewTargetPolicy creates a policy from allowed_target_hosts and allowed_target_cidrs,
+// returning nil when both are empty
+func NewTargetPolicy(hosts, cidrs []string) (*TargetPolicy, error) {
+	if len(hosts) == 0 && len(cidrs) == 0 {
+		return nil, nil
+	}
+
+	p := &TargetPolicy{}
+	for _, host := range hosts {
+		p.hosts = append(p.hosts, strings.ToLower(host))
+	}
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed_target_cidrs entry %q: %w", cidr, err)
+		}
+		p.cidrs = append(p.cidrs, prefix.Masked())
+	}
+	return p, nil
+}
+
+// Check returns an error unless host is allowed. A host is allowed when it matches
+// allowed_target_hosts, or when every address it resolves to (or connectIP, if set)
+// is inside allowed_target_cidrs.
+func (p *TargetPolicy) Check(ctx context.Context, host, connectIP string) error {
+	if p == nil {
+		return nil
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, allowed := range p.hosts {
+		if host == allowed || (strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:])) {
+			return nil
+		}
+	}
+	if len(p.cidrs) == 0 {
+		return fmt.Errorf("%w: host %s is not in allowed_target_hosts", ErrTargetNotAllowed, host)
+	}
+
+	var addrs []netip.Addr
+	switch {
+	case connectIP != "":
+		addr, err := netip.ParseAddr(connectIP)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrTargetNotAllowed, err)
+		}
+		addrs = []netip.Addr{addr}
+	default:
+		if addr, err := netip.ParseAddr(host); err == nil {
+			addrs = []netip.Addr{addr}
+			break
+		}
+		resolved, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return fmt.Errorf("%w: cannot resolve %s to check allowed_target_cidrs: %w", ErrTargetNotAllowed, host, err)
+		}
+		addrs = resolved
+	}
+
+	// Every address must be allowed, so a name resolving to both a public and an
+	// internal address cannot be used to reach the internal one
+	for _, addr := range addrs {
+		if !p.allowsAddr(addr.Unmap()) {
+			return fmt.Errorf("%w: address %s of %s is not in allowed_target_cidrs", ErrTargetNotAllowed, addr, host)
+		}
+	}
+	return nil
+}
+
+// allowsAddr reports whether addr is inside one of the allowed networks
+func (p *TargetPolicy) allowsAddr(addr netip.Addr) bool {
+	for _, prefix := range p.cidrs {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
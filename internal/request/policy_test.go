@@ -0,0 +1,84 @@
+package request
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"eugene-chernyshenko/proxy-synthetic-check/internal/config"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/metrics/metricstest"
+)
+
+func TestTargetPolicy_Check(t *testing.T) {
+	tests := []struct {
+		name      string
+		hosts     []string
+		cidrs     []string
+		host      string
+		connectIP string
+		wantErr   bool
+	}{
+		{name: "no policy", host: "10.0.0.1"},
+		{name: "exact host", hosts: []string{"example.com"}, host: "Example.com"},
+		{name: "wildcard host", hosts: []string{"*.example.com"}, host: "api.example.com"},
+		{name: "wildcard does not match apex", hosts: []string{"*.example.com"}, host: "example.com", wantErr: true},
+		{name: "host not listed", hosts: []string{"example.com"}, host: "internal.local", wantErr: true},
+		{name: "IP in CIDR", cidrs: []string{"203.0.113.0/24"}, host: "203.0.113.7"},
+		{name: "IP outside CIDR", cidrs: []string{"203.0.113.0/24"}, host: "10.0.0.1", wantErr: true},
+		{name: "resolved name in CIDR", cidrs: []string{"127.0.0.0/8", "::1/128"}, host: "localhost"},
+		{name: "resolved name outside CIDR", cidrs: []string{"203.0.113.0/24"}, host: "localhost", wantErr: true},
+		{name: "connect_ip checked instead of DNS", cidrs: []string{"203.0.113.0/24"}, host: "localhost", connectIP: "203.0.113.7"},
+		{name: "connect_ip outside CIDR", cidrs: []string{"203.0.113.0/24"}, host: "example.com", connectIP: "10.0.0.1", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := NewTargetPolicy(tt.hosts, tt.cidrs)
+			if err != nil {
+				t.Fatalf("NewTargetPolicy() error = %v", err)
+			}
+			err = policy.Check(context.Background(), tt.host, tt.connectIP)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Check(%q) error = %v, wantErr %v", tt.host, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewTargetPolicy_InvalidCIDR(t *testing.T) {
+	if _, err := NewTargetPolicy(nil, []string{"10.0.0.0/33"}); err == nil {
+		t.Error("NewTargetPolicy() error = nil, want invalid CIDR error")
+	}
+}
+
+func TestMake_TargetPolicy(t *testing.T) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer server.Close()
+
+	m := metricstest.New(t)
+	proxyConfig := config.Proxy{Protocol: "http"}
+
+	allowed, _ := NewTargetPolicy(nil, []string{"127.0.0.0/8"})
+	if result := Make(context.Background(), m, server.Client(), server.URL, "proxy_policy_allowed", proxyConfig, allowed); result.Status != "success" {
+		t.Errorf("allowed target: status = %q (%s), want success", result.Status, result.ErrorType)
+	}
+
+	refused, _ := NewTargetPolicy([]string{"example.com"}, []string{"203.0.113.0/24"})
+	result := Make(context.Background(), m, server.Client(), server.URL, "proxy_policy_refused", proxyConfig, refused)
+	if result.ErrorType != "target_not_allowed" {
+		t.Errorf("refused target: error type = %q, want target_not_allowed", result.ErrorType)
+	}
+	if got := testutil.ToFloat64(m.RequestsTotal.WithLabelValues("proxy_policy_refused", "http", "error", "target_not_allowed", "")); got != 1 {
+		t.Errorf("requests_total{error=target_not_allowed} = %v, want 1", got)
+	}
+	if got := hits.Load(); got != 1 {
+		t.Errorf("server hit %d times, want 1 (refused request must not be sent)", got)
+	}
+}
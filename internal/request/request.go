@@ -1,139 +1,675 @@
 package request
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"hash"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/andybalholm/brotli"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"eugene-chernyshenko/proxy-synthetic-check/internal/config"
 	"eugene-chernyshenko/proxy-synthetic-check/internal/metrics"
 )
 
-// Make performs HTTP request and records metrics
-func Make(m *metrics.Metrics, client *http.Client, targetURL, proxyID, proxyProtocol string, labels map[string]string) {
+// tracerName identifies spans created by this package
+const tracerName = "eugene-chernyshenko/proxy-synthetic-check/internal/request"
+
+// Proxy states exported by the proxy_state gauge
+const (
+	StateDown     = 0 // check failed
+	StateDegraded = 1 // check succeeded with a warning status or slower than the degraded threshold
+	StateUp       = 2 // check succeeded within the threshold
+)
+
+// ErrTooManyRedirects is returned by a client's CheckRedirect when max_redirects is exceeded
+var ErrTooManyRedirects = errors.New("too many redirects")
+
+// CheckResult is the outcome of a single check
+type CheckResult struct {
+	Status    string        // success, warning or error
+	ErrorType string        // error label value, empty on success
+	Duration  time.Duration // request latency as recorded in request_duration_seconds
+
+	StatusCode int    // HTTP status code, 0 when no response was received
+	ALPN       string // TLS application protocol negotiated with the target, empty without TLS or ALPN
+}
+
+// Make performs HTTP request and records metrics. Targets refused by policy (may be nil)
+// are recorded as target_not_allowed without sending anything. Userinfo in targetURL is
+// sent as Basic Auth credentials and kept out of logs, spans and metric labels. Canceling
+// ctx aborts the request without recording anything and returns a zero CheckResult;
+// client.Timeout bounds the request as a deadline on ctx.
+func Make(ctx context.Context, m *metrics.Metrics, client *http.Client, targetURL, proxyID string, proxyConfig config.Proxy, policy *TargetPolicy) (result CheckResult) {
+	parent := ctx
+	proxyProtocol := proxyConfig.Protocol
+	targetURL, targetAuth := splitUserinfo(targetURL)
+
+	// Span is a no-op unless a tracer provider was installed (see tracing.Setup)
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "check",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("proxy_id", proxyID),
+			attribute.String("proxy_protocol", proxyProtocol),
+			attribute.String("target", targetURL),
+			attribute.String("http.method", proxyConfig.GetMethod()),
+		),
+	)
+	defer span.End()
+	if client.Timeout > 0 {
+		// Reported as context.DeadlineExceeded, also while reading the body
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, client.Timeout)
+		defer cancel()
+	}
+	ctx = httptrace.WithClientTrace(ctx, newClientTrace(span))
+
+	// Label values: proxy_id, proxy_protocol, ...labelKeys...
+	labelValues := m.ProxyLabelValues(proxyID, proxyProtocol, proxyConfig.MetricLabels())
+	ctx = httptrace.WithClientTrace(ctx, timingTrace(m, labelValues))
+
+	inFlight := m.InFlight.WithLabelValues(labelValues...)
+	inFlight.Inc()
+	defer inFlight.Dec()
+
 	start := time.Now()
 
-	resp, err := client.Get(targetURL)
-	duration := time.Since(start).Seconds()
-
-	// Build label values: proxy_id, proxy_protocol, ...labelKeys..., status, error
-	buildLabelValues := func(status, errorValue string) []string {
-		values := []string{proxyID, proxyProtocol}
-		for _, key := range m.LabelKeys {
-			if val, ok := labels[key]; ok {
-				values = append(values, val)
-			} else {
-				values = append(values, "")
-			}
+	var resp *http.Response
+	var policyErr error
+	var reqBody io.Reader
+	if proxyConfig.Body != "" {
+		reqBody = strings.NewReader(proxyConfig.Body)
+	}
+	req, err := http.NewRequestWithContext(ctx, proxyConfig.GetMethod(), targetURL, reqBody)
+	if err == nil && targetAuth != nil {
+		// A configured Authorization header still takes precedence
+		password, _ := targetAuth.Password()
+		req.SetBasicAuth(targetAuth.Username(), password)
+	}
+	if err == nil && reqBody != nil {
+		// Configured headers may still override it
+		req.Header.Set("Content-Type", defaultContentType(proxyConfig.Body))
+	}
+	if err == nil {
+		policyErr = policy.Check(ctx, req.URL.Hostname(), proxyConfig.ConnectIP)
+		err = policyErr
+	}
+	if err == nil && proxyConfig.ConnectIP != "" && strings.ToLower(proxyProtocol) == "http" {
+		// SOCKS5 pins the IP in its dialer; HTTP proxies connect to whatever the URL names
+		pinTargetIP(req, proxyConfig.ConnectIP)
+	}
+	if err == nil {
+		setHeaders(req, proxyConfig.Headers)
+	}
+	if err == nil && proxyConfig.UserAgent != "" {
+		req.Header.Set("User-Agent", proxyConfig.UserAgent)
+	}
+	if err == nil && proxyConfig.RequireCompression {
+		// Setting Accept-Encoding ourselves disables the transport's transparent gzip
+		// decompression, so Content-Encoding reports what the server actually sent
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	if err == nil && proxyConfig.HMACSigning != nil {
+		err = signRequest(req, proxyConfig.HMACSigning, time.Now())
+	}
+	if err == nil {
+		resp, err = client.Do(req)
+	}
+	elapsed := time.Since(start)
+	if parent.Err() != nil {
+		// Aborted on shutdown or because the proxy was stopped; not an outcome of the proxy
+		log.Printf("[%s] Request to %s canceled", proxyID, targetURL)
+		return
+	}
+	elapsed = sanitizeDuration(m, elapsed, maxPlausibleLatency(client), proxyID, labelValues)
+
+	// HTTP status code of the response, 0 when none was received
+	statusCode := 0
+	alpn := ""
+	if resp != nil {
+		statusCode = resp.StatusCode
+		if resp.TLS != nil {
+			alpn = resp.TLS.NegotiatedProtocol
+			span.SetAttributes(attribute.String("tls.alpn", alpn))
+			recordCertExpiry(m, labelValues, targetURL, resp.TLS)
 		}
-		values = append(values, status, errorValue)
-		return values
-	}
-
-	// Build label values for duration: proxy_id, proxy_protocol, ...labelKeys...
-	buildDurationLabelValues := func() []string {
-		values := []string{proxyID, proxyProtocol}
-		for _, key := range m.LabelKeys {
-			if val, ok := labels[key]; ok {
-				values = append(values, val)
-			} else {
-				values = append(values, "")
-			}
+	}
+
+	// Record the outcome of the check in metrics and on the span
+	record := func(status, errorType string, err error) {
+		if parent.Err() != nil {
+			// Canceled while reading the body
+			return
 		}
-		return values
+		result = CheckResult{Status: status, ErrorType: errorType, Duration: elapsed, StatusCode: statusCode, ALPN: alpn}
+		recordResult(m, span, proxyID, proxyConfig, result, err)
+	}
+
+	if policyErr != nil {
+		record("error", "target_not_allowed", policyErr)
+		log.Printf("[%s] Refusing request to %s: %v", proxyID, targetURL, policyErr)
+		return
 	}
 
 	if err != nil {
 		// Categorize error
 		errorType, _ := CategorizeError(err)
-		m.RequestsTotal.WithLabelValues(buildLabelValues("error", errorType)...).Inc()
-		m.RequestDuration.WithLabelValues(buildDurationLabelValues()...).Observe(duration)
+		record("error", errorType, err)
 		log.Printf("[%s] Error making request to %s: %v", proxyID, targetURL, err)
 		return
 	}
 	defer resp.Body.Close()
 
-	// Read and discard response body to free up connection
-	_, err = io.Copy(io.Discard, resp.Body)
+	// Read response body to free up connection; it is only kept when it has to be inspected
+	var body bytes.Buffer
+	sink := io.Discard
+	if proxyConfig.MonotonicField != "" || proxyConfig.BodyContains != "" || proxyConfig.BodyRegex != "" {
+		sink = &body
+	}
+	var bodyReader io.Reader = resp.Body
+	if proxyConfig.RequireCompression {
+		bodyReader, err = decodeBody(resp.Body, resp.Header.Get("Content-Encoding"))
+		if err != nil {
+			record("error", "read_error", err)
+			log.Printf("[%s] Error decoding response: %v", proxyID, err)
+			return
+		}
+	}
+	// expected_sha256 covers the whole body, not just the inspected part
+	digest := sha256.New()
+	if proxyConfig.ExpectedSHA256 != "" {
+		bodyReader = io.TeeReader(bodyReader, digest)
+	}
+	bodySize, err := io.Copy(sink, io.LimitReader(bodyReader, maxInspectedBody))
+	if err == nil {
+		var rest int64
+		rest, err = io.Copy(io.Discard, bodyReader)
+		bodySize += rest
+	}
 	if err != nil {
 		// Error reading response body
-		m.RequestsTotal.WithLabelValues(buildLabelValues("error", "read_error")...).Inc()
-		m.RequestDuration.WithLabelValues(buildDurationLabelValues()...).Observe(duration)
+		record("error", "read_error", err)
 		log.Printf("[%s] Error reading response: %v", proxyID, err)
 		return
 	}
+	m.ResponseSize.WithLabelValues(labelValues...).Observe(float64(bodySize))
+
+	// The target answered but did not agree on any of the offered protocols
+	if len(proxyConfig.TLSALPN) > 0 && resp.TLS != nil && !slices.Contains(proxyConfig.TLSALPN, alpn) {
+		record("error", "alpn_mismatch", nil)
+		log.Printf("[%s] Negotiated ALPN protocol %q for request to %s, want one of %v", proxyID, alpn, targetURL, proxyConfig.TLSALPN)
+		return
+	}
 
-	// Check HTTP status code
-	if resp.StatusCode >= 400 {
-		errorType := "http_" + strconv.Itoa(resp.StatusCode)
-		m.RequestsTotal.WithLabelValues(buildLabelValues("error", errorType)...).Inc()
-		m.RequestDuration.WithLabelValues(buildDurationLabelValues()...).Observe(duration)
+	if proxyConfig.RequireOCSPStapling {
+		if err := checkOCSPStaple(resp.TLS); err != nil {
+			record("error", "ocsp_missing", err)
+			log.Printf("[%s] Missing OCSP staple for request to %s: %v", proxyID, targetURL, err)
+			return
+		}
+	}
+
+	// Check HTTP status code; reachable but flagged (e.g. 429 rate limited) is a warning
+	switch status, errorType := statusResult(proxyConfig, resp.StatusCode); status {
+	case "warning":
+		record(status, errorType, nil)
+		log.Printf("[%s] HTTP %d for request to %s reported as warning", proxyID, resp.StatusCode, targetURL)
+		return
+	case "error":
+		record(status, errorType, nil)
 		log.Printf("[%s] HTTP error %d for request to %s", proxyID, resp.StatusCode, targetURL)
 		return
 	}
 
+	// A flaky proxy may answer 200 without passing on any content
+	if proxyConfig.EmptyBodyIsFailure && bodySize == 0 && req.Method != http.MethodHead {
+		record("error", "empty_response", nil)
+		log.Printf("[%s] Empty response body from %s", proxyID, targetURL)
+		return
+	}
+
+	// A load balancer may answer 200 with an error page; only the first maxInspectedBody bytes are searched
+	if proxyConfig.BodyContains != "" && !strings.Contains(body.String(), proxyConfig.BodyContains) {
+		record("error", "body_mismatch", nil)
+		log.Printf("[%s] Response from %s does not contain %q", proxyID, targetURL, proxyConfig.BodyContains)
+		return
+	}
+
+	// Both body_contains and body_regex have to pass
+	if proxyConfig.BodyRegex != "" {
+		re, err := proxyConfig.BodyRegexp()
+		if err != nil || !re.Match(body.Bytes()) {
+			record("error", "body_regex_mismatch", err)
+			log.Printf("[%s] Response from %s does not match %q", proxyID, targetURL, proxyConfig.BodyRegex)
+			return
+		}
+	}
+
+	if proxyConfig.ExpectedSHA256 != "" {
+		if sum := hex.EncodeToString(digest.Sum(nil)); !strings.EqualFold(sum, proxyConfig.ExpectedSHA256) {
+			record("error", "checksum_mismatch", nil)
+			log.Printf("[%s] Response from %s has SHA-256 %s, want %s", proxyID, targetURL, sum, proxyConfig.ExpectedSHA256)
+			return
+		}
+	}
+
+	if proxyConfig.RequireCompression && !isCompressed(resp.Header.Get("Content-Encoding")) {
+		record("error", "compression_not_applied", nil)
+		log.Printf("[%s] Response from %s not compressed despite Accept-Encoding: %s", proxyID, targetURL, acceptEncoding)
+		return
+	}
+
+	// The target must show it is serving traffic: the counter has to grow between two samples
+	if proxyConfig.MonotonicField != "" {
+		if status, errorType, err := checkMonotonic(ctx, client, req, proxyConfig, body.Bytes()); err != nil {
+			record(status, errorType, err)
+			log.Printf("[%s] Counter %s of %s: %v", proxyID, proxyConfig.MonotonicField, targetURL, err)
+			return
+		}
+	}
+
 	// Success
-	m.RequestsTotal.WithLabelValues(buildLabelValues("success", "")...).Inc()
-	m.RequestDuration.WithLabelValues(buildDurationLabelValues()...).Observe(duration)
+	record("success", "", nil)
+	return
+}
+
+// splitUserinfo returns targetURL without its userinfo, and the userinfo (nil when there is none)
+func splitUserinfo(targetURL string) (string, *url.Userinfo) {
+	u, err := url.Parse(targetURL)
+	if err != nil || u.User == nil {
+		return targetURL, nil
+	}
+	user := u.User
+	u.User = nil
+	return u.String(), user
+}
+
+// recordResult records the outcome of a check in metrics and on the span
+func recordResult(m *metrics.Metrics, span trace.Span, proxyID string, proxyConfig config.Proxy, result CheckResult, err error) {
+	labelValues := m.ProxyLabelValues(proxyID, proxyConfig.Protocol, proxyConfig.MetricLabels())
+	statusClass := StatusClass(result.StatusCode)
+	errorLabel := m.ErrorLabel(proxyID, result.ErrorType)
+	m.RequestsTotal.WithLabelValues(append(labelValues, result.Status, errorLabel, statusClass)...).Inc()
+	m.RequestDuration.WithLabelValues(append(labelValues, statusClass)...).Observe(result.Duration.Seconds())
+	state := DeriveState(result.Status, result.Duration, proxyConfig.GetDegradedThreshold())
+	m.ProxyState.WithLabelValues(labelValues...).Set(float64(state))
+	if result.Status == "success" {
+		m.LastSuccess.WithLabelValues(labelValues...).SetToCurrentTime()
+	}
+	if len(proxyConfig.UserAgentRotation) > 0 {
+		m.RequestsByUserAgent.WithLabelValues(append(labelValues, proxyConfig.UserAgent, result.Status)...).Inc()
+	}
+	setSpanResult(span, result.Status, result.ErrorType, err)
+}
+
+// defaultMaxPlausibleLatency bounds measured latencies when the client has no timeout
+const defaultMaxPlausibleLatency = 10 * time.Minute
+
+// maxPlausibleLatency returns the longest latency that can legitimately be measured with client
+func maxPlausibleLatency(client *http.Client) time.Duration {
+	if client.Timeout > 0 {
+		return 2 * client.Timeout
+	}
+	return defaultMaxPlausibleLatency
+}
+
+// sanitizeDuration clamps non-positive or implausibly large durations into (0, limit],
+// counting and logging each anomaly so it doesn't silently poison the histogram.
+// time.Now carries a monotonic reading, so wall-clock (NTP) jumps don't affect time.Since;
+// this guards against platforms where the monotonic clock itself misbehaves (e.g. VM migrations).
+func sanitizeDuration(m *metrics.Metrics, d, limit time.Duration, proxyID string, labelValues []string) time.Duration {
+	clamped := d
+	switch {
+	case d <= 0:
+		clamped = 0
+	case d > limit:
+		clamped = limit
+	default:
+		return d
+	}
+
+	m.LatencyAnomalies.WithLabelValues(labelValues...).Inc()
+	log.Printf("[%s] Warning: implausible latency %v measured, clamped to %v", proxyID, d, clamped)
+	return clamped
+}
+
+// pinTargetIP points the request URL at ip while keeping the original host in the Host header
+func pinTargetIP(req *http.Request, ip string) {
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	req.Host = req.URL.Host
+	req.URL.Host = net.JoinHostPort(ip, port)
+}
+
+// signRequest sets the timestamp and signature headers on req. The signature is the hex HMAC
+// of the request URI (path and query) immediately followed by the unix timestamp.
+func signRequest(req *http.Request, signing *config.HMACSigning, now time.Time) error {
+	var newHash func() hash.Hash
+	switch strings.ToLower(signing.Algorithm) {
+	case "", "sha256":
+		newHash = sha256.New
+	case "sha512":
+		newHash = sha512.New
+	case "sha1":
+		newHash = sha1.New
+	default:
+		return errors.New("unsupported hmac_signing algorithm: " + signing.Algorithm)
+	}
+
+	header := signing.Header
+	if header == "" {
+		header = "X-Signature"
+	}
+	timestampHeader := signing.TimestampHeader
+	if timestampHeader == "" {
+		timestampHeader = "X-Timestamp"
+	}
+
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	mac := hmac.New(newHash, []byte(signing.Secret))
+	mac.Write([]byte(req.URL.RequestURI() + timestamp))
+
+	req.Header.Set(timestampHeader, timestamp)
+	req.Header.Set(header, hex.EncodeToString(mac.Sum(nil)))
+	return nil
+}
+
+// acceptEncoding is sent when require_compression is set
+const acceptEncoding = "br, gzip"
+
+// isCompressed reports whether a Content-Encoding header value names one of the offered encodings
+func isCompressed(contentEncoding string) bool {
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case "br", "gzip":
+		return true
+	}
+	return false
+}
+
+// decodeBody decodes a response body compressed with one of the offered encodings, since
+// setting Accept-Encoding disables the transport's transparent decompression
+func decodeBody(body io.Reader, contentEncoding string) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case "gzip":
+		decoded, err := gzip.NewReader(body)
+		if err == io.EOF {
+			// No body at all, e.g. answering HEAD
+			return body, nil
+		}
+		return decoded, err
+	case "br":
+		return brotli.NewReader(body), nil
+	}
+	return body, nil
+}
+
+// StatusClass returns the status code class (2xx, 3xx, 4xx, 5xx), or empty when no response was received
+func StatusClass(code int) string {
+	if code < 100 || code > 599 {
+		return ""
+	}
+	return strconv.Itoa(code/100) + "xx"
+}
+
+// statusResult returns the status (warning or error) and error type of a response with status
+// code, or an empty status when the code counts as success
+func statusResult(proxyConfig config.Proxy, code int) (status, errorType string) {
+	if proxyConfig.IsWarnStatus(code) {
+		return "warning", httpErrorType(proxyConfig, code)
+	}
+	if proxyConfig.IsExpectedStatus(code) {
+		return "", ""
+	}
+	switch {
+	case code == http.StatusProxyAuthRequired:
+		// An HTTP proxy rejected its credentials; the request never reached the target
+		return "error", "proxy_auth_error"
+	case len(proxyConfig.ExpectedStatus) > 0:
+		return "error", "unexpected_status"
+	}
+	return "error", httpErrorType(proxyConfig, code)
+}
+
+// httpErrorType returns the error type of a response with status code: http_ and the code,
+// or http_error with coarse_status_errors, leaving the code's class to the status_class label
+func httpErrorType(proxyConfig config.Proxy, code int) string {
+	if proxyConfig.CoarseStatusErrors {
+		return "http_error"
+	}
+	return "http_" + strconv.Itoa(code)
+}
+
+// DeriveState maps a check status (success, warning or error) to up, degraded or down.
+// Warnings are always degraded; a zero threshold disables latency-based degradation.
+func DeriveState(status string, duration, degradedThreshold time.Duration) int {
+	switch status {
+	case "error":
+		return StateDown
+	case "warning":
+		return StateDegraded
+	}
+	if degradedThreshold > 0 && duration > degradedThreshold {
+		return StateDegraded
+	}
+	return StateUp
+}
+
+// newClientTrace records httptrace phases as events on the check span
+func newClientTrace(span trace.Span) *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { span.AddEvent("dns_start") },
+		DNSDone:  func(httptrace.DNSDoneInfo) { span.AddEvent("dns_done") },
+		ConnectStart: func(network, addr string) {
+			span.AddEvent("connect_start", trace.WithAttributes(attribute.String("addr", addr)))
+		},
+		ConnectDone: func(network, addr string, err error) {
+			span.AddEvent("connect_done", trace.WithAttributes(attribute.String("addr", addr)))
+		},
+		TLSHandshakeStart: func() { span.AddEvent("tls_handshake_start") },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { span.AddEvent("tls_handshake_done") },
+		GotConn: func(info httptrace.GotConnInfo) {
+			span.AddEvent("got_conn", trace.WithAttributes(attribute.Bool("reused", info.Reused)))
+		},
+		GotFirstResponseByte: func() { span.AddEvent("first_response_byte") },
+	}
+}
+
+// timingTrace observes the phases of a request in their histograms: waiting for a connection
+// (including dialing), DNS resolution, TCP connect and TLS handshake of new connections, and
+// the time from the request being written to the first response byte. Phases that don't
+// happen, e.g. dialing for a reused connection, are not observed. Whether the connection was
+// reused is counted in connection_reuse_total.
+func timingTrace(m *metrics.Metrics, labelValues []string) *httptrace.ClientTrace {
+	// The dialer may run DNS and connect attempts in parallel goroutines
+	var mu sync.Mutex
+	var getConn, dnsStart, connectStart, tlsStart, wroteRequest time.Time
+	since := func(start *time.Time) (time.Duration, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if start.IsZero() {
+			return 0, false
+		}
+		return time.Since(*start), true
+	}
+	mark := func(start *time.Time) {
+		mu.Lock()
+		defer mu.Unlock()
+		*start = time.Now()
+	}
+	observe := func(histogram *prometheus.HistogramVec, start *time.Time) {
+		if d, ok := since(start); ok {
+			histogram.WithLabelValues(labelValues...).Observe(d.Seconds())
+		}
+	}
+
+	return &httptrace.ClientTrace{
+		GetConn: func(string) { mark(&getConn) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			observe(m.ConnWait, &getConn)
+			m.ConnectionReuse.WithLabelValues(append(labelValues, strconv.FormatBool(info.Reused))...).Inc()
+		},
+		DNSStart: func(httptrace.DNSStartInfo) { mark(&dnsStart) },
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			if info.Err == nil {
+				observe(m.DNSDuration, &dnsStart)
+			}
+		},
+		ConnectStart: func(string, string) { mark(&connectStart) },
+		ConnectDone: func(_, _ string, err error) {
+			if err == nil {
+				observe(m.ConnectDuration, &connectStart)
+			}
+		},
+		TLSHandshakeStart: func() { mark(&tlsStart) },
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				observe(m.TLSHandshakeDuration, &tlsStart)
+			}
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { mark(&wroteRequest) },
+		GotFirstResponseByte: func() { observe(m.TimeToFirstByte, &wroteRequest) },
+	}
+}
+
+// recordCertExpiry sets tls_cert_expiry_timestamp_seconds from the target's leaf certificate,
+// if it presented one
+func recordCertExpiry(m *metrics.Metrics, labelValues []string, targetURL string, state *tls.ConnectionState) {
+	if len(state.PeerCertificates) == 0 {
+		return
+	}
+	notAfter := state.PeerCertificates[0].NotAfter
+	m.CertExpiry.WithLabelValues(append(labelValues, targetURL)...).Set(float64(notAfter.Unix()))
+}
+
+// setSpanResult attaches the check outcome to the span
+func setSpanResult(span trace.Span, status, errorType string, err error) {
+	span.SetAttributes(
+		attribute.String("status", status),
+		attribute.String("error", errorType),
+	)
+	if status == "error" {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.SetStatus(codes.Error, errorType)
+	}
+}
+
+// isCertificateError reports whether err is a failed verification of the target's certificate,
+// e.g. expired, issued for another hostname or by an unknown authority
+func isCertificateError(err error) bool {
+	var verificationErr *tls.CertificateVerificationError
+	var invalidErr x509.CertificateInvalidError
+	var hostnameErr x509.HostnameError
+	var authorityErr x509.UnknownAuthorityError
+	return errors.As(err, &verificationErr) || errors.As(err, &invalidErr) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &authorityErr)
 }
 
-// CategorizeError categorizes errors into types for metrics
+// CategorizeError categorizes errors into types for metrics. Wrapped errors (e.g. *url.Error
+// from the client, *net.OpError from dialing) are matched by type first; the error text is
+// only inspected for errors that carry no type, such as those of some proxy dialers.
 func CategorizeError(err error) (errorType, httpStatusCode string) {
 	if err == nil {
 		return "", ""
 	}
 
-	errStr := err.Error()
-	errLower := strings.ToLower(errStr)
+	if errors.Is(err, ErrTooManyRedirects) {
+		return "too_many_redirects", ""
+	}
+	if errors.Is(err, ErrTargetNotAllowed) {
+		return "target_not_allowed", ""
+	}
+	if isCertificateError(err) {
+		return "tls_error", ""
+	}
+
+	errLower := strings.ToLower(err.Error())
+
+	// A proxy rejected its credentials: a 407 answer to CONNECT (net/http and the chain dialer
+	// report only the status text) or a failed SOCKS5 username/password negotiation
+	if strings.Contains(errLower, "proxy authentication required") ||
+		strings.Contains(errLower, "username/password authentication failed") {
+		return "proxy_auth_error", ""
+	}
+
+	// TLS alert sent by a server supporting none of the offered ALPN protocols; received
+	// alerts have no exported type
+	if strings.Contains(errLower, "no application protocol") {
+		return "alpn_mismatch", ""
+	}
 
-	// Check for timeout errors
-	if strings.Contains(errLower, "timeout") ||
-		strings.Contains(errLower, "deadline exceeded") ||
-		strings.Contains(errLower, "i/o timeout") {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) ||
+		(errors.As(err, &netErr) && netErr.Timeout()) {
 		return "timeout", ""
 	}
 
-	// Check for DNS errors
-	if strings.Contains(errLower, "no such host") ||
-		strings.Contains(errLower, "dns") ||
-		strings.Contains(errLower, "name resolution") {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
 		return "dns_error", ""
 	}
 
-	// Check for EOF errors (connection closed unexpectedly)
-	if err == io.EOF || strings.Contains(errLower, "eof") {
+	// Connection closed unexpectedly, refused, reset or unreachable
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ENETUNREACH) || errors.Is(err, syscall.EHOSTUNREACH) {
 		return "connection_error", ""
 	}
 
-	// Check for connection errors
-	if strings.Contains(errLower, "connection refused") ||
+	// Fall back to the error text for errors built without wrapping
+	switch {
+	case strings.Contains(errLower, "timeout") ||
+		strings.Contains(errLower, "deadline exceeded"):
+		return "timeout", ""
+	case strings.Contains(errLower, "no such host") ||
+		strings.Contains(errLower, "dns") ||
+		strings.Contains(errLower, "name resolution"):
+		return "dns_error", ""
+	case strings.Contains(errLower, "eof") ||
+		strings.Contains(errLower, "connection refused") ||
 		strings.Contains(errLower, "connection reset") ||
 		strings.Contains(errLower, "broken pipe") ||
-		strings.Contains(errLower, "network is unreachable") {
+		strings.Contains(errLower, "network is unreachable"):
 		return "connection_error", ""
 	}
 
-	// Check for URL errors (which might contain HTTP status codes)
-	if urlErr, ok := err.(*url.Error); ok {
-		if urlErr.Err != nil {
-			// Recursively check the underlying error
-			errType, _ := CategorizeError(urlErr.Err)
-			if errType != "" {
-				return errType, ""
-			}
-		}
-	}
-
-	// Default to connection_error for unknown network errors
-	if _, ok := err.(net.Error); ok {
+	// Default to connection_error for unknown network errors, including *url.Error
+	if errors.As(err, &netErr) {
 		return "connection_error", ""
 	}
 
 	// Unknown error type
 	return "unknown_error", ""
 }
-
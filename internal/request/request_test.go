@@ -1,11 +1,43 @@
 package request
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"log"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"eugene-chernyshenko/proxy-synthetic-check/internal/config"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/metrics"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/metrics/metricstest"
 )
 
 func TestCategorizeError_Timeout(t *testing.T) {
@@ -137,6 +169,86 @@ func TestCategorizeError_URLError(t *testing.T) {
 	}
 }
 
+func TestCategorizeError_Wrapped(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		wantType string
+	}{
+		{
+			name:     "wrapped context deadline",
+			err:      fmt.Errorf("second sample: %w", context.DeadlineExceeded),
+			wantType: "timeout",
+		},
+		{
+			name:     "deadline inside url.Error",
+			err:      &url.Error{Op: "Get", URL: "https://example.com", Err: &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}},
+			wantType: "timeout",
+		},
+		{
+			name:     "DNS error",
+			err:      &url.Error{Op: "Get", URL: "https://example.invalid", Err: &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "server misbehaving", Name: "example.invalid"}}},
+			wantType: "dns_error",
+		},
+		{
+			name:     "DNS timeout",
+			err:      &net.DNSError{Err: "lookup failed", Name: "example.com", IsTimeout: true},
+			wantType: "timeout",
+		},
+		{
+			name:     "connection refused",
+			err:      &url.Error{Op: "Get", URL: "http://127.0.0.1:1", Err: &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}},
+			wantType: "connection_error",
+		},
+		{
+			name:     "connection reset",
+			err:      fmt.Errorf("proxy chain hop 2: %w", &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}),
+			wantType: "connection_error",
+		},
+		{
+			name:     "unexpected EOF",
+			err:      fmt.Errorf("reading response: %w", io.ErrUnexpectedEOF),
+			wantType: "connection_error",
+		},
+		{
+			name:     "wrapped too many redirects",
+			err:      &url.Error{Op: "Get", URL: "http://example.com/loop", Err: ErrTooManyRedirects},
+			wantType: "too_many_redirects",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotType, _ := CategorizeError(tt.err)
+			if gotType != tt.wantType {
+				t.Errorf("CategorizeError(%v) errorType = %v, want %v", tt.err, gotType, tt.wantType)
+			}
+		})
+	}
+}
+
+func TestCategorizeError_TLSError(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "example.com"}, NotAfter: time.Now().Add(-time.Hour)}
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"expired", x509.CertificateInvalidError{Cert: cert, Reason: x509.Expired}},
+		{"hostname mismatch", x509.HostnameError{Certificate: cert, Host: "other.example.com"}},
+		{"unknown authority", x509.UnknownAuthorityError{Cert: cert}},
+		{"verification error", &tls.CertificateVerificationError{Err: errors.New("x509: certificate signed by unknown authority")}},
+		{"wrapped by the client", &url.Error{Op: "Get", URL: "https://example.com", Err: &tls.CertificateVerificationError{Err: x509.HostnameError{Certificate: cert, Host: "example.com"}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if gotType, _ := CategorizeError(tt.err); gotType != "tls_error" {
+				t.Errorf("CategorizeError(%v) errorType = %v, want tls_error", tt.err, gotType)
+			}
+		})
+	}
+}
+
 func TestCategorizeError_UnknownError(t *testing.T) {
 	err := &unknownError{msg: "some unknown error"}
 
@@ -205,3 +317,1111 @@ func TestCategorizeError_RealNetError(t *testing.T) {
 		}
 	}
 }
+
+// histogramCount returns the number of observations of a single histogram series
+func histogramCount(t *testing.T, observer prometheus.Observer) uint64 {
+	t.Helper()
+	var metric dto.Metric
+	if err := observer.(prometheus.Metric).Write(&metric); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func TestMake_RecordsSpan(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	defer otel.SetTracerProvider(prev)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	Make(context.Background(), metricstest.New(t), server.Client(), server.URL, "proxy_trace", config.Proxy{Protocol: "http"}, nil)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("exported spans = %d, want 1", len(spans))
+	}
+
+	attrs := make(map[attribute.Key]string)
+	for _, kv := range spans[0].Attributes {
+		attrs[kv.Key] = kv.Value.Emit()
+	}
+	want := map[attribute.Key]string{
+		"proxy_id":       "proxy_trace",
+		"proxy_protocol": "http",
+		"target":         server.URL,
+		"status":         "error",
+		"error":          "http_503",
+	}
+	for key, val := range want {
+		if attrs[key] != val {
+			t.Errorf("span attribute %s = %q, want %q", key, attrs[key], val)
+		}
+	}
+
+	events := make(map[string]bool)
+	for _, ev := range spans[0].Events {
+		events[ev.Name] = true
+	}
+	for _, name := range []string{"connect_start", "connect_done", "got_conn", "first_response_byte"} {
+		if !events[name] {
+			t.Errorf("span event %q missing, got %v", name, spans[0].Events)
+		}
+	}
+}
+
+func TestDeriveState(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    string
+		duration  time.Duration
+		threshold time.Duration
+		want      int
+	}{
+		{
+			name:      "fast success",
+			status:    "success",
+			duration:  100 * time.Millisecond,
+			threshold: 500 * time.Millisecond,
+			want:      StateUp,
+		},
+		{
+			name:      "slow success",
+			status:    "success",
+			duration:  800 * time.Millisecond,
+			threshold: 500 * time.Millisecond,
+			want:      StateDegraded,
+		},
+		{
+			name:      "slow success without threshold",
+			status:    "success",
+			duration:  10 * time.Second,
+			threshold: 0,
+			want:      StateUp,
+		},
+		{
+			name:      "fast warning",
+			status:    "warning",
+			duration:  10 * time.Millisecond,
+			threshold: 500 * time.Millisecond,
+			want:      StateDegraded,
+		},
+		{
+			name:      "fast failure",
+			status:    "error",
+			duration:  10 * time.Millisecond,
+			threshold: 500 * time.Millisecond,
+			want:      StateDown,
+		},
+		{
+			name:      "slow failure",
+			status:    "error",
+			duration:  time.Second,
+			threshold: 500 * time.Millisecond,
+			want:      StateDown,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := DeriveState(tt.status, tt.duration, tt.threshold)
+			if got != tt.want {
+				t.Errorf("DeriveState() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMake_SetsProxyState(t *testing.T) {
+	m := metricstest.New(t)
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	tests := []struct {
+		name        string
+		proxyID     string
+		server      *httptest.Server
+		proxyConfig config.Proxy
+		want        int
+	}{
+		{
+			name:        "up",
+			proxyID:     "proxy_state_up",
+			server:      slow,
+			proxyConfig: config.Proxy{Protocol: "http"},
+			want:        StateUp,
+		},
+		{
+			name:        "degraded",
+			proxyID:     "proxy_state_degraded",
+			server:      slow,
+			proxyConfig: config.Proxy{Protocol: "http", DegradedLatencyMs: 10},
+			want:        StateDegraded,
+		},
+		{
+			name:        "down",
+			proxyID:     "proxy_state_down",
+			server:      failing,
+			proxyConfig: config.Proxy{Protocol: "http", DegradedLatencyMs: 10},
+			want:        StateDown,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Make(context.Background(), m, tt.server.Client(), tt.server.URL, tt.proxyID, tt.proxyConfig, nil)
+
+			got := testutil.ToFloat64(m.ProxyState.WithLabelValues(tt.proxyID, "http"))
+			if got != float64(tt.want) {
+				t.Errorf("proxy_state = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeDuration(t *testing.T) {
+	m := metricstest.New(t)
+	limit := 20 * time.Second
+
+	tests := []struct {
+		name        string
+		proxyID     string
+		duration    time.Duration
+		want        time.Duration
+		wantAnomaly float64
+	}{
+		{
+			name:        "plausible duration",
+			proxyID:     "proxy_clamp_ok",
+			duration:    250 * time.Millisecond,
+			want:        250 * time.Millisecond,
+			wantAnomaly: 0,
+		},
+		{
+			name:        "negative duration",
+			proxyID:     "proxy_clamp_negative",
+			duration:    -3 * time.Second,
+			want:        0,
+			wantAnomaly: 1,
+		},
+		{
+			name:        "huge duration",
+			proxyID:     "proxy_clamp_huge",
+			duration:    72 * time.Hour,
+			want:        limit,
+			wantAnomaly: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			labelValues := []string{tt.proxyID, "http"}
+			got := sanitizeDuration(m, tt.duration, limit, tt.proxyID, labelValues)
+			if got != tt.want {
+				t.Errorf("sanitizeDuration() = %v, want %v", got, tt.want)
+			}
+
+			anomalies := testutil.ToFloat64(m.LatencyAnomalies.WithLabelValues(labelValues...))
+			if anomalies != tt.wantAnomaly {
+				t.Errorf("latency_anomaly_total = %v, want %v", anomalies, tt.wantAnomaly)
+			}
+		})
+	}
+}
+
+func TestSignRequest(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name          string
+		signing       config.HMACSigning
+		wantHeader    string
+		wantSignature string
+	}{
+		{
+			name:          "default sha256",
+			signing:       config.HMACSigning{Secret: "topsecret"},
+			wantHeader:    "X-Signature",
+			wantSignature: "2de2a08d9f1cc5bc85f1f7ab1410536edc0260d7951a25b51ff23a6e04c5d782",
+		},
+		{
+			name:          "sha512 with custom header",
+			signing:       config.HMACSigning{Secret: "topsecret", Header: "X-Api-Sig", Algorithm: "SHA512"},
+			wantHeader:    "X-Api-Sig",
+			wantSignature: "0b08aabd0d4e13bc86ee5f4da3962831d35485e51b11cc3685418766850b2c02b44798c7a68bd59b46b9e9aaee937b10ce53477cc0f203de00d38065f5fd2f30",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/health?x=1", nil)
+			if err := signRequest(req, &tt.signing, now); err != nil {
+				t.Fatalf("signRequest() error = %v", err)
+			}
+			if got := req.Header.Get(tt.wantHeader); got != tt.wantSignature {
+				t.Errorf("%s = %v, want %v", tt.wantHeader, got, tt.wantSignature)
+			}
+			if got := req.Header.Get("X-Timestamp"); got != "1700000000" {
+				t.Errorf("X-Timestamp = %v, want 1700000000", got)
+			}
+		})
+	}
+}
+
+func TestSignRequest_UnsupportedAlgorithm(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	err := signRequest(req, &config.HMACSigning{Secret: "topsecret", Algorithm: "md5"}, time.Now())
+	if err == nil {
+		t.Fatal("signRequest() error = nil, want unsupported algorithm error")
+	}
+	if strings.Contains(err.Error(), "topsecret") {
+		t.Errorf("signRequest() error = %v, must not contain the secret", err)
+	}
+}
+
+func TestMake_SignsRequest(t *testing.T) {
+	var gotSignature, gotTimestamp string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotSignature = r.Header.Get("X-Signature")
+		gotTimestamp = r.Header.Get("X-Timestamp")
+	}))
+	defer server.Close()
+
+	proxyConfig := config.Proxy{
+		Protocol:    "http",
+		HMACSigning: &config.HMACSigning{Secret: "topsecret"},
+	}
+	Make(context.Background(), metricstest.New(t), server.Client(), server.URL+"/health", "proxy_hmac", proxyConfig, nil)
+
+	mac := hmac.New(sha256.New, []byte("topsecret"))
+	mac.Write([]byte("/health" + gotTimestamp))
+	if want := hex.EncodeToString(mac.Sum(nil)); gotSignature != want {
+		t.Errorf("X-Signature = %v, want %v", gotSignature, want)
+	}
+}
+
+func TestPinTargetIP(t *testing.T) {
+	tests := []struct {
+		name     string
+		url      string
+		wantHost string
+		wantURL  string
+	}{
+		{
+			name:     "https default port",
+			url:      "https://example.com/health",
+			wantHost: "example.com",
+			wantURL:  "https://192.0.2.10:443/health",
+		},
+		{
+			name:     "http explicit port",
+			url:      "http://example.com:8080/health",
+			wantHost: "example.com:8080",
+			wantURL:  "http://192.0.2.10:8080/health",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			req.Host = ""
+			pinTargetIP(req, "192.0.2.10")
+			if req.Host != tt.wantHost {
+				t.Errorf("Host = %v, want %v", req.Host, tt.wantHost)
+			}
+			if req.URL.String() != tt.wantURL {
+				t.Errorf("URL = %v, want %v", req.URL.String(), tt.wantURL)
+			}
+		})
+	}
+}
+
+func TestMake_WarnStatusCodes(t *testing.T) {
+	m := metricstest.New(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	Make(context.Background(), m, server.Client(), server.URL, "proxy_warn", config.Proxy{Protocol: "http", WarnStatusCodes: []int{429}}, nil)
+	Make(context.Background(), m, server.Client(), server.URL, "proxy_no_warn", config.Proxy{Protocol: "http"}, nil)
+
+	if got := testutil.ToFloat64(m.RequestsTotal.WithLabelValues("proxy_warn", "http", "warning", "http_429", "4xx")); got != 1 {
+		t.Errorf("requests_total{status=warning,error=http_429} = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(m.ProxyState.WithLabelValues("proxy_warn", "http")); got != StateDegraded {
+		t.Errorf("proxy_state = %v, want %v", got, StateDegraded)
+	}
+	if got := testutil.ToFloat64(m.RequestsTotal.WithLabelValues("proxy_no_warn", "http", "error", "http_429", "4xx")); got != 1 {
+		t.Errorf("requests_total{status=error,error=http_429} = %v, want 1", got)
+	}
+}
+
+func TestMake_ExpectedStatus(t *testing.T) {
+	m := metricstest.New(t)
+	unauthorized := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer unauthorized.Close()
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer ok.Close()
+
+	result := Make(context.Background(), m, unauthorized.Client(), unauthorized.URL, "proxy_expect_401", config.Proxy{Protocol: "http", ExpectedStatus: []int{401}}, nil)
+	if result.Status != "success" {
+		t.Errorf("expected 401: result = %+v, want success", result)
+	}
+
+	result = Make(context.Background(), m, ok.Client(), ok.URL, "proxy_unexpected_200", config.Proxy{Protocol: "http", ExpectedStatus: []int{401}}, nil)
+	if result.Status != "error" || result.ErrorType != "unexpected_status" {
+		t.Errorf("unexpected 200: result = %+v, want error unexpected_status", result)
+	}
+	if got := testutil.ToFloat64(m.RequestsTotal.WithLabelValues("proxy_unexpected_200", "http", "error", "unexpected_status", "2xx")); got != 1 {
+		t.Errorf("requests_total{status=error,error=unexpected_status} = %v, want 1", got)
+	}
+}
+
+func TestMake_ProxyAuthError(t *testing.T) {
+	m := metricstest.New(t)
+	// An HTTP proxy rejecting the credentials of every request, CONNECT included
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="proxy"`)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	}))
+	defer proxyServer.Close()
+	proxyURL, err := url.Parse(proxyServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	// Plain HTTP targets get the proxy's 407 as the response
+	result := Make(context.Background(), m, client, "http://example.com/", "proxy_auth_http", config.Proxy{Protocol: "http"}, nil)
+	if result.Status != "error" || result.ErrorType != "proxy_auth_error" {
+		t.Errorf("HTTP target: result = %+v, want error proxy_auth_error", result)
+	}
+	if got := testutil.ToFloat64(m.RequestsTotal.WithLabelValues("proxy_auth_http", "http", "error", "proxy_auth_error", "4xx")); got != 1 {
+		t.Errorf("requests_total{error=proxy_auth_error,status_class=4xx} = %v, want 1", got)
+	}
+
+	// HTTPS targets fail the CONNECT with a *url.Error
+	result = Make(context.Background(), m, client, "https://example.com/", "proxy_auth_https", config.Proxy{Protocol: "http"}, nil)
+	if result.Status != "error" || result.ErrorType != "proxy_auth_error" {
+		t.Errorf("HTTPS target: result = %+v, want error proxy_auth_error", result)
+	}
+}
+
+func TestCategorizeError_ProxyAuthError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"CONNECT via net/http", &url.Error{Op: "Get", URL: "https://example.com", Err: errors.New("Proxy Authentication Required")}},
+		{"CONNECT via chain", errors.New("http connect: proxy responded 407 Proxy Authentication Required")},
+		{"SOCKS5", &net.OpError{Op: "socks connect", Net: "tcp", Err: errors.New("username/password authentication failed")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if gotType, _ := CategorizeError(tt.err); gotType != "proxy_auth_error" {
+				t.Errorf("CategorizeError(%v) errorType = %v, want proxy_auth_error", tt.err, gotType)
+			}
+		})
+	}
+}
+
+func TestMake_StatusClassLabel(t *testing.T) {
+	m := metricstest.New(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	Make(context.Background(), m, server.Client(), server.URL, "proxy_status_class_503", config.Proxy{Protocol: "http"}, nil)
+	result := Make(context.Background(), m, server.Client(), server.URL, "proxy_status_coarse", config.Proxy{Protocol: "http", CoarseStatusErrors: true}, nil)
+	if result.ErrorType != "http_error" {
+		t.Errorf("coarse_status_errors: result = %+v, want error type http_error", result)
+	}
+
+	if got := testutil.ToFloat64(m.RequestsTotal.WithLabelValues("proxy_status_class_503", "http", "error", "http_503", "5xx")); got != 1 {
+		t.Errorf("requests_total{error=http_503,status_class=5xx} = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(m.RequestsTotal.WithLabelValues("proxy_status_coarse", "http", "error", "http_error", "5xx")); got != 1 {
+		t.Errorf("requests_total{error=http_error,status_class=5xx} = %v, want 1", got)
+	}
+}
+
+func TestMake_MaxErrorCardinality(t *testing.T) {
+	m := metricstest.New(t)
+	m.SetMaxErrorCardinality(3)
+	t.Cleanup(func() { m.SetMaxErrorCardinality(0) })
+
+	code := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+	}))
+	defer server.Close()
+
+	proxyConfig := config.Proxy{Protocol: "http"}
+	for code = 500; code < 510; code++ {
+		result := Make(context.Background(), m, server.Client(), server.URL, "proxy_error_cardinality", proxyConfig, nil)
+		if want := fmt.Sprintf("http_%d", code); result.ErrorType != want {
+			t.Errorf("HTTP %d: result.ErrorType = %q, want %q", code, result.ErrorType, want)
+		}
+	}
+	// Values recorded before the limit was reached keep their series
+	code = 501
+	Make(context.Background(), m, server.Client(), server.URL, "proxy_error_cardinality", proxyConfig, nil)
+
+	for _, tt := range []struct {
+		error string
+		want  float64
+	}{
+		{"http_500", 1},
+		{"http_501", 2},
+		{"http_502", 1},
+		{"http_503", 0},
+		{metrics.OtherError, 7},
+	} {
+		if got := testutil.ToFloat64(m.RequestsTotal.WithLabelValues("proxy_error_cardinality", "http", "error", tt.error, "5xx")); got != tt.want {
+			t.Errorf("requests_total{error=%q} = %v, want %v", tt.error, got, tt.want)
+		}
+	}
+	// Forgetting the proxy starts over
+	m.DeleteProxy("proxy_error_cardinality")
+	code = 509
+	Make(context.Background(), m, server.Client(), server.URL, "proxy_error_cardinality", proxyConfig, nil)
+	if got := testutil.ToFloat64(m.RequestsTotal.WithLabelValues("proxy_error_cardinality", "http", "error", "http_509", "5xx")); got != 1 {
+		t.Errorf("after DeleteProxy: requests_total{error=http_509} = %v, want 1", got)
+	}
+}
+
+func TestStatusClass(t *testing.T) {
+	tests := []struct {
+		code int
+		want string
+	}{
+		{code: 0, want: ""},
+		{code: 200, want: "2xx"},
+		{code: 204, want: "2xx"},
+		{code: 301, want: "3xx"},
+		{code: 404, want: "4xx"},
+		{code: 503, want: "5xx"},
+		{code: 999, want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := StatusClass(tt.code); got != tt.want {
+			t.Errorf("StatusClass(%d) = %q, want %q", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestMake_DurationStatusClass(t *testing.T) {
+	m := metricstest.New(t)
+	code := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+	}))
+	defer server.Close()
+
+	proxyConfig := config.Proxy{Protocol: "http"}
+	Make(context.Background(), m, server.Client(), server.URL, "proxy_status_class", proxyConfig, nil)
+	code = http.StatusServiceUnavailable
+	Make(context.Background(), m, server.Client(), server.URL, "proxy_status_class", proxyConfig, nil)
+	Make(context.Background(), m, server.Client(), server.URL, "proxy_status_class", proxyConfig, nil)
+
+	if got := histogramCount(t, m.RequestDuration.WithLabelValues("proxy_status_class", "http", "2xx")); got != 1 {
+		t.Errorf("request_duration_seconds{status_class=2xx} count = %v, want 1", got)
+	}
+	if got := histogramCount(t, m.RequestDuration.WithLabelValues("proxy_status_class", "http", "5xx")); got != 2 {
+		t.Errorf("request_duration_seconds{status_class=5xx} count = %v, want 2", got)
+	}
+}
+
+func TestMake_TLSALPN(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{NextProtos: []string{"http/1.1"}}
+	server.StartTLS()
+	defer server.Close()
+
+	clientOffering := func(protos ...string) *http.Client {
+		client := server.Client()
+		transport := client.Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig.NextProtos = protos
+		client.Transport = transport
+		return client
+	}
+
+	m := metricstest.New(t)
+	tests := []struct {
+		name      string
+		offer     []string
+		wantALPN  string
+		wantError string
+	}{
+		{name: "negotiated", offer: []string{"http/1.1"}, wantALPN: "http/1.1"},
+		{name: "rejected by server", offer: []string{"h2"}, wantError: "alpn_mismatch"},
+		{name: "server picks a later offer", offer: []string{"h2", "http/1.1"}, wantALPN: "http/1.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyConfig := config.Proxy{Protocol: "http", TLSALPN: tt.offer}
+			result := Make(context.Background(), m, clientOffering(tt.offer...), server.URL, "proxy_alpn", proxyConfig, nil)
+			if result.ErrorType != tt.wantError {
+				t.Errorf("error type = %q, want %q", result.ErrorType, tt.wantError)
+			}
+			if result.ALPN != tt.wantALPN {
+				t.Errorf("ALPN = %q, want %q", result.ALPN, tt.wantALPN)
+			}
+		})
+	}
+
+	// Negotiated protocol outside the configured list
+	proxyConfig := config.Proxy{Protocol: "http", TLSALPN: []string{"h2"}}
+	result := Make(context.Background(), m, clientOffering("h2", "http/1.1"), server.URL, "proxy_alpn", proxyConfig, nil)
+	if result.ErrorType != "alpn_mismatch" {
+		t.Errorf("http/1.1 negotiated while requiring h2: error type = %q, want alpn_mismatch", result.ErrorType)
+	}
+}
+
+// compressedHandler answers body compressed with contentEncoding (gzip, br or none)
+func compressedHandler(contentEncoding, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var out io.Writer = w
+		switch contentEncoding {
+		case "gzip":
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			out = gz
+		case "br":
+			br := brotli.NewWriter(w)
+			defer br.Close()
+			out = br
+		}
+		if contentEncoding != "" {
+			w.Header().Set("Content-Encoding", contentEncoding)
+		}
+		io.WriteString(out, body)
+	}
+}
+
+func TestMake_RequireCompression(t *testing.T) {
+	var gotAcceptEncoding string
+	handler := func(contentEncoding string) http.HandlerFunc {
+		compressed := compressedHandler(contentEncoding, "body")
+		return func(w http.ResponseWriter, r *http.Request) {
+			gotAcceptEncoding = r.Header.Get("Accept-Encoding")
+			compressed(w, r)
+		}
+	}
+
+	m := metricstest.New(t)
+	proxyConfig := config.Proxy{Protocol: "http", RequireCompression: true}
+	tests := []struct {
+		name            string
+		contentEncoding string
+		wantError       string
+	}{
+		{name: "gzip", contentEncoding: "gzip"},
+		{name: "brotli", contentEncoding: "br"},
+		{name: "uncompressed", wantError: "compression_not_applied"},
+		{name: "identity", contentEncoding: "identity", wantError: "compression_not_applied"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(handler(tt.contentEncoding))
+			defer server.Close()
+
+			result := Make(context.Background(), m, server.Client(), server.URL, "proxy_compression", proxyConfig, nil)
+			if result.ErrorType != tt.wantError {
+				t.Errorf("error type = %q, want %q", result.ErrorType, tt.wantError)
+			}
+			if gotAcceptEncoding != "br, gzip" {
+				t.Errorf("Accept-Encoding = %q, want %q", gotAcceptEncoding, "br, gzip")
+			}
+		})
+	}
+}
+
+func TestMake_RequireCompressionDecodesBody(t *testing.T) {
+	m := metricstest.New(t)
+	proxyConfig := config.Proxy{
+		Protocol:           "http",
+		RequireCompression: true,
+		BodyContains:       `"status": "ok"`,
+		BodyRegex:          `"version": "\d+"`,
+		MonotonicField:     "requests",
+	}
+
+	for _, contentEncoding := range []string{"gzip", "br"} {
+		t.Run(contentEncoding, func(t *testing.T) {
+			var requests atomic.Int64
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body := fmt.Sprintf(`{"status": "ok", "version": "3", "requests": %d}`, requests.Add(1))
+				compressedHandler(contentEncoding, body)(w, r)
+			}))
+			defer server.Close()
+
+			result := Make(context.Background(), m, server.Client(), server.URL, "proxy_compressed_body", proxyConfig, nil)
+			if result.Status != "success" {
+				t.Errorf("status = %q (%s), want success on the decoded body", result.Status, result.ErrorType)
+			}
+		})
+	}
+
+	// A body that is not what Content-Encoding claims can't be inspected
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write([]byte(`{"status": "ok", "version": "3", "requests": 1}`))
+	}))
+	defer server.Close()
+	result := Make(context.Background(), m, server.Client(), server.URL, "proxy_compressed_body", proxyConfig, nil)
+	if result.ErrorType != "read_error" {
+		t.Errorf("invalid gzip body: error type = %q, want read_error", result.ErrorType)
+	}
+}
+
+func TestMake_EmptyBodyIsFailure(t *testing.T) {
+	empty := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer empty.Close()
+	nonEmpty := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer nonEmpty.Close()
+
+	m := metricstest.New(t)
+	proxyConfig := config.Proxy{Protocol: "http", EmptyBodyIsFailure: true}
+
+	result := Make(context.Background(), m, empty.Client(), empty.URL, "proxy_empty_body", proxyConfig, nil)
+	if result.Status != "error" || result.ErrorType != "empty_response" {
+		t.Errorf("empty body: result = %+v, want empty_response", result)
+	}
+	if got := testutil.ToFloat64(m.RequestsTotal.WithLabelValues("proxy_empty_body", "http", "error", "empty_response", "2xx")); got != 1 {
+		t.Errorf("requests_total{error=empty_response} = %v, want 1", got)
+	}
+
+	if result := Make(context.Background(), m, nonEmpty.Client(), nonEmpty.URL, "proxy_empty_body", proxyConfig, nil); result.Status != "success" {
+		t.Errorf("non-empty body: result = %+v, want success", result)
+	}
+	if result := Make(context.Background(), m, empty.Client(), empty.URL, "proxy_empty_body_allowed", config.Proxy{Protocol: "http"}, nil); result.Status != "success" {
+		t.Errorf("empty body without the option: result = %+v, want success", result)
+	}
+}
+
+func TestMake_Method(t *testing.T) {
+	var gotMethod string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethod = r.Method
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	m := metricstest.New(t)
+	for _, tt := range []struct{ method, want string }{
+		{"", http.MethodGet},
+		{"head", http.MethodHead},
+		{"POST", http.MethodPost},
+	} {
+		proxyConfig := config.Proxy{Protocol: "http", Method: tt.method, EmptyBodyIsFailure: true}
+		result := Make(context.Background(), m, server.Client(), server.URL, "proxy_method", proxyConfig, nil)
+		if gotMethod != tt.want {
+			t.Errorf("method %q: server got %s, want %s", tt.method, gotMethod, tt.want)
+		}
+		if result.Status != "success" {
+			t.Errorf("method %q: result = %+v, want success", tt.method, result)
+		}
+	}
+}
+
+func TestMake_Body(t *testing.T) {
+	var gotBody, gotType string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		gotBody, gotType = string(body), r.Header.Get("Content-Type")
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	m := metricstest.New(t)
+	for _, tt := range []struct {
+		body     string
+		headers  map[string]string
+		wantType string
+	}{
+		{body: `{"ping":true}`, wantType: "application/json"},
+		{body: "ping", wantType: "text/plain; charset=utf-8"},
+		{body: "a=1", headers: map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, wantType: "application/x-www-form-urlencoded"},
+	} {
+		proxyConfig := config.Proxy{Protocol: "http", Method: "POST", Body: tt.body, Headers: tt.headers}
+		result := Make(context.Background(), m, server.Client(), server.URL, "proxy_body", proxyConfig, nil)
+		if result.Status != "success" {
+			t.Errorf("body %q: result = %+v, want success", tt.body, result)
+		}
+		if gotBody != tt.body {
+			t.Errorf("server got body %q, want %q", gotBody, tt.body)
+		}
+		if gotType != tt.wantType {
+			t.Errorf("body %q: Content-Type = %q, want %q", tt.body, gotType, tt.wantType)
+		}
+	}
+}
+
+func TestMake_ConnWaitQueuesAtConnLimit(t *testing.T) {
+	const hold = 200 * time.Millisecond
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(hold)
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	// Two overlapping checks share one connection: the second waits for the first to finish
+	client := &http.Client{Transport: &http.Transport{MaxConnsPerHost: 1}}
+	m := metricstest.New(t)
+	proxyConfig := config.Proxy{Protocol: "http"}
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if result := Make(context.Background(), m, client, server.URL, "proxy_conn_wait", proxyConfig, nil); result.Status != "success" {
+				t.Errorf("result = %+v, want success", result)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var metric dto.Metric
+	if err := m.ConnWait.WithLabelValues("proxy_conn_wait", "http").(prometheus.Metric).Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	if got := metric.GetHistogram().GetSampleCount(); got != 2 {
+		t.Fatalf("conn_wait_seconds count = %d, want 2", got)
+	}
+	if got := metric.GetHistogram().GetSampleSum(); got < (hold / 2).Seconds() {
+		t.Errorf("conn_wait_seconds sum = %vs, want the queued check to wait about %v", got, hold)
+	}
+}
+
+func TestMake_TargetBasicAuth(t *testing.T) {
+	var gotUserinfo bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUserinfo = gotUserinfo || r.URL.User != nil
+		if user, password, ok := r.BasicAuth(); !ok || user != "monitor" || password != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+	withAuth := func(userinfo string) string {
+		return strings.Replace(server.URL, "http://", "http://"+userinfo+"@", 1)
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	m := metricstest.New(t)
+	if result := Make(context.Background(), m, server.Client(), withAuth("monitor:s3cret"), "proxy_target_auth", config.Proxy{Protocol: "http"}, nil); result.Status != "success" {
+		t.Errorf("result = %+v, want success with the URL's credentials", result)
+	}
+	if result := Make(context.Background(), m, server.Client(), withAuth("monitor:wrong"), "proxy_target_auth", config.Proxy{Protocol: "http"}, nil); result.ErrorType != "http_401" {
+		t.Errorf("wrong password: result = %+v, want http_401", result)
+	}
+	if gotUserinfo {
+		t.Error("request URL sent with userinfo")
+	}
+	if strings.Contains(logs.String(), "wrong") {
+		t.Errorf("log output contains the target password:\n%s", logs.String())
+	}
+}
+
+func TestMake_ExpectedSHA256(t *testing.T) {
+	// Larger than maxInspectedBody, so the hash must cover more than the inspected part
+	artifact := bytes.Repeat([]byte("artifact"), maxInspectedBody/4)
+	sum := sha256.Sum256(artifact)
+	corrupt := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := artifact
+		if corrupt {
+			body = append(bytes.Clone(artifact[:len(artifact)-1]), '!')
+		}
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	m := metricstest.New(t)
+	proxyConfig := config.Proxy{Protocol: "http", ExpectedSHA256: strings.ToUpper(hex.EncodeToString(sum[:]))}
+	if result := Make(context.Background(), m, server.Client(), server.URL, "proxy_checksum", proxyConfig, nil); result.Status != "success" {
+		t.Errorf("matching content: result = %+v, want success", result)
+	}
+
+	corrupt = true
+	result := Make(context.Background(), m, server.Client(), server.URL, "proxy_checksum", proxyConfig, nil)
+	if result.Status != "error" || result.ErrorType != "checksum_mismatch" {
+		t.Errorf("corrupted content: result = %+v, want error checksum_mismatch", result)
+	}
+	if got := testutil.ToFloat64(m.RequestsTotal.WithLabelValues("proxy_checksum", "http", "error", "checksum_mismatch", "2xx")); got != 1 {
+		t.Errorf("requests_total{error=checksum_mismatch} = %v, want 1", got)
+	}
+}
+
+func TestMake_BodyContains(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html>Service temporarily unavailable</html>"))
+	}))
+	defer server.Close()
+
+	m := metricstest.New(t)
+	result := Make(context.Background(), m, server.Client(), server.URL, "proxy_body_mismatch", config.Proxy{Protocol: "http", BodyContains: "status: ok"}, nil)
+	if result.Status != "error" || result.ErrorType != "body_mismatch" {
+		t.Errorf("result = %+v, want error body_mismatch", result)
+	}
+	if got := testutil.ToFloat64(m.RequestsTotal.WithLabelValues("proxy_body_mismatch", "http", "error", "body_mismatch", "2xx")); got != 1 {
+		t.Errorf("requests_total{status=error,error=body_mismatch} = %v, want 1", got)
+	}
+
+	result = Make(context.Background(), m, server.Client(), server.URL, "proxy_body_match", config.Proxy{Protocol: "http", BodyContains: "temporarily"}, nil)
+	if result.Status != "success" {
+		t.Errorf("result = %+v, want success when the body contains the marker", result)
+	}
+}
+
+func TestMake_BodyRegex(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status": "ok", "version": 3}`))
+	}))
+	defer server.Close()
+
+	m := metricstest.New(t)
+	for _, tt := range []struct {
+		proxyID, contains, regex string
+		wantErrorType            string
+	}{
+		{proxyID: "proxy_regex_match", regex: `"status":\s*"ok"`},
+		{proxyID: "proxy_regex_mismatch", regex: `"status":\s*"degraded"`, wantErrorType: "body_regex_mismatch"},
+		{proxyID: "proxy_regex_contains_first", contains: "missing", regex: `"status"`, wantErrorType: "body_mismatch"},
+	} {
+		proxyConfig := config.Proxy{Protocol: "http", BodyContains: tt.contains, BodyRegex: tt.regex}
+		result := Make(context.Background(), m, server.Client(), server.URL, tt.proxyID, proxyConfig, nil)
+		if result.ErrorType != tt.wantErrorType {
+			t.Errorf("%s: result = %+v, want error type %q", tt.proxyID, result, tt.wantErrorType)
+		}
+	}
+}
+
+func TestMake_ResponseSize(t *testing.T) {
+	const size = 1500
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", size)))
+	}))
+	defer server.Close()
+
+	m := metricstest.New(t)
+	Make(context.Background(), m, server.Client(), server.URL, "proxy_response_size", config.Proxy{Protocol: "http"}, nil)
+
+	var metric dto.Metric
+	if err := m.ResponseSize.WithLabelValues("proxy_response_size", "http").(prometheus.Metric).Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	if got := metric.GetHistogram().GetSampleCount(); got != 1 {
+		t.Fatalf("response_size_bytes count = %d, want 1", got)
+	}
+	if got := metric.GetHistogram().GetSampleSum(); got != size {
+		t.Errorf("response_size_bytes sum = %v, want %d", got, size)
+	}
+}
+
+func TestMake_PhaseTimings(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	// Dial by hostname so the DNS phase happens; the test certificate is valid for example.com
+	transport := server.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.ServerName = "example.com"
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	m := metricstest.New(t)
+	result := Make(context.Background(), m, &http.Client{Transport: transport}, "https://localhost:"+port, "proxy_phase_timings", config.Proxy{Protocol: "http"}, nil)
+	if result.Status != "success" {
+		t.Fatalf("result = %+v, want success", result)
+	}
+
+	for name, histogram := range map[string]*prometheus.HistogramVec{
+		"dns_duration_seconds":           m.DNSDuration,
+		"connect_duration_seconds":       m.ConnectDuration,
+		"tls_handshake_duration_seconds": m.TLSHandshakeDuration,
+		"time_to_first_byte_seconds":     m.TimeToFirstByte,
+	} {
+		var metric dto.Metric
+		if err := histogram.WithLabelValues("proxy_phase_timings", "http").(prometheus.Metric).Write(&metric); err != nil {
+			t.Fatal(err)
+		}
+		if got := metric.GetHistogram().GetSampleCount(); got < 1 {
+			t.Errorf("%s count = %d, want at least 1", name, got)
+		}
+	}
+}
+
+func TestMake_ConnectionReuse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	m := metricstest.New(t)
+	client := server.Client()
+	for range 2 {
+		if result := Make(context.Background(), m, client, server.URL, "proxy_conn_reuse", config.Proxy{Protocol: "http"}, nil); result.Status != "success" {
+			t.Fatalf("result = %+v, want success", result)
+		}
+	}
+
+	if got := testutil.ToFloat64(m.ConnectionReuse.WithLabelValues("proxy_conn_reuse", "http", "false")); got != 1 {
+		t.Errorf("connection_reuse_total{conn_reused=false} = %v, want 1 for the first request", got)
+	}
+	if got := testutil.ToFloat64(m.ConnectionReuse.WithLabelValues("proxy_conn_reuse", "http", "true")); got != 1 {
+		t.Errorf("connection_reuse_total{conn_reused=true} = %v, want 1 for the second request", got)
+	}
+}
+
+func TestMake_CertExpiry(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer plain.Close()
+
+	m := metricstest.New(t)
+	Make(context.Background(), m, server.Client(), server.URL, "proxy_cert_expiry", config.Proxy{Protocol: "http"}, nil)
+	want := float64(server.Certificate().NotAfter.Unix())
+	if got := testutil.ToFloat64(m.CertExpiry.WithLabelValues("proxy_cert_expiry", "http", server.URL)); got != want {
+		t.Errorf("tls_cert_expiry_timestamp_seconds = %v, want %v", got, want)
+	}
+
+	// Plain HTTP targets have no certificate
+	Make(context.Background(), m, plain.Client(), plain.URL, "proxy_cert_expiry_plain", config.Proxy{Protocol: "http"}, nil)
+	if n := m.CertExpiry.DeletePartialMatch(prometheus.Labels{"proxy_id": "proxy_cert_expiry_plain"}); n != 0 {
+		t.Errorf("tls_cert_expiry_timestamp_seconds series for plain HTTP = %d, want 0", n)
+	}
+}
+
+func TestMake_LastSuccessTimestamp(t *testing.T) {
+	code := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+	}))
+	defer server.Close()
+
+	m := metricstest.New(t)
+	before := float64(time.Now().Unix())
+	Make(context.Background(), m, server.Client(), server.URL, "proxy_last_success", config.Proxy{Protocol: "http"}, nil)
+	got := testutil.ToFloat64(m.LastSuccess.WithLabelValues("proxy_last_success", "http"))
+	if got < before || got > float64(time.Now().Unix()+1) {
+		t.Errorf("last_success_timestamp_seconds = %v, want the time of the check (%v)", got, before)
+	}
+
+	// A failure leaves the timestamp of the last success
+	code = http.StatusInternalServerError
+	m.LastSuccess.WithLabelValues("proxy_last_success", "http").Set(1)
+	Make(context.Background(), m, server.Client(), server.URL, "proxy_last_success", config.Proxy{Protocol: "http"}, nil)
+	if got := testutil.ToFloat64(m.LastSuccess.WithLabelValues("proxy_last_success", "http")); got != 1 {
+		t.Errorf("last_success_timestamp_seconds after a failure = %v, want it unchanged", got)
+	}
+}
+
+func TestMake_InFlightRequests(t *testing.T) {
+	arrived := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+	}))
+	defer server.Close()
+
+	m := metricstest.New(t)
+	inFlight := m.InFlight.WithLabelValues("proxy_in_flight", "http")
+	done := make(chan struct{})
+	for range 2 {
+		go func() {
+			Make(context.Background(), m, server.Client(), server.URL, "proxy_in_flight", config.Proxy{Protocol: "http"}, nil)
+			done <- struct{}{}
+		}()
+	}
+	<-arrived
+	<-arrived
+	if got := testutil.ToFloat64(inFlight); got != 2 {
+		t.Errorf("in_flight_requests while blocked = %v, want 2", got)
+	}
+
+	close(release)
+	<-done
+	<-done
+	if got := testutil.ToFloat64(inFlight); got != 0 {
+		t.Errorf("in_flight_requests after completion = %v, want 0", got)
+	}
+}
+
+func TestMake_ContextCanceled(t *testing.T) {
+	arrived := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(arrived)
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := server.Client()
+	client.Timeout = 30 * time.Second
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-arrived
+		cancel()
+	}()
+
+	m := metricstest.New(t)
+	start := time.Now()
+	result := Make(ctx, m, client, server.URL, "proxy_canceled", config.Proxy{Protocol: "http"}, nil)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Make() returned %v after cancellation, want promptly", elapsed)
+	}
+	if result != (CheckResult{}) {
+		t.Errorf("Make() = %+v, want a zero result", result)
+	}
+	for name, c := range map[string]prometheus.Collector{"requests_total": m.RequestsTotal, "request_duration_seconds": m.RequestDuration, "proxy_state": m.ProxyState} {
+		if n := testutil.CollectAndCount(c); n != 0 {
+			t.Errorf("%s series after a canceled check = %d, want 0", name, n)
+		}
+	}
+}
+
+func TestMake_DeadlineExceeded(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := server.Client()
+	client.Timeout = 100 * time.Millisecond
+	result := Make(context.Background(), metricstest.New(t), client, server.URL, "proxy_deadline", config.Proxy{Protocol: "http"}, nil)
+	if result.ErrorType != "timeout" {
+		t.Errorf("Make() ErrorType = %q, want timeout", result.ErrorType)
+	}
+}
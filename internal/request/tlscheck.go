@@ -0,0 +1,131 @@
+package request
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"slices"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/proxy"
+
+	"eugene-chernyshenko/proxy-synthetic-check/internal/config"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/metrics"
+)
+
+// TLSHandshake opens a connection to the target through dialer, performs a TLS handshake with
+// the target hostname as server name and closes the connection without sending any HTTP. The
+// latency covers dialing and the handshake; the handshake alone is observed in
+// tls_handshake_duration_seconds, and the certificate details are recorded on the span.
+// tls_alpn and require_ocsp_stapling are checked like for HTTP checks. The certificate is
+// verified as set in tlsConfig (root CAs, skipping verification), or against the system roots
+// when nil; its server name and protocols are always those of the target and proxy.
+func TLSHandshake(m *metrics.Metrics, dialer proxy.ContextDialer, tlsConfig *tls.Config, targetURL, proxyID string, proxyConfig config.Proxy, policy *TargetPolicy, timeout time.Duration) (result CheckResult) {
+	// Only HTTP checks send target credentials; keep them out of logs and spans
+	targetURL = config.MaskURL(targetURL)
+
+	ctx, span := otel.Tracer(tracerName).Start(context.Background(), "tls",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("proxy_id", proxyID),
+			attribute.String("proxy_protocol", proxyConfig.Protocol),
+			attribute.String("target", targetURL),
+		),
+	)
+	defer span.End()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	labelValues := m.ProxyLabelValues(proxyID, proxyConfig.Protocol, proxyConfig.MetricLabels())
+	start := time.Now()
+
+	var policyErr error
+	var state tls.ConnectionState
+	host, port, err := TargetAddr(targetURL)
+	if err == nil {
+		policyErr = policy.Check(ctx, host, proxyConfig.ConnectIP)
+		err = policyErr
+	}
+	if err == nil {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+		if err == nil {
+			handshakeStart := time.Now()
+			clientConfig := &tls.Config{}
+			if tlsConfig != nil {
+				clientConfig = tlsConfig.Clone()
+			}
+			clientConfig.ServerName = host
+			clientConfig.NextProtos = proxyConfig.TLSALPN
+			tlsConn := tls.Client(conn, clientConfig)
+			err = tlsConn.HandshakeContext(ctx)
+			if err == nil {
+				m.TLSHandshakeDuration.WithLabelValues(labelValues...).Observe(time.Since(handshakeStart).Seconds())
+				state = tlsConn.ConnectionState()
+			}
+			tlsConn.Close()
+		}
+	}
+	elapsed := time.Since(start)
+
+	limit := defaultMaxPlausibleLatency
+	if timeout > 0 {
+		limit = 2 * timeout
+	}
+	elapsed = sanitizeDuration(m, elapsed, limit, proxyID, labelValues)
+
+	record := func(status, errorType string, err error) {
+		result = CheckResult{Status: status, ErrorType: errorType, Duration: elapsed}
+		recordResult(m, span, proxyID, proxyConfig, result, err)
+	}
+
+	if policyErr != nil {
+		record("error", "target_not_allowed", policyErr)
+		log.Printf("[%s] Refusing TLS handshake with %s: %v", proxyID, targetURL, policyErr)
+		return
+	}
+	if err != nil {
+		errorType, _ := CategorizeError(err)
+		record("error", errorType, err)
+		log.Printf("[%s] TLS handshake with %s failed: %v", proxyID, targetURL, err)
+		return
+	}
+
+	span.SetAttributes(
+		attribute.String("tls.version", tls.VersionName(state.Version)),
+		attribute.String("tls.cipher", tls.CipherSuiteName(state.CipherSuite)),
+		attribute.String("tls.alpn", state.NegotiatedProtocol),
+	)
+	recordCertExpiry(m, labelValues, targetURL, &state)
+	if len(state.PeerCertificates) > 0 {
+		cert := state.PeerCertificates[0]
+		span.SetAttributes(
+			attribute.String("tls.cert.subject", cert.Subject.String()),
+			attribute.String("tls.cert.issuer", cert.Issuer.String()),
+			attribute.String("tls.cert.not_after", cert.NotAfter.UTC().Format(time.RFC3339)),
+		)
+	}
+
+	if len(proxyConfig.TLSALPN) > 0 && !slices.Contains(proxyConfig.TLSALPN, state.NegotiatedProtocol) {
+		record("error", "alpn_mismatch", nil)
+		log.Printf("[%s] Negotiated ALPN protocol %q with %s, want one of %v", proxyID, state.NegotiatedProtocol, targetURL, proxyConfig.TLSALPN)
+		return
+	}
+	if proxyConfig.RequireOCSPStapling {
+		if err := checkOCSPStaple(&state); err != nil {
+			record("error", "ocsp_missing", err)
+			log.Printf("[%s] Missing OCSP staple from %s: %v", proxyID, targetURL, err)
+			return
+		}
+	}
+
+	record("success", "", nil)
+	return
+}
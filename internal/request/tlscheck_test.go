@@ -0,0 +1,54 @@
+package request
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"eugene-chernyshenko/proxy-synthetic-check/internal/config"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/metrics/metricstest"
+	checkproxy "eugene-chernyshenko/proxy-synthetic-check/internal/proxy"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/proxy/proxytest"
+)
+
+func TestTLSHandshake_ThroughProxy(t *testing.T) {
+	var requests atomic.Int32
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+	}))
+	defer target.Close()
+	proxyServer := proxytest.NewConnectProxy(t)
+	dialer, err := checkproxy.CreateDialer("http", proxyServer.Listener.Addr().String(), checkproxy.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(target.Certificate())
+
+	m := metricstest.New(t)
+	result := TLSHandshake(m, dialer, &tls.Config{RootCAs: roots}, target.URL, "proxy_tls_only", config.Proxy{Protocol: "http"}, nil, 5*time.Second)
+	if result.Status != "success" || result.StatusCode != 0 {
+		t.Errorf("result = %+v, want success without status code", result)
+	}
+	if got := histogramCount(t, m.TLSHandshakeDuration.WithLabelValues("proxy_tls_only", "http")); got != 1 {
+		t.Errorf("tls_handshake_duration_seconds count = %v, want 1", got)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("target got %d HTTP requests, want none", n)
+	}
+
+	// The test certificate isn't trusted by the system roots
+	result = TLSHandshake(m, dialer, nil, target.URL, "proxy_tls_untrusted", config.Proxy{Protocol: "http"}, nil, 5*time.Second)
+	if result.Status != "error" || result.ErrorType != "tls_error" {
+		t.Errorf("untrusted certificate: result = %+v, want tls_error", result)
+	}
+	if got := testutil.ToFloat64(m.ProxyState.WithLabelValues("proxy_tls_untrusted", "http")); got != StateDown {
+		t.Errorf("proxy_state = %v, want %v", got, StateDown)
+	}
+}
@@ -0,0 +1,186 @@
+package request
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/proxy"
+
+	"eugene-chernyshenko/proxy-synthetic-check/internal/config"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/metrics"
+)
+
+// websocketGUID is appended to Sec-WebSocket-Key to derive Sec-WebSocket-Accept (RFC 6455)
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket performs a WebSocket opening handshake with the target through dialer and closes
+// the connection once the server accepted the upgrade, recording the handshake latency like
+// Make records a request. ws:// and http:// targets are plain, wss:// and https:// use TLS,
+// verified as set in tlsConfig like for TLSHandshake. A response other than 101 with a valid
+// Sec-WebSocket-Accept is a ws_upgrade_failed error.
+func WebSocket(m *metrics.Metrics, dialer proxy.ContextDialer, tlsConfig *tls.Config, targetURL, proxyID string, proxyConfig config.Proxy, policy *TargetPolicy, timeout time.Duration) (result CheckResult) {
+	// Only HTTP checks send target credentials; keep them out of logs and spans
+	targetURL = config.MaskURL(targetURL)
+
+	ctx, span := otel.Tracer(tracerName).Start(context.Background(), "websocket",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("proxy_id", proxyID),
+			attribute.String("proxy_protocol", proxyConfig.Protocol),
+			attribute.String("target", targetURL),
+		),
+	)
+	defer span.End()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+
+	var policyErr, upgradeErr error
+	statusCode := 0
+	host, port, err := TargetAddr(targetURL)
+	if err == nil {
+		policyErr = policy.Check(ctx, host, proxyConfig.ConnectIP)
+		err = policyErr
+	}
+	if err == nil {
+		statusCode, upgradeErr, err = websocketHandshake(ctx, dialer, tlsConfig, targetURL, net.JoinHostPort(host, port), proxyConfig)
+	}
+	elapsed := time.Since(start)
+
+	labelValues := m.ProxyLabelValues(proxyID, proxyConfig.Protocol, proxyConfig.MetricLabels())
+	limit := defaultMaxPlausibleLatency
+	if timeout > 0 {
+		limit = 2 * timeout
+	}
+	elapsed = sanitizeDuration(m, elapsed, limit, proxyID, labelValues)
+
+	record := func(status, errorType string, err error) {
+		result = CheckResult{Status: status, ErrorType: errorType, Duration: elapsed, StatusCode: statusCode}
+		recordResult(m, span, proxyID, proxyConfig, result, err)
+	}
+
+	if policyErr != nil {
+		record("error", "target_not_allowed", policyErr)
+		log.Printf("[%s] Refusing WebSocket upgrade to %s: %v", proxyID, targetURL, policyErr)
+		return
+	}
+	if err != nil {
+		errorType, _ := CategorizeError(err)
+		record("error", errorType, err)
+		log.Printf("[%s] Error connecting to %s: %v", proxyID, targetURL, err)
+		return
+	}
+	if upgradeErr != nil {
+		record("error", "ws_upgrade_failed", upgradeErr)
+		log.Printf("[%s] WebSocket upgrade to %s failed: %v", proxyID, targetURL, upgradeErr)
+		return
+	}
+
+	record("success", "", nil)
+	return
+}
+
+// websocketHandshake dials addr through dialer and sends the opening handshake for targetURL.
+// err reports connection failures; upgradeErr a response that doesn't accept the upgrade.
+func websocketHandshake(ctx context.Context, dialer proxy.ContextDialer, tlsConfig *tls.Config, targetURL, addr string, proxyConfig config.Proxy) (statusCode int, upgradeErr, err error) {
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return 0, nil, err
+	}
+	secure := u.Scheme == "wss" || u.Scheme == "https"
+
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if secure {
+		clientConfig := &tls.Config{}
+		if tlsConfig != nil {
+			clientConfig = tlsConfig.Clone()
+		}
+		clientConfig.ServerName = u.Hostname()
+		// The handshake is HTTP/1.1 only
+		clientConfig.NextProtos = []string{"http/1.1"}
+		tlsConn := tls.Client(conn, clientConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return 0, nil, err
+		}
+		conn = tlsConn
+	}
+
+	// The request is written to the connection directly, so the scheme only matters for TLS
+	handshakeURL := *u
+	handshakeURL.Scheme = "http"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, handshakeURL.String(), nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	key, err := websocketKey()
+	if err != nil {
+		return 0, nil, err
+	}
+	setHeaders(req, proxyConfig.Headers)
+	if proxyConfig.UserAgent != "" {
+		req.Header.Set("User-Agent", proxyConfig.UserAgent)
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(conn); err != nil {
+		return 0, nil, err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return 0, nil, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode != http.StatusSwitchingProtocols:
+		return resp.StatusCode, fmt.Errorf("HTTP %d, want 101", resp.StatusCode), nil
+	case !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket"):
+		return resp.StatusCode, fmt.Errorf("Upgrade header %q, want websocket", resp.Header.Get("Upgrade")), nil
+	case resp.Header.Get("Sec-WebSocket-Accept") != websocketAccept(key):
+		return resp.StatusCode, fmt.Errorf("Sec-WebSocket-Accept %q does not match the key", resp.Header.Get("Sec-WebSocket-Accept")), nil
+	}
+	return resp.StatusCode, nil, nil
+}
+
+// websocketKey returns a random base64 Sec-WebSocket-Key
+func websocketKey() (string, error) {
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(nonce[:]), nil
+}
+
+// websocketAccept returns the Sec-WebSocket-Accept value a server must answer key with
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
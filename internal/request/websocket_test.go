@@ -0,0 +1,131 @@
+package request
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"eugene-chernyshenko/proxy-synthetic-check/internal/config"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/metrics/metricstest"
+	checkproxy "eugene-chernyshenko/proxy-synthetic-check/internal/proxy"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/proxy/proxytest"
+)
+
+// websocketStub accepts WebSocket upgrades, answering with accept as Sec-WebSocket-Accept
+// (the correct value when empty)
+func websocketStub(t *testing.T, accept string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(websocketHandler(accept))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// websocketHandler accepts WebSocket upgrades like websocketStub
+func websocketHandler(accept string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || r.Header.Get("Sec-WebSocket-Version") != "13" {
+			http.Error(w, "not a WebSocket upgrade", http.StatusBadRequest)
+			return
+		}
+		answer := accept
+		if answer == "" {
+			answer = websocketAccept(r.Header.Get("Sec-WebSocket-Key"))
+		}
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + answer + "\r\n\r\n"))
+	}
+}
+
+func TestWebSocket_ThroughProxy(t *testing.T) {
+	stub := websocketStub(t, "")
+	proxyServer := proxytest.NewConnectProxy(t)
+	dialer, err := checkproxy.CreateDialer("http", proxyServer.Listener.Addr().String(), checkproxy.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := metricstest.New(t)
+	target := "ws://" + stub.Listener.Addr().String() + "/stream"
+	result := WebSocket(m, dialer, nil, target, "proxy_ws", config.Proxy{Protocol: "http"}, nil, 5*time.Second)
+	if result.Status != "success" || result.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("result = %+v, want success with status 101", result)
+	}
+	if got := testutil.ToFloat64(m.RequestsTotal.WithLabelValues("proxy_ws", "http", "success", "", "1xx")); got != 1 {
+		t.Errorf("requests_total{status=success} = %v, want 1", got)
+	}
+}
+
+func TestWebSocket_UpgradeFailed(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer plain.Close()
+	badAccept := websocketStub(t, "d3Jvbmc=")
+	proxyServer := proxytest.NewConnectProxy(t)
+	dialer, err := checkproxy.CreateDialer("http", proxyServer.Listener.Addr().String(), checkproxy.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := metricstest.New(t)
+	for _, target := range []string{plain.URL, badAccept.URL} {
+		result := WebSocket(m, dialer, nil, target, "proxy_ws_failed", config.Proxy{Protocol: "http"}, nil, 5*time.Second)
+		if result.Status != "error" || result.ErrorType != "ws_upgrade_failed" {
+			t.Errorf("%s: result = %+v, want ws_upgrade_failed", target, result)
+		}
+	}
+	for _, class := range []string{"2xx", "1xx"} {
+		if got := testutil.ToFloat64(m.RequestsTotal.WithLabelValues("proxy_ws_failed", "http", "error", "ws_upgrade_failed", class)); got != 1 {
+			t.Errorf("requests_total{error=ws_upgrade_failed,status_class=%s} = %v, want 1", class, got)
+		}
+	}
+}
+
+func TestWebSocket_SecureUsesTLSConfig(t *testing.T) {
+	stub := httptest.NewTLSServer(websocketHandler(""))
+	defer stub.Close()
+	proxyServer := proxytest.NewConnectProxy(t)
+	dialer, err := checkproxy.CreateDialer("http", proxyServer.Listener.Addr().String(), checkproxy.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(stub.Certificate())
+
+	m := metricstest.New(t)
+	target := "wss://" + stub.Listener.Addr().String() + "/stream"
+	tests := []struct {
+		name       string
+		tlsConfig  *tls.Config
+		wantStatus string
+	}{
+		{"system roots", nil, "error"},
+		{"root CAs", &tls.Config{RootCAs: roots}, "success"},
+		{"insecure", &tls.Config{InsecureSkipVerify: true}, "success"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := WebSocket(m, dialer, tt.tlsConfig, target, "proxy_wss", config.Proxy{Protocol: "http"}, nil, 5*time.Second)
+			if result.Status != tt.wantStatus {
+				t.Errorf("result = %+v, want status %s", result, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestWebSocketAccept(t *testing.T) {
+	// Example from RFC 6455 section 1.3
+	if got := websocketAccept("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("websocketAccept() = %q, want s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", got)
+	}
+}
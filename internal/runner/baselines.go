@@ -0,0 +1,68 @@
+package runner
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"eugene-chernyshenko/proxy-synthetic-check/internal/config"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/metrics"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/request"
+)
+
+// Baselines flags proxies whose successful checks are slower than their expected latency
+// times a factor. A nil *Baselines flags nothing.
+type Baselines struct {
+	baselines map[string]time.Duration // by proxy ID
+	factor    float64
+}
+
+// LoadBaselines reads a YAML (or JSON) file mapping proxy IDs to their baseline latency in
+// seconds, e.g. historical p50s
+func LoadBaselines(path string, factor float64) (*Baselines, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var seconds map[string]float64
+	if err := yaml.Unmarshal(data, &seconds); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	b := &Baselines{baselines: make(map[string]time.Duration, len(seconds)), factor: factor}
+	for proxyID, s := range seconds {
+		if s <= 0 {
+			return nil, fmt.Errorf("%s: baseline of %s must be positive, got %v", path, proxyID, s)
+		}
+		b.baselines[proxyID] = time.Duration(s * float64(time.Second))
+	}
+	return b, nil
+}
+
+// Len returns the number of proxies with a baseline
+func (b *Baselines) Len() int {
+	if b == nil {
+		return 0
+	}
+	return len(b.baselines)
+}
+
+// Check sets proxy_latency_regression for a successful check of proxyID: 1 when it took
+// longer than the baseline times the factor, 0 otherwise. Failed checks and proxies without
+// a baseline leave it unchanged.
+func (b *Baselines) Check(m *metrics.Metrics, proxyID string, proxyConfig config.Proxy, result request.CheckResult) {
+	if b == nil || result.Status != "success" {
+		return
+	}
+	baseline, ok := b.baselines[proxyID]
+	if !ok {
+		return
+	}
+	regression := 0.0
+	if result.Duration.Seconds() > baseline.Seconds()*b.factor {
+		regression = 1
+	}
+	labelValues := m.ProxyLabelValues(proxyID, proxyConfig.Protocol, proxyConfig.MetricLabels())
+	m.LatencyRegression.WithLabelValues(labelValues...).Set(regression)
+}
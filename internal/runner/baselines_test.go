@@ -0,0 +1,71 @@
+package runner
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"eugene-chernyshenko/proxy-synthetic-check/internal/config"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/metrics/metricstest"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/request"
+)
+
+func writeBaselines(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "baselines.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestBaselines_Check(t *testing.T) {
+	m := metricstest.New(t)
+	baselines, err := LoadBaselines(writeBaselines(t, "proxy_baseline: 0.1\n"), 2)
+	if err != nil {
+		t.Fatalf("LoadBaselines() error = %v", err)
+	}
+	if baselines.Len() != 1 {
+		t.Fatalf("Len() = %d, want 1", baselines.Len())
+	}
+
+	proxyConfig := config.Proxy{Protocol: "http"}
+	gauge := m.LatencyRegression.WithLabelValues("proxy_baseline", "http")
+	tests := []struct {
+		name   string
+		result request.CheckResult
+		want   float64
+	}{
+		{"below threshold", request.CheckResult{Status: "success", Duration: 150 * time.Millisecond}, 0},
+		{"above threshold", request.CheckResult{Status: "success", Duration: 300 * time.Millisecond}, 1},
+		{"failed check leaves it unchanged", request.CheckResult{Status: "error", ErrorType: "timeout", Duration: 50 * time.Millisecond}, 1},
+		{"back below threshold", request.CheckResult{Status: "success", Duration: 100 * time.Millisecond}, 0},
+	}
+	for _, tt := range tests {
+		baselines.Check(m, "proxy_baseline", proxyConfig, tt.result)
+		if got := testutil.ToFloat64(gauge); got != tt.want {
+			t.Errorf("%s: proxy_latency_regression = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Proxies without a baseline are never flagged
+	baselines.Check(m, "proxy_baseline_missing", proxyConfig, request.CheckResult{Status: "success", Duration: time.Minute})
+	if got := testutil.CollectAndCount(m.LatencyRegression, "proxy_latency_regression"); got != 1 {
+		t.Errorf("proxy_latency_regression series = %d, want 1", got)
+	}
+}
+
+func TestLoadBaselines_Invalid(t *testing.T) {
+	if _, err := LoadBaselines(writeBaselines(t, "proxy_zero: 0\n"), 2); err == nil {
+		t.Error("LoadBaselines() error = nil, want error for non-positive baseline")
+	}
+	if _, err := LoadBaselines(writeBaselines(t, "- not a map\n"), 2); err == nil {
+		t.Error("LoadBaselines() error = nil, want error for malformed file")
+	}
+	if _, err := LoadBaselines(filepath.Join(t.TempDir(), "missing.yaml"), 2); err == nil {
+		t.Error("LoadBaselines() error = nil, want error for missing file")
+	}
+}
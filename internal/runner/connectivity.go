@@ -0,0 +1,67 @@
+package runner
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Connectivity tracks whether the host itself has network access by periodically
+// dialing a well-known address directly (not through any proxy). While it is offline
+// runners skip their checks instead of recording failures for every proxy.
+// A nil *Connectivity always reports online.
+type Connectivity struct {
+	addr     string
+	interval time.Duration
+	timeout  time.Duration
+	dial     func(ctx context.Context, network, addr string) (net.Conn, error)
+	offline  atomic.Bool
+}
+
+// NewConnectivity creates a sentinel dialing addr (host:port) every interval
+func NewConnectivity(addr string, interval, timeout time.Duration) *Connectivity {
+	dialer := &net.Dialer{}
+	return &Connectivity{
+		addr:     addr,
+		interval: interval,
+		timeout:  timeout,
+		dial:     dialer.DialContext,
+	}
+}
+
+// Online reports the result of the most recent probe
+func (c *Connectivity) Online() bool {
+	return c == nil || !c.offline.Load()
+}
+
+// Run probes connectivity immediately and then every interval, forever
+func (c *Connectivity) Run() {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		c.probe()
+		<-ticker.C
+	}
+}
+
+// probe dials the sentinel address once and updates the state, logging transitions
+func (c *Connectivity) probe() {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	conn, err := c.dial(ctx, "tcp", c.addr)
+	if err == nil {
+		conn.Close()
+	}
+
+	wasOffline := c.offline.Swap(err != nil)
+	switch {
+	case err != nil && !wasOffline:
+		log.Printf("Host connectivity lost (dial %s: %v), suppressing proxy checks", c.addr, err)
+	case err == nil && wasOffline:
+		log.Printf("Host connectivity restored, resuming proxy checks")
+	}
+}
@@ -0,0 +1,73 @@
+package runner
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FirstSuccess tracks which proxies have had at least one successful check.
+// A nil *FirstSuccess ignores results.
+type FirstSuccess struct {
+	mu      sync.Mutex
+	pending map[string]bool // proxy IDs without a success yet
+	done    chan struct{}   // closed once pending is empty
+}
+
+// NewFirstSuccess creates a tracker waiting for every proxy in proxyIDs
+func NewFirstSuccess(proxyIDs []string) *FirstSuccess {
+	f := &FirstSuccess{
+		pending: make(map[string]bool, len(proxyIDs)),
+		done:    make(chan struct{}),
+	}
+	for _, id := range proxyIDs {
+		f.pending[id] = true
+	}
+	if len(f.pending) == 0 {
+		close(f.done)
+	}
+	return f
+}
+
+// Record notes the status of a check of proxyID
+func (f *FirstSuccess) Record(proxyID, status string) {
+	if f == nil || status != "success" {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.pending[proxyID] {
+		return
+	}
+	delete(f.pending, proxyID)
+	if len(f.pending) == 0 {
+		close(f.done)
+	}
+}
+
+// Wait blocks until every proxy has succeeded or timeout elapses. On timeout it
+// returns an error listing the proxies that never succeeded.
+func (f *FirstSuccess) Wait(timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-f.done:
+		return nil
+	case <-timer.C:
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.pending) == 0 {
+		return nil
+	}
+	var missing []string
+	for id := range f.pending {
+		missing = append(missing, id)
+	}
+	slices.Sort(missing)
+	return errors.New("no successful check within " + timeout.String() + " for: " + strings.Join(missing, ", "))
+}
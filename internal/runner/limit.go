@@ -0,0 +1,49 @@
+package runner
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// InFlightLimit caps the number of checks in flight, for one proxy or across all
+// proxies, as a safety net for the goroutine-per-tick model.
+// A nil *InFlightLimit is unlimited.
+type InFlightLimit struct {
+	max     int64
+	current atomic.Int64
+	running sync.WaitGroup // reserved slots, for wait
+}
+
+// NewInFlightLimit creates a limit allowing at most max concurrent checks
+func NewInFlightLimit(max int) *InFlightLimit {
+	return &InFlightLimit{max: int64(max)}
+}
+
+// acquire reserves a slot, reporting false when the limit is reached
+func (l *InFlightLimit) acquire() bool {
+	if l == nil {
+		return true
+	}
+	if l.current.Add(1) > l.max {
+		l.current.Add(-1)
+		return false
+	}
+	l.running.Add(1)
+	return true
+}
+
+// release frees a slot reserved by acquire
+func (l *InFlightLimit) release() {
+	if l != nil {
+		l.current.Add(-1)
+		l.running.Done()
+	}
+}
+
+// wait blocks until every slot reserved so far is released. It must not run concurrently
+// with acquire.
+func (l *InFlightLimit) wait() {
+	if l != nil {
+		l.running.Wait()
+	}
+}
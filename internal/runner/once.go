@@ -0,0 +1,39 @@
+package runner
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	"eugene-chernyshenko/proxy-synthetic-check/internal/config"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/metrics"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/request"
+)
+
+// OnceResult is the outcome of the single check of a proxy in RunOnce
+type OnceResult struct {
+	ProxyID     string
+	ProxyConfig config.Proxy
+	Result      request.CheckResult
+	Err         error // the proxy could not be checked (see Probe)
+}
+
+// RunOnce checks every proxy of cfg once, concurrently, instead of starting runners. The
+// checks are recorded in m and the results returned in the order of cfg.Proxies, with the
+// proxy IDs a Supervisor would assign.
+func RunOnce(ctx context.Context, m *metrics.Metrics, cfg *config.ProxyConfig, shared Shared) []OnceResult {
+	requestTimeout := cfg.GetRequestTimeout()
+	results := make([]OnceResult, len(cfg.Proxies))
+	var wg sync.WaitGroup
+	for i, proxyConfig := range cfg.Proxies {
+		results[i] = OnceResult{ProxyID: "proxy_" + strconv.Itoa(i+1), ProxyConfig: proxyConfig}
+		wg.Add(1)
+		go func(r *OnceResult) {
+			defer wg.Done()
+			targetURL := proxyConfig.GetTargetURL(cfg.DefaultTargetURL)
+			r.Result, r.Err = Probe(ctx, m, r.ProxyID, proxyConfig, targetURL, proxyConfig.GetRequestTimeout(requestTimeout), shared)
+		}(&results[i])
+	}
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,21 @@
+package runner
+
+import "sync/atomic"
+
+// Readiness tracks whether any proxy has completed a check since startup.
+// A nil *Readiness ignores checks.
+type Readiness struct {
+	checked atomic.Bool
+}
+
+// record notes a completed check
+func (r *Readiness) record() {
+	if r != nil {
+		r.checked.Store(true)
+	}
+}
+
+// Ready reports whether a check has completed
+func (r *Readiness) Ready() bool {
+	return r.checked.Load()
+}
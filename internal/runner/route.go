@@ -0,0 +1,109 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"eugene-chernyshenko/proxy-synthetic-check/internal/config"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/metrics"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/proxy"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/request"
+)
+
+// RunRoute checks the route name through hops (see config.ProxyConfig.RouteHops) every
+// interval until ctx is cancelled. Targets refused by policy (may be nil) are never dialed.
+func RunRoute(ctx context.Context, m *metrics.Metrics, name string, hops []config.Hop, targetURL string, interval, timeout time.Duration, policy *request.TargetPolicy) {
+	log.Printf("[route %s] Starting route runner (%d hops, target: %s, interval: %v)", name, len(hops), config.MaskURL(targetURL), interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		checkRoute(ctx, m, name, hops, targetURL, timeout, policy)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			log.Printf("[route %s] Stopping route runner", name)
+			return
+		}
+	}
+}
+
+// checkRoute dials, for every hop, the next hop (the target after the last one) through all
+// hops up to and including it, and records each hop and the route as up only if all succeeded.
+// A target refused by policy makes the last hop down without dialing.
+func checkRoute(ctx context.Context, m *metrics.Metrics, name string, hops []config.Hop, targetURL string, timeout time.Duration, policy *request.TargetPolicy) bool {
+	up := true
+	for i, hop := range hops {
+		next := config.MaskURL(targetURL)
+		var addr string
+		var err error
+		if i+1 < len(hops) {
+			next = proxy.MaskAuth(hops[i+1].Protocol, hops[i+1].Proxy)
+			addr, err = hopAddr(hops[i+1])
+		} else {
+			var host, port string
+			host, port, err = request.TargetAddr(targetURL)
+			if err == nil {
+				err = policy.Check(ctx, host, "")
+				addr = net.JoinHostPort(host, port)
+			}
+		}
+		if err == nil {
+			err = dialThrough(ctx, hops[:i+1], addr, timeout)
+		}
+
+		hopUp := 1.0
+		if err != nil {
+			hopUp = 0
+			up = false
+			log.Printf("[route %s] Hop %d (%s) can't reach %s: %v", name, i+1, proxy.MaskAuth(hop.Protocol, hop.Proxy), next, err)
+		}
+		m.RouteHopUp.WithLabelValues(name, strconv.Itoa(i+1)).Set(hopUp)
+	}
+
+	routeUp := 0.0
+	if up {
+		routeUp = 1
+	}
+	m.RouteUp.WithLabelValues(name).Set(routeUp)
+	return up
+}
+
+// dialThrough opens a TCP connection to addr through hops, in order, and closes it right away
+func dialThrough(ctx context.Context, hops []config.Hop, addr string, timeout time.Duration) error {
+	var opts proxy.Options
+	for _, hop := range hops[1:] {
+		opts.Chain = append(opts.Chain, proxy.Hop{Protocol: hop.Protocol, Proxy: hop.Proxy})
+	}
+	dialer, err := proxy.CreateDialer(hops[0].Protocol, hops[0].Proxy, opts)
+	if err != nil {
+		return err
+	}
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// hopAddr returns the host:port of a hop without credentials
+func hopAddr(hop config.Hop) (string, error) {
+	u, err := proxy.ParseURL(hop.Protocol, hop.Proxy)
+	if err != nil {
+		return "", err
+	}
+	if u.Port() == "" {
+		return "", fmt.Errorf("proxy address %s has no port", u.Host)
+	}
+	return u.Host, nil
+}
@@ -0,0 +1,99 @@
+package runner
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"eugene-chernyshenko/proxy-synthetic-check/internal/config"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/metrics/metricstest"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/proxy/proxytest"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/request"
+)
+
+func TestCheckRoute(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+	entry, egress := proxytest.NewConnectProxy(t), proxytest.NewConnectProxy(t)
+
+	m := metricstest.New(t)
+	hops := []config.Hop{
+		{Protocol: "http", Proxy: entry.Listener.Addr().String()},
+		{Protocol: "http", Proxy: egress.Listener.Addr().String()},
+	}
+	if !checkRoute(context.Background(), m, "route_up", hops, target.URL, 5*time.Second, nil) {
+		t.Error("checkRoute() = false, want true with both hops forwarding")
+	}
+	if got := testutil.ToFloat64(m.RouteUp.WithLabelValues("route_up")); got != 1 {
+		t.Errorf("route_up = %v, want 1", got)
+	}
+
+	// The egress hop is down: the entry hop can't reach it, and nothing reaches the target
+	stopped := proxytest.NewConnectProxy(t)
+	stopped.Close()
+	down := []config.Hop{
+		{Protocol: "http", Proxy: entry.Listener.Addr().String()},
+		{Protocol: "http", Proxy: stopped.Listener.Addr().String()},
+	}
+	if checkRoute(context.Background(), m, "route_down", down, target.URL, 5*time.Second, nil) {
+		t.Error("checkRoute() = true, want false with the egress hop down")
+	}
+	if got := testutil.ToFloat64(m.RouteUp.WithLabelValues("route_down")); got != 0 {
+		t.Errorf("route_up = %v, want 0", got)
+	}
+	if got := testutil.ToFloat64(m.RouteHopUp.WithLabelValues("route_down", "1")); got != 0 {
+		t.Errorf("route_hop_up{hop=1} = %v, want 0", got)
+	}
+	if got := testutil.ToFloat64(m.RouteHopUp.WithLabelValues("route_down", "2")); got != 0 {
+		t.Errorf("route_hop_up{hop=2} = %v, want 0", got)
+	}
+
+	// Both hops are up but the last one can't reach the target
+	target.Close()
+	if checkRoute(context.Background(), m, "route_no_target", hops, target.URL, 5*time.Second, nil) {
+		t.Error("checkRoute() = true, want false with the target down")
+	}
+	if got := testutil.ToFloat64(m.RouteHopUp.WithLabelValues("route_no_target", "1")); got != 1 {
+		t.Errorf("route_hop_up{hop=1} = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(m.RouteHopUp.WithLabelValues("route_no_target", "2")); got != 0 {
+		t.Errorf("route_hop_up{hop=2} = %v, want 0", got)
+	}
+}
+
+func TestCheckRoute_TargetNotAllowed(t *testing.T) {
+	var dialed atomic.Bool
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	target.Config.ConnState = func(net.Conn, http.ConnState) { dialed.Store(true) }
+	target.Start()
+	defer target.Close()
+	entry, egress := proxytest.NewConnectProxy(t), proxytest.NewConnectProxy(t)
+	hops := []config.Hop{
+		{Protocol: "http", Proxy: entry.Listener.Addr().String()},
+		{Protocol: "http", Proxy: egress.Listener.Addr().String()},
+	}
+	policy, err := request.NewTargetPolicy([]string{"example.com"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := metricstest.New(t)
+	if checkRoute(context.Background(), m, "route_refused", hops, target.URL, 5*time.Second, policy) {
+		t.Error("checkRoute() = true, want false with the target outside allowed_target_hosts")
+	}
+	if got := testutil.ToFloat64(m.RouteHopUp.WithLabelValues("route_refused", "1")); got != 1 {
+		t.Errorf("route_hop_up{hop=1} = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(m.RouteHopUp.WithLabelValues("route_refused", "2")); got != 0 {
+		t.Errorf("route_hop_up{hop=2} = %v, want 0", got)
+	}
+	if dialed.Load() {
+		t.Error("refused target was dialed")
+	}
+}
@@ -1,41 +1,474 @@
 package runner
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"log"
+	"math/rand/v2"
 	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	xproxy "golang.org/x/net/proxy"
+
 	"eugene-chernyshenko/proxy-synthetic-check/internal/config"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/history"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/kafka"
 	"eugene-chernyshenko/proxy-synthetic-check/internal/metrics"
 	"eugene-chernyshenko/proxy-synthetic-check/internal/proxy"
 	"eugene-chernyshenko/proxy-synthetic-check/internal/request"
 )
 
-// Run starts a proxy runner that sends requests at specified interval
-func Run(m *metrics.Metrics, proxyID string, proxyConfig config.Proxy, targetURL string, requestInterval, requestTimeout time.Duration) {
-	// Create transport for this proxy
-	transport, err := proxy.CreateTransport(proxyConfig.Protocol, proxyConfig.Proxy)
+// Shared holds process-wide state used by all runners. Nil fields are disabled.
+type Shared struct {
+	Connectivity *Connectivity         // skip checks while the host is offline
+	InFlight     *InFlightLimit        // shed checks above a global in-flight cap
+	History      *history.Writer       // persist every check result
+	Kafka        *kafka.Sink           // publish every check result
+	Baselines    *Baselines            // flag checks slower than the proxy's baseline
+	TargetPolicy *request.TargetPolicy // refuse targets outside the allowlist
+	FirstSuccess *FirstSuccess         // track the first successful check of each proxy
+	Readiness    *Readiness            // track whether any check has completed
+	Verify       *FirstSuccess         // track the first successful check of proxies started by a verified reload
+
+	RootCAs            *x509.CertPool // verify targets against the global ca_file instead of the system roots
+	InsecureSkipVerify bool           // accept any target certificate for all proxies
+}
+
+// Run starts a proxy runner that sends requests at specified interval until ctx is cancelled.
+// It returns once the checks in flight at that point have finished.
+// A non-zero jitter randomizes the first check and every interval by up to ±jitter.
+func Run(ctx context.Context, m *metrics.Metrics, proxyID string, proxyConfig config.Proxy, targetURL string, requestInterval, requestTimeout, jitter time.Duration, shared Shared) {
+	// A misconfigured proxy stops only its own runner, not the checks of all the others
+	initFailed := func(format string, args ...any) {
+		log.Printf("[%s] "+format+"; not checking this proxy", append([]any{proxyID}, args...)...)
+		m.ProxyInitErrors.WithLabelValues(m.ProxyLabelValues(proxyID, proxyConfig.Protocol, proxyConfig.MetricLabels())...).Inc()
+	}
+
+	// Setting up a proxy may fail while it isn't reachable yet, e.g. still starting up;
+	// a configuration error fails for good
+	retrying := func(what string, create func() error) error {
+		err := retryInit(ctx, defaultInitBackoff, create, func(err error, wait time.Duration) {
+			log.Printf("[%s] Error creating proxy %s: %v; retrying in %v", proxyID, what, err, wait)
+			m.ProxyInitErrors.WithLabelValues(m.ProxyLabelValues(proxyID, proxyConfig.Protocol, proxyConfig.MetricLabels())...).Inc()
+		})
+		if err != nil && ctx.Err() == nil {
+			return fmt.Errorf("creating proxy %s: %w", what, err)
+		}
+		return err
+	}
+	checkOnce, closeCheck, err := buildCheck(ctx, m, proxyID, proxyConfig, targetURL, requestTimeout, shared, retrying)
+	if err != nil {
+		if ctx.Err() == nil {
+			initFailed("Error setting up checks: %v", err)
+		}
+		return
+	}
+	defer closeCheck()
+
+	log.Printf("[%s] Starting proxy runner (protocol: %s, proxy: %s, interval: %v)", proxyID, proxyConfig.Protocol, proxy.MaskAuth(proxyConfig.Protocol, proxyConfig.Proxy), requestInterval)
+	for i, hop := range proxyConfig.Chain {
+		log.Printf("[%s] Chain hop %d: %s %s", proxyID, i+2, hop.Protocol, proxy.MaskAuth(hop.Protocol, hop.Proxy))
+	}
+	if len(proxyConfig.Headers) > 0 {
+		log.Printf("[%s] Request headers: %s", proxyID, request.MaskHeaders(proxyConfig.Headers))
+	}
+	if proxyConfig.Description != "" || proxyConfig.Owner != "" {
+		log.Printf("[%s] Description: %q, owner: %q", proxyID, proxyConfig.Description, proxyConfig.Owner)
+	}
+	switch {
+	case len(proxyConfig.CompareTargets) > 0:
+		log.Printf("[%s] Comparing targets %s and %s", proxyID, config.MaskURL(proxyConfig.CompareTargets[0]), config.MaskURL(proxyConfig.CompareTargets[1]))
+	case proxyConfig.WebSocket:
+		log.Printf("[%s] Checking WebSocket upgrade", proxyID)
+	case proxyConfig.TLSOnly:
+		log.Printf("[%s] Checking TLS handshake only", proxyID)
+	case proxyConfig.ConnectOnly:
+		log.Printf("[%s] Checking TCP connect only", proxyID)
+	}
+
+	check := func() {
+		results := checkOnce()
+		if results == nil {
+			// The runner is stopping; an aborted check has no result to pass on
+			return
+		}
+		status := "success"
+		for _, result := range results {
+			shared.History.Add(proxyID, result)
+			shared.Kafka.Add(proxyID, result)
+			if result.Status != "success" {
+				status = result.Status
+			}
+		}
+		shared.FirstSuccess.Record(proxyID, status)
+		shared.Verify.Record(proxyID, status)
+		if len(results) == 1 {
+			// The two compare_targets latencies have no baseline of their own
+			shared.Baselines.Check(m, proxyID, proxyConfig, results[0])
+		}
+	}
+
+	schedule, err := proxyConfig.CronSchedule()
+	if err != nil {
+		initFailed("Error parsing cron: %v", err)
+		return
+	}
+	if schedule != nil {
+		log.Printf("[%s] Checking on cron schedule %q", proxyID, proxyConfig.Cron)
+	}
+
+	rng := rand.New(rand.NewPCG(uint64(time.Now().UnixNano()), 0))
+
+	// Delay the very first check so proxies (and replicas) restarted together don't synchronize.
+	// Cron schedules fire at fixed times on purpose.
+	if spread := proxyConfig.GetInitialSpread(); spread > 0 && schedule == nil {
+		delay := initialDelay(rng, spread)
+		log.Printf("[%s] Delaying first check by %v", proxyID, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	inFlight := NewInFlightLimit(proxyConfig.GetMaxInFlight())
+	// Checks still running when ctx is canceled must not record anything after Run returns,
+	// when the supervisor may already have deleted the proxy's metrics
+	defer inFlight.wait()
+
+	// Send the first request immediately (or within jitter), then every interval (±jitter).
+	// Fire times are computed from the previous one, not from when the check finished.
+	next := time.Now().Add(firstOffset(rng, jitter))
+	advance := func() {
+		next = next.Add(nextInterval(rng, requestInterval, jitter))
+		if now := time.Now(); next.Before(now) {
+			// Fell behind (e.g. the host was suspended): don't fire a burst to catch up
+			next = now
+		}
+	}
+	if schedule != nil {
+		// Missed fire times (e.g. while the host was suspended) are skipped, not caught up on
+		next = schedule.Next(time.Now())
+		advance = func() { next = schedule.Next(time.Now()) }
+	}
+	timer := time.NewTimer(time.Until(next))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			dispatch(m, proxyID, proxyConfig, shared, inFlight, check)
+			advance()
+			timer.Reset(time.Until(next))
+		case <-ctx.Done():
+			log.Printf("[%s] Stopping proxy runner", proxyID)
+			return
+		}
+	}
+}
+
+// transportOptions returns the options of the transport and dialers checking proxyConfig
+// against targetURL. It fails only when the proxy's ca_file can't be loaded.
+func transportOptions(proxyConfig config.Proxy, targetURL string, shared Shared) (proxy.Options, error) {
+	opts := proxy.Options{
+		StrictSOCKS5Auth: proxyConfig.StrictSOCKS5Auth,
+		ConnectIP:        proxyConfig.ConnectIP,
+		TLSALPN:          proxyConfig.TLSALPN,
+		MaxConns:         proxyConfig.MaxConnsPerProxy,
+
+		MaxIdleConns:        proxyConfig.MaxIdleConns,
+		MaxIdleConnsPerHost: proxyConfig.MaxIdleConnsPerHost,
+		IdleConnTimeout:     proxyConfig.GetIdleConnTimeout(),
+		DisableKeepAlives:   proxyConfig.DisableKeepAlives,
+		DialTimeout:         proxyConfig.GetDialTimeout(),
+
+		RootCAs:            shared.RootCAs,
+		InsecureSkipVerify: proxyConfig.InsecureSkipVerify || shared.InsecureSkipVerify,
+	}
+	if proxyConfig.CAFile != "" {
+		pool, err := proxy.LoadCertPool(proxyConfig.CAFile)
+		if err != nil {
+			return opts, err
+		}
+		opts.RootCAs = pool
+	}
+	for _, hop := range proxyConfig.Chain {
+		opts.Chain = append(opts.Chain, proxy.Hop{Protocol: hop.Protocol, Proxy: hop.Proxy})
+	}
+	if proxyConfig.ConnectIP != "" && strings.ToLower(proxyConfig.Protocol) == "http" {
+		// HTTP proxies connect to the host in the request URL, which request.Make
+		// rewrites to connect_ip, so the original hostname has to be pinned for TLS
+		if u, err := url.Parse(targetURL); err == nil {
+			opts.TLSServerName = u.Hostname()
+		}
+	}
+	return opts, nil
+}
+
+// Probe runs a single check of proxyConfig against targetURL the way Run does and returns its
+// result. The check is recorded in m only, not passed on to shared's history, Kafka sink or
+// trackers. With compare_targets both targets are checked and the result is the first that
+// didn't succeed, else the first target's. Canceling ctx aborts HTTP checks. It fails when the
+// proxy's transport can't be set up.
+func Probe(ctx context.Context, m *metrics.Metrics, proxyID string, proxyConfig config.Proxy, targetURL string, requestTimeout time.Duration, shared Shared) (request.CheckResult, error) {
+	check, closeCheck, err := buildCheck(ctx, m, proxyID, proxyConfig, targetURL, requestTimeout, shared, func(what string, create func() error) error {
+		if err := create(); err != nil {
+			return fmt.Errorf("creating proxy %s: %w", what, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return request.CheckResult{}, err
+	}
+	defer closeCheck()
+
+	results := check()
+	if results == nil {
+		return request.CheckResult{}, ctx.Err()
+	}
+	for _, result := range results {
+		if result.Status != "success" {
+			return result, nil
+		}
+	}
+	return results[0], nil
+}
+
+// buildCheck sets up what proxyConfig is checked through, an HTTP client or, for connect_only,
+// tls_only and websocket, a dialer, and returns a check of targetURL (or of compare_targets)
+// recorded in m, and a function releasing the setup. Every proxy setup step runs through
+// setup, which may retry it; its error is returned as is. check returns the result of each
+// target checked, or nil when ctx was canceled during the check.
+func buildCheck(ctx context.Context, m *metrics.Metrics, proxyID string, proxyConfig config.Proxy, targetURL string, requestTimeout time.Duration, shared Shared, setup func(what string, create func() error) error) (check func() []request.CheckResult, closeCheck func(), err error) {
+	opts, err := transportOptions(proxyConfig, targetURL, shared)
 	if err != nil {
-		log.Fatalf("[%s] Error creating proxy transport: %v", proxyID, err)
+		return nil, nil, fmt.Errorf("loading ca_file: %w", err)
 	}
 
+	if proxyConfig.ConnectOnly || proxyConfig.TLSOnly || proxyConfig.WebSocket {
+		var dialer xproxy.ContextDialer
+		if err := setup("dialer", func() (err error) {
+			dialer, err = proxy.CreateDialer(proxyConfig.Protocol, proxyConfig.Proxy, opts)
+			return err
+		}); err != nil {
+			return nil, nil, err
+		}
+		tlsConfig := &tls.Config{RootCAs: opts.RootCAs, InsecureSkipVerify: opts.InsecureSkipVerify}
+		check = func() []request.CheckResult {
+			var result request.CheckResult
+			switch {
+			case proxyConfig.WebSocket:
+				result = request.WebSocket(m, dialer, tlsConfig, targetURL, proxyID, proxyConfig, shared.TargetPolicy, requestTimeout)
+			case proxyConfig.TLSOnly:
+				result = request.TLSHandshake(m, dialer, tlsConfig, targetURL, proxyID, proxyConfig, shared.TargetPolicy, requestTimeout)
+			default:
+				result = request.Connect(m, dialer, targetURL, proxyID, proxyConfig, shared.TargetPolicy, requestTimeout)
+			}
+			return []request.CheckResult{result}
+		}
+		return check, func() {}, nil
+	}
+
+	if n := len(proxyConfig.CompareTargets); n > 0 && n != 2 {
+		return nil, nil, fmt.Errorf("compare_targets must contain exactly two URLs, got %d", n)
+	}
+	var transport *http.Transport
+	if err := setup("transport", func() (err error) {
+		transport, err = proxy.CreateTransport(proxyConfig.Protocol, proxyConfig.Proxy, opts)
+		return err
+	}); err != nil {
+		return nil, nil, err
+	}
 	client := &http.Client{
-		Transport: transport,
-		Timeout:   requestTimeout,
+		Transport:     transport,
+		Timeout:       requestTimeout,
+		CheckRedirect: checkRedirect(m, proxyID, proxyConfig, shared.TargetPolicy),
+	}
+
+	if len(proxyConfig.CompareTargets) > 0 {
+		check = func() []request.CheckResult {
+			return compareTargets(ctx, m, client, proxyID, proxyConfig, shared.TargetPolicy)
+		}
+		return check, transport.CloseIdleConnections, nil
 	}
+	userAgents := &rotation{items: proxyConfig.UserAgentRotation}
+	check = func() []request.CheckResult {
+		proxyConfig := proxyConfig
+		if ua, ok := userAgents.pick(); ok {
+			proxyConfig.UserAgent = ua
+		}
+		result := request.Make(ctx, m, client, targetURL, proxyID, proxyConfig, shared.TargetPolicy)
+		// A flaky proxy passing on an empty body now and then is retried right away
+		for retry := 1; retry <= proxyConfig.EmptyBodyRetries && result.ErrorType == "empty_response" && ctx.Err() == nil; retry++ {
+			log.Printf("[%s] Retrying empty response (%d/%d)", proxyID, retry, proxyConfig.EmptyBodyRetries)
+			result = request.Make(ctx, m, client, targetURL, proxyID, proxyConfig, shared.TargetPolicy)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		return []request.CheckResult{result}
+	}
+	return check, transport.CloseIdleConnections, nil
+}
 
-	log.Printf("[%s] Starting proxy runner (protocol: %s, proxy: %s)", proxyID, proxyConfig.Protocol, proxy.MaskAuth(proxyConfig.Protocol, proxyConfig.Proxy))
+// initBackoff bounds the waits between attempts to set up a proxy
+type initBackoff struct {
+	min, max time.Duration
+}
+
+// defaultInitBackoff retries after 1s, 2s, 4s and so on, then every minute
+var defaultInitBackoff = initBackoff{min: time.Second, max: time.Minute}
 
-	// Create ticker for this proxy
-	ticker := time.NewTicker(requestInterval)
-	defer ticker.Stop()
+// retryInit calls create until it succeeds, returning nil, or fails with proxy.ErrInvalid,
+// returning that error; ctx's error is returned once it is done. After a failure it waits
+// b.min, doubling the wait after every further one up to b.max; failed is called with each
+// retried error and the wait that follows.
+func retryInit(ctx context.Context, b initBackoff, create func() error, failed func(err error, wait time.Duration)) error {
+	wait := b.min
+	for {
+		err := create()
+		if err == nil || errors.Is(err, proxy.ErrInvalid) {
+			return err
+		}
+		failed(err, wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		wait = min(2*wait, b.max)
+	}
+}
 
-	// Send initial request immediately
-	go request.Make(m, client, targetURL, proxyID, proxyConfig.Protocol, proxyConfig.Labels)
+// dispatch starts check in a new goroutine unless it has to be skipped. inFlight limits the
+// checks of this proxy (nil is unlimited), shared.InFlight those of all proxies.
+func dispatch(m *metrics.Metrics, proxyID string, proxyConfig config.Proxy, shared Shared, inFlight *InFlightLimit, check func()) {
+	skip := func(reason string) {
+		labelValues := m.ProxyLabelValues(proxyID, proxyConfig.Protocol, proxyConfig.MetricLabels())
+		m.RequestsSkipped.WithLabelValues(append(labelValues, reason)...).Inc()
+	}
 
-	// Send requests at intervals
-	for range ticker.C {
-		go request.Make(m, client, targetURL, proxyID, proxyConfig.Protocol, proxyConfig.Labels)
+	if !shared.Connectivity.Online() {
+		// A host without network would otherwise record a failure for every proxy
+		skip("host_offline")
+		return
+	}
+	if !inFlight.acquire() {
+		// The previous checks of this proxy are still running, e.g. against a stalled target
+		skip("proxy_in_flight_limit")
+		return
 	}
+	if !shared.InFlight.acquire() {
+		inFlight.release()
+		skip("shed_goroutine_limit")
+		return
+	}
+
+	go func() {
+		defer inFlight.release()
+		defer shared.InFlight.release()
+		defer func() {
+			// A bug in one check must not take down the whole process
+			if r := recover(); r != nil {
+				m.CheckPanics.WithLabelValues(m.ProxyLabelValues(proxyID, proxyConfig.Protocol, proxyConfig.MetricLabels())...).Inc()
+				log.Printf("[%s] Check panicked: %v\n%s", proxyID, r, debug.Stack())
+			}
+		}()
+		check()
+		shared.Readiness.record()
+	}()
 }
 
+// defaultMaxRedirects matches the net/http default redirect limit
+const defaultMaxRedirects = 10
+
+// checkRedirect returns the redirect policy of proxyConfig: with follow_redirects disabled the
+// 3xx response is returned as is, otherwise it fails with request.ErrTooManyRedirects after
+// max_redirects redirects (10 when zero) and refuses redirects to targets outside policy.
+// Followed redirects are counted in redirects_total.
+func checkRedirect(m *metrics.Metrics, proxyID string, proxyConfig config.Proxy, policy *request.TargetPolicy) func(*http.Request, []*http.Request) error {
+	if !proxyConfig.GetFollowRedirects() {
+		return func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	maxRedirects := proxyConfig.MaxRedirects
+	if maxRedirects <= 0 {
+		maxRedirects = defaultMaxRedirects
+	}
+	redirects := m.Redirects.WithLabelValues(m.ProxyLabelValues(proxyID, proxyConfig.Protocol, proxyConfig.MetricLabels())...)
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) > maxRedirects {
+			return request.ErrTooManyRedirects
+		}
+		if err := policy.Check(req.Context(), req.URL.Hostname(), ""); err != nil {
+			return err
+		}
+		redirects.Inc()
+		return nil
+	}
+}
+
+// rotation hands out items round-robin; it is safe for concurrent use
+type rotation struct {
+	items []string
+	next  atomic.Uint64
+}
+
+// pick returns the next item, or false when there are none
+func (r *rotation) pick() (string, bool) {
+	if len(r.items) == 0 {
+		return "", false
+	}
+	i := r.next.Add(1) - 1
+	return r.items[i%uint64(len(r.items))], true
+}
+
+// firstOffset returns the delay of the first check, random in [0, jitter]
+func firstOffset(rng *rand.Rand, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return 0
+	}
+	return initialDelay(rng, jitter)
+}
+
+// nextInterval returns interval offset by a random amount in [-jitter, +jitter], never below zero
+func nextInterval(rng *rand.Rand, interval, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return interval
+	}
+	return max(interval+time.Duration(rng.Int64N(2*int64(jitter)+1))-jitter, 0)
+}
+
+// initialDelay returns a random delay in [0, spread]
+func initialDelay(rng *rand.Rand, spread time.Duration) time.Duration {
+	return time.Duration(rng.Int64N(int64(spread) + 1))
+}
+
+// compareTargets probes both compare_targets URLs back to back through the same client,
+// records each latency plus the second minus the first and returns both results, or nil when
+// ctx was canceled. The delta is only updated when neither probe failed.
+func compareTargets(ctx context.Context, m *metrics.Metrics, client *http.Client, proxyID string, proxyConfig config.Proxy, policy *request.TargetPolicy) []request.CheckResult {
+	targetA, targetB := proxyConfig.CompareTargets[0], proxyConfig.CompareTargets[1]
+	a := request.Make(ctx, m, client, targetA, proxyID, proxyConfig, policy)
+	b := request.Make(ctx, m, client, targetB, proxyID, proxyConfig, policy)
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	labelValues := m.ProxyLabelValues(proxyID, proxyConfig.Protocol, proxyConfig.MetricLabels())
+	m.TargetLatency.WithLabelValues(append(labelValues, config.MaskURL(targetA))...).Set(a.Duration.Seconds())
+	m.TargetLatency.WithLabelValues(append(labelValues, config.MaskURL(targetB))...).Set(b.Duration.Seconds())
+
+	if a.Status != "error" && b.Status != "error" {
+		m.TargetLatencyDelta.WithLabelValues(labelValues...).Set((b.Duration - a.Duration).Seconds())
+	}
+	return []request.CheckResult{a, b}
+}
@@ -0,0 +1,639 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"eugene-chernyshenko/proxy-synthetic-check/internal/config"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/metrics/metricstest"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/proxy"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/request"
+)
+
+func TestCompareTargets_RecordsDelta(t *testing.T) {
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fast.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	m := metricstest.New(t)
+	proxyConfig := config.Proxy{
+		Protocol:       "http",
+		CompareTargets: []string{fast.URL, slow.URL},
+	}
+
+	compareTargets(context.Background(), m, http.DefaultClient, "proxy_compare", proxyConfig, nil)
+
+	latencyA := testutil.ToFloat64(m.TargetLatency.WithLabelValues("proxy_compare", "http", fast.URL))
+	latencyB := testutil.ToFloat64(m.TargetLatency.WithLabelValues("proxy_compare", "http", slow.URL))
+	delta := testutil.ToFloat64(m.TargetLatencyDelta.WithLabelValues("proxy_compare", "http"))
+
+	if latencyB < 0.05 {
+		t.Errorf("target_latency_seconds{target=slow} = %v, want >= 0.05", latencyB)
+	}
+	if math.Abs(delta-(latencyB-latencyA)) > 1e-9 {
+		t.Errorf("target_latency_delta_seconds = %v, want %v - %v", delta, latencyB, latencyA)
+	}
+}
+
+func TestCompareTargets_SkipsDeltaOnError(t *testing.T) {
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ok.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+
+	m := metricstest.New(t)
+	proxyConfig := config.Proxy{
+		Protocol:       "http",
+		CompareTargets: []string{ok.URL, failing.URL},
+	}
+
+	compareTargets(context.Background(), m, http.DefaultClient, "proxy_compare_error", proxyConfig, nil)
+
+	// DeleteLabelValues reports whether the series existed
+	if m.TargetLatencyDelta.DeleteLabelValues("proxy_compare_error", "http") {
+		t.Error("target_latency_delta_seconds recorded although one probe failed")
+	}
+}
+
+func TestBuildCheck(t *testing.T) {
+	// An HTTP proxy answering every request itself
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer stub.Close()
+	proxyAddr := strings.TrimPrefix(stub.URL, "http://")
+
+	tests := []struct {
+		name        string
+		proxyConfig config.Proxy
+		wantResults int
+	}{
+		{"request", config.Proxy{Protocol: "http", Proxy: proxyAddr}, 1},
+		{"compare_targets", config.Proxy{Protocol: "http", Proxy: proxyAddr, CompareTargets: []string{"http://a.example.com/", "http://b.example.com/"}}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var steps []string
+			setup := func(what string, create func() error) error {
+				steps = append(steps, what)
+				return create()
+			}
+			check, closeCheck, err := buildCheck(context.Background(), metricstest.New(t), "proxy_build", tt.proxyConfig, "http://example.com/", time.Second, Shared{}, setup)
+			if err != nil {
+				t.Fatalf("buildCheck() error = %v", err)
+			}
+			defer closeCheck()
+			if !slices.Equal(steps, []string{"transport"}) {
+				t.Errorf("setup steps = %v, want [transport]", steps)
+			}
+
+			results := check()
+			if len(results) != tt.wantResults {
+				t.Fatalf("check() returned %d results, want %d", len(results), tt.wantResults)
+			}
+			for _, result := range results {
+				if result.Status != "success" {
+					t.Errorf("result = %+v, want success", result)
+				}
+			}
+		})
+	}
+
+	// Setup errors are passed through, e.g. to stop retrying
+	errSetup := errors.New("setup failed")
+	_, _, err := buildCheck(context.Background(), metricstest.New(t), "proxy_build", config.Proxy{Protocol: "socks5", Proxy: proxyAddr, ConnectOnly: true}, "http://example.com/", time.Second, Shared{}, func(what string, create func() error) error {
+		if what != "dialer" {
+			t.Errorf("setup step = %q, want dialer", what)
+		}
+		return errSetup
+	})
+	if !errors.Is(err, errSetup) {
+		t.Errorf("buildCheck() error = %v, want the setup error", err)
+	}
+}
+
+func TestBuildCheck_EmptyBodyRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		retries      int
+		wantStatus   string
+		wantRequests int32
+	}{
+		{"retried until a body arrives", 2, "success", 3},
+		{"retries exhausted", 1, "error", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// An HTTP proxy answering the first two requests with an empty body
+			var requests atomic.Int32
+			stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if requests.Add(1) > 2 {
+					w.Write([]byte("ok"))
+				}
+			}))
+			defer stub.Close()
+
+			proxyConfig := config.Proxy{Protocol: "http", Proxy: strings.TrimPrefix(stub.URL, "http://"), EmptyBodyIsFailure: true, EmptyBodyRetries: tt.retries}
+			setup := func(what string, create func() error) error { return create() }
+			check, closeCheck, err := buildCheck(context.Background(), metricstest.New(t), "proxy_empty", proxyConfig, "http://example.com/", time.Second, Shared{}, setup)
+			if err != nil {
+				t.Fatalf("buildCheck() error = %v", err)
+			}
+			defer closeCheck()
+
+			results := check()
+			if len(results) != 1 || results[0].Status != tt.wantStatus {
+				t.Errorf("check() = %+v, want one %s result", results, tt.wantStatus)
+			}
+			if got := requests.Load(); got != tt.wantRequests {
+				t.Errorf("proxy got %d requests, want %d", got, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestRun_CronSchedule(t *testing.T) {
+	// Answers as the HTTP proxy, noting when each check arrives
+	checks := make(chan time.Time, 10)
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checks <- time.Now()
+	}))
+	defer stub.Close()
+
+	// Neither the hour-long interval nor the initial spread must delay the scheduled checks
+	proxyConfig := config.Proxy{
+		Protocol:        "http",
+		Proxy:           strings.TrimPrefix(stub.URL, "http://"),
+		Cron:            "@every 1s",
+		InitialSpreadMs: int(time.Hour / time.Millisecond),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Run(ctx, metricstest.New(t), "proxy_cron", proxyConfig, "http://example.com/", time.Hour, time.Second, 0, Shared{})
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	for i := range 2 {
+		select {
+		case at := <-checks:
+			// The schedule fires on whole seconds
+			if offset := time.Duration(at.Nanosecond()); offset > 500*time.Millisecond {
+				t.Errorf("check %d at %v, %v after the scheduled second", i+1, at, offset)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("check %d not run on the cron schedule", i+1)
+		}
+	}
+}
+
+func TestInitialDelay_WithinSpread(t *testing.T) {
+	rng := rand.New(rand.NewPCG(42, 0))
+	spread := 250 * time.Millisecond
+
+	for i := 0; i < 1000; i++ {
+		delay := initialDelay(rng, spread)
+		if delay < 0 || delay > spread {
+			t.Fatalf("initialDelay() = %v, want within [0, %v]", delay, spread)
+		}
+	}
+
+	// Same seed yields the same sequence
+	a := initialDelay(rand.New(rand.NewPCG(7, 0)), spread)
+	b := initialDelay(rand.New(rand.NewPCG(7, 0)), spread)
+	if a != b {
+		t.Errorf("initialDelay() = %v and %v for the same seed, want equal", a, b)
+	}
+}
+
+func TestNextInterval_Jitter(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	interval, jitter := time.Second, 200*time.Millisecond
+
+	var below, above bool
+	for i := 0; i < 1000; i++ {
+		got := nextInterval(rng, interval, jitter)
+		if got < interval-jitter || got > interval+jitter {
+			t.Fatalf("nextInterval() = %v, want within %v ± %v", got, interval, jitter)
+		}
+		below = below || got < interval
+		above = above || got > interval
+	}
+	if !below || !above {
+		t.Error("expected offsets on both sides of the interval")
+	}
+
+	if got := nextInterval(rng, interval, 0); got != interval {
+		t.Errorf("nextInterval() without jitter = %v, want %v", got, interval)
+	}
+	if got := nextInterval(rng, 100*time.Millisecond, time.Second); got < 0 {
+		t.Errorf("nextInterval() = %v, want non-negative", got)
+	}
+
+	for i := 0; i < 1000; i++ {
+		if got := firstOffset(rng, jitter); got < 0 || got > jitter {
+			t.Fatalf("firstOffset() = %v, want within [0, %v]", got, jitter)
+		}
+	}
+	if got := firstOffset(rng, 0); got != 0 {
+		t.Errorf("firstOffset() without jitter = %v, want 0", got)
+	}
+
+	// Same seed yields the same schedule
+	a := nextInterval(rand.New(rand.NewPCG(7, 0)), interval, jitter)
+	b := nextInterval(rand.New(rand.NewPCG(7, 0)), interval, jitter)
+	if a != b {
+		t.Errorf("nextInterval() = %v and %v for the same seed, want equal", a, b)
+	}
+}
+
+func TestDispatch_SuppressedWhileHostOffline(t *testing.T) {
+	m := metricstest.New(t)
+	proxyConfig := config.Proxy{Protocol: "socks5"}
+
+	online := false
+	connectivity := NewConnectivity("192.0.2.1:443", time.Second, time.Second)
+	connectivity.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if !online {
+			return nil, errors.New("network is unreachable")
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+
+	checked := make(chan struct{}, 1)
+	check := func() { checked <- struct{}{} }
+
+	// Host offline: check is not run and is counted as skipped
+	connectivity.probe()
+	if connectivity.Online() {
+		t.Fatal("Online() = true after failed probe, want false")
+	}
+	dispatch(m, "proxy_offline", proxyConfig, Shared{Connectivity: connectivity}, nil, check)
+	select {
+	case <-checked:
+		t.Error("check ran while host offline")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if got := testutil.ToFloat64(m.RequestsSkipped.WithLabelValues("proxy_offline", "socks5", "host_offline")); got != 1 {
+		t.Errorf("requests_skipped_total{reason=host_offline} = %v, want 1", got)
+	}
+
+	// Connectivity restored: checks resume
+	online = true
+	connectivity.probe()
+	if !connectivity.Online() {
+		t.Fatal("Online() = false after successful probe, want true")
+	}
+	dispatch(m, "proxy_offline", proxyConfig, Shared{Connectivity: connectivity}, nil, check)
+	select {
+	case <-checked:
+	case <-time.After(time.Second):
+		t.Error("check did not run after connectivity was restored")
+	}
+}
+
+func TestConnectivity_NilIsOnline(t *testing.T) {
+	var connectivity *Connectivity
+	if !connectivity.Online() {
+		t.Error("nil Connectivity Online() = false, want true")
+	}
+}
+
+func TestDispatch_ShedsAboveInFlightLimit(t *testing.T) {
+	m := metricstest.New(t)
+	proxyConfig := config.Proxy{Protocol: "http"}
+	shared := Shared{InFlight: NewInFlightLimit(2)}
+
+	release := make(chan struct{})
+	var started sync.WaitGroup
+	started.Add(2)
+	blocking := func() {
+		started.Done()
+		<-release
+	}
+
+	ran := make(chan struct{}, 1)
+	dispatch(m, "proxy_shed", proxyConfig, shared, nil, blocking)
+	dispatch(m, "proxy_shed", proxyConfig, shared, nil, blocking)
+	started.Wait()
+
+	// Both slots are taken: further checks are shed, not started
+	dispatch(m, "proxy_shed", proxyConfig, shared, nil, func() { ran <- struct{}{} })
+	dispatch(m, "proxy_shed", proxyConfig, shared, nil, func() { ran <- struct{}{} })
+	if got := testutil.ToFloat64(m.RequestsSkipped.WithLabelValues("proxy_shed", "http", "shed_goroutine_limit")); got != 2 {
+		t.Errorf("requests_skipped_total{reason=shed_goroutine_limit} = %v, want 2", got)
+	}
+
+	// Slots are released when checks finish
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for shared.InFlight.current.Load() != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	dispatch(m, "proxy_shed", proxyConfig, shared, nil, func() { ran <- struct{}{} })
+	select {
+	case <-ran:
+	case <-time.After(time.Second):
+		t.Error("check did not run after in-flight checks finished")
+	}
+}
+
+func TestDispatch_SkipsAbovePerProxyLimit(t *testing.T) {
+	m := metricstest.New(t)
+	proxyConfig := config.Proxy{Protocol: "http", MaxInFlight: 2}
+
+	release := make(chan struct{})
+	var arrived atomic.Int32
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived.Add(1)
+		<-release
+	}))
+	defer stalled.Close()
+	defer close(release)
+
+	inFlight := NewInFlightLimit(proxyConfig.GetMaxInFlight())
+	check := func() {
+		if resp, err := http.Get(stalled.URL); err == nil {
+			resp.Body.Close()
+		}
+	}
+
+	// Ticks keep coming while the target stalls
+	for i := 0; i < 10; i++ {
+		dispatch(m, "proxy_stalled", proxyConfig, Shared{}, inFlight, check)
+	}
+
+	if got := testutil.ToFloat64(m.RequestsSkipped.WithLabelValues("proxy_stalled", "http", "proxy_in_flight_limit")); got != 8 {
+		t.Errorf("requests_skipped_total{reason=proxy_in_flight_limit} = %v, want 8", got)
+	}
+	if got := inFlight.current.Load(); got != 2 {
+		t.Errorf("checks in flight = %d, want 2", got)
+	}
+	deadline := time.Now().Add(time.Second)
+	for arrived.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := arrived.Load(); got != 2 {
+		t.Errorf("requests reaching the target = %d, want 2", got)
+	}
+}
+
+func TestDispatch_RecoversPanic(t *testing.T) {
+	m := metricstest.New(t)
+	proxyConfig := config.Proxy{Protocol: "http"}
+	inFlight := NewInFlightLimit(1)
+
+	dispatch(m, "proxy_panic", proxyConfig, Shared{}, inFlight, func() { panic("boom") })
+
+	deadline := time.Now().Add(time.Second)
+	for testutil.ToFloat64(m.CheckPanics.WithLabelValues("proxy_panic", "http")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := testutil.ToFloat64(m.CheckPanics.WithLabelValues("proxy_panic", "http")); got != 1 {
+		t.Fatalf("check_panics_total = %v, want 1", got)
+	}
+
+	// The slot of the panicked check is released
+	for inFlight.current.Load() != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	ran := make(chan struct{})
+	dispatch(m, "proxy_panic", proxyConfig, Shared{}, inFlight, func() { close(ran) })
+	select {
+	case <-ran:
+	case <-time.After(time.Second):
+		t.Error("check did not run after a panicked check")
+	}
+}
+
+func TestDispatch_RecordsReadiness(t *testing.T) {
+	readiness := &Readiness{}
+	if readiness.Ready() {
+		t.Fatal("Ready() = true before any check")
+	}
+
+	done := make(chan struct{})
+	dispatch(metricstest.New(t), "proxy_ready", config.Proxy{Protocol: "http"}, Shared{Readiness: readiness}, nil, func() { <-done })
+	time.Sleep(20 * time.Millisecond)
+	if readiness.Ready() {
+		t.Error("Ready() = true while the first check is still running")
+	}
+	close(done)
+
+	deadline := time.Now().Add(time.Second)
+	for !readiness.Ready() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !readiness.Ready() {
+		t.Error("Ready() = false after a completed check")
+	}
+}
+
+func TestRetryInit_SucceedsOnSecondAttempt(t *testing.T) {
+	attempts := 0
+	var waits []time.Duration
+	err := retryInit(context.Background(), initBackoff{min: time.Millisecond, max: 4 * time.Millisecond}, func() error {
+		attempts++
+		if attempts == 1 {
+			return errors.New("proxy not reachable yet")
+		}
+		return nil
+	}, func(err error, wait time.Duration) {
+		waits = append(waits, wait)
+	})
+
+	if err != nil || attempts != 2 {
+		t.Errorf("retryInit() = %v after %d attempts, want nil after 2", err, attempts)
+	}
+	if !slices.Equal(waits, []time.Duration{time.Millisecond}) {
+		t.Errorf("failures reported with waits %v, want one with 1ms", waits)
+	}
+}
+
+func TestRetryInit_BackoffAndCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var waits []time.Duration
+	err := retryInit(ctx, initBackoff{min: time.Millisecond, max: 4 * time.Millisecond}, func() error {
+		return errors.New("proxy not reachable")
+	}, func(err error, wait time.Duration) {
+		waits = append(waits, wait)
+		if len(waits) == 5 {
+			cancel()
+		}
+	})
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("retryInit() = %v, want context.Canceled once ctx is done", err)
+	}
+	ms := time.Millisecond
+	if want := []time.Duration{ms, 2 * ms, 4 * ms, 4 * ms, 4 * ms}; !slices.Equal(waits, want) {
+		t.Errorf("waits = %v, want doubling from 1ms up to 4ms", waits)
+	}
+}
+
+func TestRetryInit_InvalidConfigIsPermanent(t *testing.T) {
+	attempts := 0
+	_, createErr := proxy.CreateTransport("socks5", "http://bad.example:1080", proxy.Options{})
+	err := retryInit(context.Background(), initBackoff{min: time.Millisecond, max: 4 * time.Millisecond}, func() error {
+		attempts++
+		return createErr
+	}, func(err error, wait time.Duration) {
+		t.Errorf("retrying after %v", err)
+	})
+
+	if !errors.Is(err, proxy.ErrInvalid) || attempts != 1 {
+		t.Errorf("retryInit() = %v after %d attempts, want the invalid configuration error after 1", err, attempts)
+	}
+}
+
+func TestCheckRedirect_StopsAtLimit(t *testing.T) {
+	var hits atomic.Int32
+	loop := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	}))
+	defer loop.Close()
+
+	m := metricstest.New(t)
+	proxyConfig := config.Proxy{Protocol: "http", MaxRedirects: 3}
+	client := &http.Client{CheckRedirect: checkRedirect(m, "proxy_redirect_loop", proxyConfig, nil)}
+	result := request.Make(context.Background(), m, client, loop.URL, "proxy_redirect_loop", proxyConfig, nil)
+
+	if result.ErrorType != "too_many_redirects" {
+		t.Errorf("error type = %q, want too_many_redirects", result.ErrorType)
+	}
+	// The original request plus three followed redirects
+	if got := hits.Load(); got != 4 {
+		t.Errorf("server hit %d times, want 4", got)
+	}
+	if got := testutil.ToFloat64(m.RequestsTotal.WithLabelValues("proxy_redirect_loop", "http", "error", "too_many_redirects", "3xx")); got != 1 {
+		t.Errorf("requests_total{error=too_many_redirects} = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(m.Redirects.WithLabelValues("proxy_redirect_loop", "http")); got != 3 {
+		t.Errorf("redirects_total = %v, want 3", got)
+	}
+}
+
+func TestCheckRedirect_Disabled(t *testing.T) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		http.Redirect(w, r, "/elsewhere", http.StatusFound)
+	}))
+	defer server.Close()
+
+	m := metricstest.New(t)
+	follow := false
+	proxyConfig := config.Proxy{Protocol: "http", FollowRedirects: &follow}
+	client := &http.Client{CheckRedirect: checkRedirect(m, "proxy_redirect_disabled", proxyConfig, nil)}
+	result := request.Make(context.Background(), m, client, server.URL, "proxy_redirect_disabled", proxyConfig, nil)
+
+	if result.Status != "success" || result.StatusCode != http.StatusFound {
+		t.Errorf("result = %s %d (%s), want success 302", result.Status, result.StatusCode, result.ErrorType)
+	}
+	if got := hits.Load(); got != 1 {
+		t.Errorf("server hit %d times, want 1", got)
+	}
+	if got := testutil.ToFloat64(m.Redirects.WithLabelValues("proxy_redirect_disabled", "http")); got != 0 {
+		t.Errorf("redirects_total = %v, want 0", got)
+	}
+}
+
+func TestCheckRedirect_TargetPolicy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://internal.example/", http.StatusFound)
+	}))
+	defer server.Close()
+
+	policy, err := request.NewTargetPolicy(nil, []string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{CheckRedirect: checkRedirect(metricstest.New(t), "proxy_redirect_policy", config.Proxy{Protocol: "http"}, policy)}
+	result := request.Make(context.Background(), metricstest.New(t), client, server.URL, "proxy_redirect_policy", config.Proxy{Protocol: "http"}, policy)
+
+	if result.ErrorType != "target_not_allowed" {
+		t.Errorf("redirect outside policy: error type = %q, want target_not_allowed", result.ErrorType)
+	}
+}
+
+func TestFirstSuccess_ReportsProxiesWithoutSuccess(t *testing.T) {
+	tracker := NewFirstSuccess([]string{"proxy_1", "proxy_2", "proxy_3"})
+	tracker.Record("proxy_1", "success")
+	tracker.Record("proxy_2", "error")
+	tracker.Record("proxy_3", "warning")
+
+	err := tracker.Wait(20 * time.Millisecond)
+	if err == nil {
+		t.Fatal("Wait() error = nil, want report of proxies without success")
+	}
+	if want := "for: proxy_2, proxy_3"; !strings.Contains(err.Error(), want) {
+		t.Errorf("Wait() error = %q, want it to contain %q", err, want)
+	}
+}
+
+func TestFirstSuccess_AllSucceed(t *testing.T) {
+	tracker := NewFirstSuccess([]string{"proxy_1", "proxy_2"})
+	go func() {
+		tracker.Record("proxy_1", "success")
+		tracker.Record("proxy_2", "success")
+	}()
+	if err := tracker.Wait(time.Second); err != nil {
+		t.Errorf("Wait() error = %v, want nil", err)
+	}
+
+	// A nil tracker ignores results
+	var nilTracker *FirstSuccess
+	nilTracker.Record("proxy_1", "success")
+}
+
+func TestRotation_CyclesUserAgents(t *testing.T) {
+	var gotUserAgents []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUserAgents = append(gotUserAgents, r.UserAgent())
+	}))
+	defer server.Close()
+
+	m := metricstest.New(t)
+	proxyConfig := config.Proxy{Protocol: "http", UserAgentRotation: []string{"ua-a", "ua-b", "ua-c"}}
+	userAgents := &rotation{items: proxyConfig.UserAgentRotation}
+	for range 4 {
+		pc := proxyConfig
+		pc.UserAgent, _ = userAgents.pick()
+		request.Make(context.Background(), m, server.Client(), server.URL, "proxy_ua_rotation", pc, nil)
+	}
+
+	want := []string{"ua-a", "ua-b", "ua-c", "ua-a"}
+	if !slices.Equal(gotUserAgents, want) {
+		t.Errorf("User-Agents = %v, want %v", gotUserAgents, want)
+	}
+	if got := testutil.ToFloat64(m.RequestsByUserAgent.WithLabelValues("proxy_ua_rotation", "http", "ua-a", "success")); got != 2 {
+		t.Errorf("requests_by_user_agent_total{user_agent=ua-a} = %v, want 2", got)
+	}
+
+	if _, ok := (&rotation{}).pick(); ok {
+		t.Error("empty rotation returned an item")
+	}
+}
@@ -0,0 +1,386 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"eugene-chernyshenko/proxy-synthetic-check/internal/config"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/metrics"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/request"
+)
+
+// runSpec is everything a runner is started with; a proxy whose spec changes is restarted
+type runSpec struct {
+	proxyConfig     config.Proxy
+	targetURL       string
+	requestInterval time.Duration
+	requestTimeout  time.Duration
+	jitter          time.Duration
+}
+
+// runningProxy is a started runner
+type runningProxy struct {
+	id     string
+	spec   runSpec
+	cancel context.CancelFunc
+	done   chan struct{} // closed when the runner has returned
+}
+
+// Supervisor starts and stops runners as the configured proxy set changes. Proxies are
+// tracked by config.Proxy.Key, so a proxy surviving a reload keeps its proxy_id and metrics.
+type Supervisor struct {
+	m      *metrics.Metrics
+	shared Shared
+
+	// run starts a runner; Run unless replaced in tests
+	run func(ctx context.Context, proxyID string, spec runSpec, shared Shared)
+
+	reloading sync.Mutex // serializes Reload, which may wait for verification
+
+	mu      sync.Mutex
+	current *config.ProxyConfig      // last applied config
+	running map[string]*runningProxy // by proxy key
+	retired map[string]string        // IDs of proxies removed by a reload still being verified, by proxy key
+	nextID  int
+	stopped bool // set by Stop; nothing is applied afterwards
+}
+
+// NewSupervisor creates a supervisor starting runners with m and shared
+func NewSupervisor(m *metrics.Metrics, shared Shared) *Supervisor {
+	s := &Supervisor{
+		m:       m,
+		shared:  shared,
+		running: make(map[string]*runningProxy),
+		retired: make(map[string]string),
+	}
+	s.run = func(ctx context.Context, proxyID string, spec runSpec, shared Shared) {
+		Run(ctx, s.m, proxyID, spec.proxyConfig, spec.targetURL, spec.requestInterval, spec.requestTimeout, spec.jitter, shared)
+	}
+	return s
+}
+
+// Apply makes the running proxies match cfg: runners are started for new proxies, stopped
+// (and their metrics deleted) for removed ones and restarted for changed ones. New proxies
+// get the next unused proxy_N ID; on the first call that is proxy_1..proxy_N in config order.
+func (s *Supervisor) Apply(cfg *config.ProxyConfig) {
+	s.apply(cfg, false)
+}
+
+// apply is Apply; with verify set it returns a tracker of the first successful check of
+// each started or restarted proxy, and removed proxies keep their metrics and IDs (see
+// retire) until the outcome is settled by commitRetired
+func (s *Supervisor) apply(cfg *config.ProxyConfig, verify bool) *FirstSuccess {
+	removed, tracker := s.update(cfg, verify)
+
+	// A removed runner's last checks may still be recording; wait for them, outside the
+	// lock, so their metrics don't outlive the deletion
+	for _, p := range removed {
+		<-p.done
+		if !verify {
+			s.m.DeleteProxy(p.id)
+		}
+	}
+	return tracker
+}
+
+// commitRetired deletes the metrics of the proxies removed by verified applies that weren't
+// brought back since, and forgets their IDs
+func (s *Supervisor) commitRetired() {
+	s.mu.Lock()
+	retired := s.retired
+	s.retired = make(map[string]string)
+	s.mu.Unlock()
+
+	for _, id := range retired {
+		s.m.DeleteProxy(id)
+	}
+}
+
+// update starts, stops and restarts runners for apply, returning the stopped runners of
+// removed proxies and apply's tracker
+func (s *Supervisor) update(cfg *config.ProxyConfig, verify bool) ([]*runningProxy, *FirstSuccess) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return nil, nil
+	}
+	s.current = cfg
+
+	requestTimeout := cfg.GetRequestTimeout()
+
+	var starts []string // keys of runners to (re)start
+	wanted := make(map[string]bool, len(cfg.Proxies))
+	for _, proxyConfig := range cfg.Proxies {
+		// A single config file may repeat an entry; each repeat gets its own runner
+		key := proxyConfig.Key()
+		for n := 2; wanted[key]; n++ {
+			key = proxyConfig.Key() + "#" + strconv.Itoa(n)
+		}
+		wanted[key] = true
+		spec := runSpec{
+			proxyConfig:     proxyConfig,
+			targetURL:       proxyConfig.GetTargetURL(cfg.DefaultTargetURL),
+			requestInterval: proxyConfig.GetRequestInterval(cfg.RequestInterval),
+			requestTimeout:  proxyConfig.GetRequestTimeout(requestTimeout),
+			jitter:          cfg.GetJitter(),
+		}
+
+		current, ok := s.running[key]
+		switch {
+		case !ok:
+			// A proxy brought back by a rollback keeps its ID, and so its metrics and baseline
+			id, ok := s.retired[key]
+			if ok {
+				delete(s.retired, key)
+			} else {
+				s.nextID++
+				id = "proxy_" + strconv.Itoa(s.nextID)
+			}
+			s.running[key] = &runningProxy{id: id, spec: spec}
+			starts = append(starts, key)
+		case !reflect.DeepEqual(current.spec, spec):
+			log.Printf("[%s] Configuration changed, restarting runner", current.id)
+			current.cancel()
+			s.running[key] = &runningProxy{id: current.id, spec: spec}
+			starts = append(starts, key)
+		}
+	}
+
+	var removed []*runningProxy
+	for key, current := range s.running {
+		if wanted[key] {
+			continue
+		}
+		log.Printf("[%s] Proxy removed from configuration", current.id)
+		current.cancel()
+		removed = append(removed, current)
+		delete(s.running, key)
+		if verify {
+			s.retired[key] = current.id
+		}
+	}
+
+	shared := s.shared
+	if verify {
+		var proxyIDs []string
+		for _, key := range starts {
+			// A cron schedule may not come around within the verification timeout
+			if p := s.running[key]; p.spec.proxyConfig.Cron == "" {
+				proxyIDs = append(proxyIDs, p.id)
+			}
+		}
+		shared.Verify = NewFirstSuccess(proxyIDs)
+	}
+	for _, key := range starts {
+		s.start(s.running[key], shared)
+	}
+	return removed, shared.Verify
+}
+
+// Reload loads a new config with load and applies it. Nothing is applied unless load returns
+// a complete, valid config; on failure config_reload_errors_total is incremented and the
+// current proxies keep running. With reload_verify_timeout_ms set in the new config, every
+// added or changed proxy without a cron schedule has to succeed once within that time, else
+// the previous config is applied again and the reload fails the same way. Proxies removed by
+// the new config keep their metrics until it is verified and return with their old IDs after
+// a rollback. Reloads are serialized; one waiting for verification delays the next, but not
+// Stop.
+func (s *Supervisor) Reload(load func() (*config.ProxyConfig, error)) error {
+	s.reloading.Lock()
+	defer s.reloading.Unlock()
+
+	cfg, err := load()
+	if err != nil {
+		s.m.ConfigReloadErrors.Inc()
+		return err
+	}
+
+	current := s.Current()
+	if current != nil {
+		warnUnreloadable(current, cfg, s.m.LabelKeys)
+	}
+	timeout := cfg.GetReloadVerifyTimeout()
+	verify := s.apply(cfg, current != nil && timeout > 0)
+	if verify != nil {
+		if err := verify.Wait(timeout); err != nil {
+			log.Printf("Reloaded configuration failed verification, rolling back")
+			s.m.ConfigReloadErrors.Inc()
+			// The restored proxies are verified the same way, so a rollback that doesn't
+			// bring them back (e.g. the targets are down for every config) is visible
+			if rollback := s.apply(current, true); rollback != nil {
+				if err := rollback.Wait(timeout); err != nil {
+					log.Printf("Error: the previous configuration failed verification after the rollback too: %v", err)
+				}
+			}
+			// Proxies removed by the rollback, those the rejected config added, are gone for good
+			s.commitRetired()
+			return fmt.Errorf("verifying reloaded configuration: %w", err)
+		}
+		s.commitRetired()
+	}
+	s.m.SetConfigHash(cfg.Hash)
+	s.m.SetConfigured(cfg.Proxies)
+	return nil
+}
+
+// Stop stops all runners and waits for their checks in flight, keeping their metrics for
+// a final scrape
+func (s *Supervisor) Stop() {
+	s.mu.Lock()
+	s.stopped = true
+	var stopped []*runningProxy
+	for key, current := range s.running {
+		current.cancel()
+		stopped = append(stopped, current)
+		delete(s.running, key)
+	}
+	s.mu.Unlock()
+
+	for _, p := range stopped {
+		<-p.done
+	}
+}
+
+// Current returns the config applied last, or nil before the first Apply
+func (s *Supervisor) Current() *config.ProxyConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.current
+}
+
+// Find returns the ID of the running proxy selected by proxyID or, when that is empty, of the
+// only one whose labels include all of labels
+func (s *Supervisor) Find(proxyID string, labels map[string]string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if proxyID != "" {
+		for _, current := range s.running {
+			if current.id == proxyID {
+				return proxyID, nil
+			}
+		}
+		return "", fmt.Errorf("unknown proxy %s", proxyID)
+	}
+	if len(labels) == 0 {
+		return "", errors.New("no proxy ID or labels given")
+	}
+
+	var matches []string
+	for _, current := range s.running {
+		matched := true
+		for key, value := range labels {
+			if v, ok := current.spec.proxyConfig.Labels[key]; !ok || v != value {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			matches = append(matches, current.id)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no proxy labelled %v", labels)
+	case 1:
+		return matches[0], nil
+	default:
+		slices.Sort(matches)
+		return "", fmt.Errorf("%d proxies labelled %v: %s", len(matches), labels, strings.Join(matches, ", "))
+	}
+}
+
+// Probe runs a single check of the running proxy proxyID as its runner would (see Probe),
+// recorded in metrics of its own (see metrics.NewProbe), which are returned with the result.
+// A non-empty targetURL is checked instead of the proxy's target.
+func (s *Supervisor) Probe(ctx context.Context, proxyID, targetURL string) (*metrics.Metrics, request.CheckResult, error) {
+	s.mu.Lock()
+	cfg := s.current
+	var spec *runSpec
+	for _, current := range s.running {
+		if current.id == proxyID {
+			spec = &current.spec
+			break
+		}
+	}
+	s.mu.Unlock()
+	if spec == nil {
+		return nil, request.CheckResult{}, fmt.Errorf("unknown proxy %s", proxyID)
+	}
+
+	m, err := metrics.NewProbe([]config.Proxy{spec.proxyConfig}, cfg.GetLatencyBuckets(), cfg.GetSizeBuckets(), cfg.LabelRename)
+	if err != nil {
+		return nil, request.CheckResult{}, err
+	}
+	if targetURL == "" {
+		targetURL = spec.targetURL
+	}
+	result, err := Probe(ctx, m, proxyID, spec.proxyConfig, targetURL, spec.requestTimeout, s.shared)
+	if err != nil {
+		return nil, request.CheckResult{}, err
+	}
+	return m, result, nil
+}
+
+// warnUnreloadable logs settings changed in next that only take effect after a restart,
+// including custom label keys missing from the exported labelKeys
+func warnUnreloadable(cur, next *config.ProxyConfig, labelKeys []string) {
+	var newKeys []string
+	for _, p := range next.Proxies {
+		for key := range p.MetricLabels() {
+			if !slices.Contains(labelKeys, key) && !slices.Contains(newKeys, key) {
+				newKeys = append(newKeys, key)
+			}
+		}
+	}
+	if len(newKeys) > 0 {
+		slices.Sort(newKeys)
+		log.Printf("Warning: label keys %s are not exported until a restart", strings.Join(newKeys, ", "))
+	}
+	if cur.MetricsPort != next.MetricsPort || cur.GetMetricsPath() != next.GetMetricsPath() {
+		log.Printf("Warning: metrics_port and metrics_path changes require a restart")
+	}
+	if !slices.Equal(cur.GetLatencyBuckets(), next.GetLatencyBuckets()) {
+		log.Printf("Warning: latency_buckets change requires a restart")
+	}
+	if !slices.Equal(cur.GetSizeBuckets(), next.GetSizeBuckets()) {
+		log.Printf("Warning: size_buckets change requires a restart")
+	}
+	if cur.MaxErrorCardinality != next.MaxErrorCardinality {
+		log.Printf("Warning: max_error_cardinality change requires a restart")
+	}
+	if !maps.Equal(cur.LabelRename, next.LabelRename) {
+		log.Printf("Warning: label_rename change requires a restart")
+	}
+	if cur.OTLPEndpoint != next.OTLPEndpoint || cur.SQLitePath != next.SQLitePath ||
+		!slices.Equal(cur.KafkaBrokers, next.KafkaBrokers) || cur.KafkaTopic != next.KafkaTopic ||
+		cur.KafkaTLS != next.KafkaTLS || !reflect.DeepEqual(cur.KafkaSASL, next.KafkaSASL) ||
+		cur.CAFile != next.CAFile || cur.InsecureSkipVerify != next.InsecureSkipVerify ||
+		cur.BaselinesFile != next.BaselinesFile || cur.BaselineFactor != next.BaselineFactor ||
+		cur.MaxGoroutines != next.MaxGoroutines || !reflect.DeepEqual(cur.ConnectivityCheck, next.ConnectivityCheck) ||
+		!slices.Equal(cur.AllowedTargetHosts, next.AllowedTargetHosts) || !slices.Equal(cur.AllowedTargetCIDRs, next.AllowedTargetCIDRs) ||
+		!reflect.DeepEqual(cur.Routes, next.Routes) {
+		log.Printf("Warning: global settings changed; only proxies and their checks are reloaded")
+	}
+}
+
+// start runs a runner for p with shared
+func (s *Supervisor) start(p *runningProxy, shared Shared) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	p.done = make(chan struct{})
+	log.Printf("[%s] Using target URL: %s", p.id, config.MaskURL(p.spec.targetURL))
+	go func() {
+		defer close(p.done)
+		s.run(ctx, p.id, p.spec, shared)
+	}()
+}
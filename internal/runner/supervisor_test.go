@@ -0,0 +1,424 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"eugene-chernyshenko/proxy-synthetic-check/internal/config"
+	"eugene-chernyshenko/proxy-synthetic-check/internal/metrics/metricstest"
+)
+
+// fakeRuns records runners started by a Supervisor instead of running checks
+type fakeRuns struct {
+	mu      sync.Mutex
+	started []string
+	ctxs    map[string]context.Context
+	specs   map[string]runSpec
+}
+
+func newSupervisorForTest(t *testing.T) (*Supervisor, *fakeRuns) {
+	t.Helper()
+	runs := &fakeRuns{ctxs: make(map[string]context.Context), specs: make(map[string]runSpec)}
+	s := NewSupervisor(metricstest.New(t), Shared{})
+	s.run = func(ctx context.Context, proxyID string, spec runSpec, shared Shared) {
+		runs.mu.Lock()
+		defer runs.mu.Unlock()
+		runs.started = append(runs.started, proxyID)
+		runs.ctxs[proxyID] = ctx
+		runs.specs[proxyID] = spec
+	}
+	return s, runs
+}
+
+// waitStarted waits until n runners have been started and returns their IDs
+func (r *fakeRuns) waitStarted(t *testing.T, n int) []string {
+	t.Helper()
+	for range 1000 {
+		r.mu.Lock()
+		if len(r.started) >= n {
+			started := append([]string(nil), r.started...)
+			r.mu.Unlock()
+			return started
+		}
+		r.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %d runners to start", n)
+	return nil
+}
+
+func (r *fakeRuns) ctx(id string) context.Context {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ctxs[id]
+}
+
+func (r *fakeRuns) spec(id string) runSpec {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.specs[id]
+}
+
+func supervisorConfig(proxies ...string) *config.ProxyConfig {
+	cfg := &config.ProxyConfig{
+		DefaultTargetURL: "http://example.com",
+		RequestInterval:  1000,
+		RequestTimeout:   5,
+	}
+	for _, p := range proxies {
+		cfg.Proxies = append(cfg.Proxies, config.Proxy{Protocol: "socks5", Proxy: p})
+	}
+	return cfg
+}
+
+func TestSupervisor_Reload(t *testing.T) {
+	s, runs := newSupervisorForTest(t)
+
+	s.Apply(supervisorConfig("a:1080", "b:1080"))
+	if got := runs.waitStarted(t, 2); !slices.Contains(got, "proxy_1") || !slices.Contains(got, "proxy_2") {
+		t.Fatalf("expected proxy_1 and proxy_2 to start, got %v", got)
+	}
+	ctxA, ctxB := runs.ctx("proxy_1"), runs.ctx("proxy_2")
+
+	s.Apply(supervisorConfig("b:1080", "c:1080"))
+	started := runs.waitStarted(t, 3)
+	if started[2] != "proxy_3" {
+		t.Errorf("expected new proxy to start as proxy_3, got %v", started)
+	}
+	if ctxA.Err() == nil {
+		t.Error("expected removed proxy_1 to be stopped")
+	}
+	if ctxB.Err() != nil {
+		t.Error("expected surviving proxy_2 to keep running")
+	}
+	if s.running["socks5://b:1080 "].id != "proxy_2" {
+		t.Errorf("expected surviving proxy to keep proxy_2, got %s", s.running["socks5://b:1080 "].id)
+	}
+}
+
+func TestSupervisor_DeletesMetricsAfterRunnerReturns(t *testing.T) {
+	s := NewSupervisor(metricstest.New(t), Shared{})
+	s.run = func(ctx context.Context, proxyID string, spec runSpec, shared Shared) {
+		// A check finishing after the runner was told to stop
+		<-ctx.Done()
+		time.Sleep(50 * time.Millisecond)
+		s.m.RequestsTotal.WithLabelValues(proxyID, "socks5", "success", "", "2xx").Inc()
+	}
+
+	s.Apply(supervisorConfig("a:1080"))
+	s.Apply(supervisorConfig())
+	if n := testutil.CollectAndCount(s.m.RequestsTotal); n != 0 {
+		t.Errorf("requests_total series after removing the proxy = %d, want 0", n)
+	}
+}
+
+func TestSupervisor_RestartsChangedProxy(t *testing.T) {
+	s, runs := newSupervisorForTest(t)
+
+	cfg := supervisorConfig("a:1080")
+	s.Apply(cfg)
+	runs.waitStarted(t, 1)
+	first := runs.ctx("proxy_1")
+
+	cfg = supervisorConfig("a:1080")
+	cfg.Proxies[0].UserAgent = "probe/2"
+	s.Apply(cfg)
+	started := runs.waitStarted(t, 2)
+	if started[1] != "proxy_1" {
+		t.Errorf("expected changed proxy to restart as proxy_1, got %v", started)
+	}
+	if first.Err() == nil {
+		t.Error("expected previous runner to be stopped")
+	}
+}
+
+func TestSupervisor_MalformedReloadKeepsConfig(t *testing.T) {
+	s, runs := newSupervisorForTest(t)
+	path := filepath.Join(t.TempDir(), "proxies.yaml")
+	load := func() (*config.ProxyConfig, error) { return config.Load(path) }
+
+	valid := `default_target_url: "https://example.com"
+request_interval_ms: 1000
+request_timeout: 5
+proxies:
+  - protocol: socks5
+    proxy: "reload-a:1080"
+  - protocol: socks5
+    proxy: "reload-b:1080"
+`
+	if err := os.WriteFile(path, []byte(valid), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(load); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	runs.waitStarted(t, 2)
+	previous := s.Current()
+
+	// A write caught half-way through the last proxy
+	if err := os.WriteFile(path, []byte(strings.TrimSuffix(valid, `1080"`+"\n")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	errorsBefore := testutil.ToFloat64(s.m.ConfigReloadErrors)
+	if err := s.Reload(load); err == nil {
+		t.Fatal("Reload() error = nil for a truncated config")
+	}
+
+	if got := testutil.ToFloat64(s.m.ConfigReloadErrors) - errorsBefore; got != 1 {
+		t.Errorf("config_reload_errors_total increased by %v, want 1", got)
+	}
+	if s.Current() != previous {
+		t.Error("expected the previous config to stay active")
+	}
+	if len(s.running) != 2 {
+		t.Errorf("expected 2 proxies to keep running, got %d", len(s.running))
+	}
+	for _, id := range []string{"proxy_1", "proxy_2"} {
+		if runs.ctx(id).Err() != nil {
+			t.Errorf("expected %s to keep running", id)
+		}
+	}
+}
+
+func TestSupervisor_ReloadDoesNotVerifyCronProxies(t *testing.T) {
+	// No runner ever records a success
+	s, runs := newSupervisorForTest(t)
+	s.Apply(supervisorConfig("verify-a:1080"))
+	runs.waitStarted(t, 1)
+
+	cfg := supervisorConfig("verify-a:1080", "scheduled:1080")
+	cfg.Proxies[1].Cron = "0 3 * * *"
+	cfg.ReloadVerifyTimeoutMs = 50
+	if err := s.Reload(func() (*config.ProxyConfig, error) { return cfg, nil }); err != nil {
+		t.Fatalf("Reload() error = %v, want the cron proxy left out of verification", err)
+	}
+	if s.Current() != cfg {
+		t.Error("expected the reloaded config to be applied")
+	}
+}
+
+func TestSupervisor_StopDuringReloadVerification(t *testing.T) {
+	// No runner ever records a success
+	s, runs := newSupervisorForTest(t)
+	s.Apply(supervisorConfig("verify-a:1080"))
+	runs.waitStarted(t, 1)
+
+	cfg := supervisorConfig("verify-a:1080", "verify-b:1080")
+	cfg.ReloadVerifyTimeoutMs = 100
+	reloaded := make(chan error)
+	go func() {
+		reloaded <- s.Reload(func() (*config.ProxyConfig, error) { return cfg, nil })
+	}()
+	runs.waitStarted(t, 2)
+	s.Stop()
+
+	if err := <-reloaded; err == nil {
+		t.Fatal("Reload() error = nil, want a verification error")
+	}
+	if started := runs.waitStarted(t, 2); len(started) != 2 {
+		t.Errorf("runners started = %v, want no rollback after Stop", started)
+	}
+	if len(s.running) != 0 {
+		t.Errorf("expected no proxies running after Stop, got %d", len(s.running))
+	}
+}
+
+func TestSupervisor_ReloadRollsBackFailedVerification(t *testing.T) {
+	s, runs := newSupervisorForTest(t)
+	// Runners of "bad" proxies fail every check, all others succeed right away
+	run := s.run
+	s.run = func(ctx context.Context, proxyID string, spec runSpec, shared Shared) {
+		run(ctx, proxyID, spec, shared)
+		if !strings.HasPrefix(spec.proxyConfig.Proxy, "bad") {
+			shared.Verify.Record(proxyID, "success")
+		}
+	}
+
+	previous := supervisorConfig("verify-a:1080")
+	s.Apply(previous)
+	runs.waitStarted(t, 1)
+	ctxA := runs.ctx("proxy_1")
+
+	good := supervisorConfig("verify-a:1080", "verify-b:1080")
+	good.ReloadVerifyTimeoutMs = 50
+	if err := s.Reload(func() (*config.ProxyConfig, error) { return good, nil }); err != nil {
+		t.Fatalf("Reload() error = %v for proxies that succeed", err)
+	}
+	if s.Current() != good {
+		t.Fatal("expected the verified config to be applied")
+	}
+
+	bad := supervisorConfig("verify-a:1080", "verify-b:1080", "bad:1080")
+	bad.ReloadVerifyTimeoutMs = 50
+	errorsBefore := testutil.ToFloat64(s.m.ConfigReloadErrors)
+	err := s.Reload(func() (*config.ProxyConfig, error) { return bad, nil })
+	if err == nil || !strings.Contains(err.Error(), "proxy_3") {
+		t.Fatalf("Reload() error = %v, want a verification error naming proxy_3", err)
+	}
+
+	if got := testutil.ToFloat64(s.m.ConfigReloadErrors) - errorsBefore; got != 1 {
+		t.Errorf("config_reload_errors_total increased by %v, want 1", got)
+	}
+	if s.Current() != good {
+		t.Error("expected the previous config to be applied again")
+	}
+	if len(s.running) != 2 {
+		t.Errorf("expected 2 proxies after the rollback, got %d", len(s.running))
+	}
+	if runs.ctx("proxy_3").Err() == nil {
+		t.Error("expected the failing proxy_3 to be stopped")
+	}
+	if ctxA.Err() != nil || runs.ctx("proxy_2").Err() != nil {
+		t.Error("expected unchanged proxies to keep running")
+	}
+}
+
+func TestSupervisor_RollbackRestoresRemovedProxies(t *testing.T) {
+	s, runs := newSupervisorForTest(t)
+	run := s.run
+	s.run = func(ctx context.Context, proxyID string, spec runSpec, shared Shared) {
+		run(ctx, proxyID, spec, shared)
+		s.m.RequestsTotal.WithLabelValues(proxyID, "socks5", "success", "", "2xx").Inc()
+		if !strings.HasPrefix(spec.proxyConfig.Proxy, "bad") {
+			shared.Verify.Record(proxyID, "success")
+		}
+	}
+	series := func(proxyID string) float64 {
+		return testutil.ToFloat64(s.m.RequestsTotal.WithLabelValues(proxyID, "socks5", "success", "", "2xx"))
+	}
+
+	previous := supervisorConfig("keep:1080", "removed:1080")
+	s.Apply(previous)
+	runs.waitStarted(t, 2)
+
+	// The rejected config drops proxy_2 and adds the failing proxy_3
+	bad := supervisorConfig("keep:1080", "bad:1080")
+	bad.ReloadVerifyTimeoutMs = 50
+	if err := s.Reload(func() (*config.ProxyConfig, error) { return bad, nil }); err == nil {
+		t.Fatal("Reload() error = nil, want a verification error")
+	}
+	if id := s.running["socks5://removed:1080 "].id; id != "proxy_2" {
+		t.Errorf("restored proxy got ID %s, want its old proxy_2", id)
+	}
+	if got := series("proxy_2"); got != 2 {
+		t.Errorf("requests_total of proxy_2 = %v, want its series kept through the rollback", got)
+	}
+	if got := series("proxy_3"); got != 0 {
+		t.Errorf("requests_total of proxy_3 = %v, want the rejected proxy's series deleted", got)
+	}
+
+	// A verified reload deletes the series of the proxies it removed
+	good := supervisorConfig("keep:1080")
+	good.ReloadVerifyTimeoutMs = 50
+	if err := s.Reload(func() (*config.ProxyConfig, error) { return good, nil }); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if got := series("proxy_2"); got != 0 {
+		t.Errorf("requests_total of proxy_2 = %v, want it deleted after the verified reload", got)
+	}
+	if got := series("proxy_1"); got != 1 {
+		t.Errorf("requests_total of proxy_1 = %v, want the unchanged proxy kept", got)
+	}
+}
+
+func TestWarnUnreloadable_NewLabelKeys(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	cur := supervisorConfig("a:1080")
+	next := supervisorConfig("a:1080", "b:1080", "c:1080")
+	next.Proxies[1].Labels = map[string]string{"region": "eu", "name": "wifi"}
+	next.Proxies[2].Canary = true
+
+	warnUnreloadable(cur, next, []string{"region"})
+	if want := "label keys canary, name are not exported until a restart"; !strings.Contains(logs.String(), want) {
+		t.Errorf("logs = %q, want a warning %q", logs.String(), want)
+	}
+
+	logs.Reset()
+	warnUnreloadable(cur, next, []string{"canary", "name", "region"})
+	if strings.Contains(logs.String(), "label keys") {
+		t.Errorf("logs = %q, want no warning for exported label keys", logs.String())
+	}
+}
+
+func TestSupervisor_BadProxyDoesNotStopOthers(t *testing.T) {
+	var hits atomic.Int32
+	// Answers as the HTTP proxy of the good proxy
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer stub.Close()
+
+	m := metricstest.New(t)
+	s := NewSupervisor(m, Shared{})
+	cfg := &config.ProxyConfig{
+		DefaultTargetURL: "http://example.com/",
+		RequestInterval:  20,
+		RequestTimeout:   5,
+		Proxies: []config.Proxy{
+			{Protocol: "socks5", Proxy: "http://bad.example:1080"},
+			{Protocol: "http", Proxy: strings.TrimPrefix(stub.URL, "http://")},
+		},
+	}
+	s.Apply(cfg)
+	defer s.Stop()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for (hits.Load() < 2 || testutil.ToFloat64(m.ProxyInitErrors.WithLabelValues("proxy_1", "socks5")) == 0) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := testutil.ToFloat64(m.ProxyInitErrors.WithLabelValues("proxy_1", "socks5")); got < 1 {
+		t.Errorf("proxy_init_errors_total of the bad proxy = %v, want at least 1", got)
+	}
+	if got := hits.Load(); got < 2 {
+		t.Errorf("good proxy checked %d times, want it to keep running", got)
+	}
+}
+
+func TestSupervisor_PerProxyTimeout(t *testing.T) {
+	s, runs := newSupervisorForTest(t)
+
+	cfg := supervisorConfig("a:1080", "b:1080")
+	cfg.Proxies[1].RequestTimeoutMs = 500
+	s.Apply(cfg)
+	runs.waitStarted(t, 2)
+
+	if got := runs.spec("proxy_1").requestTimeout; got != 5*time.Second {
+		t.Errorf("proxy_1 timeout = %v, want the global 5s", got)
+	}
+	if got := runs.spec("proxy_2").requestTimeout; got != 500*time.Millisecond {
+		t.Errorf("proxy_2 timeout = %v, want its own 500ms", got)
+	}
+}
+
+func TestSupervisor_Stop(t *testing.T) {
+	s, runs := newSupervisorForTest(t)
+
+	s.Apply(supervisorConfig("stop-a:1080", "stop-b:1080"))
+	started := runs.waitStarted(t, 2)
+
+	s.Stop()
+	for _, id := range started {
+		if runs.ctx(id).Err() == nil {
+			t.Errorf("expected %s to be stopped", id)
+		}
+	}
+	if len(s.running) != 0 {
+		t.Errorf("running = %v, want none after Stop", s.running)
+	}
+}